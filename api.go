@@ -1,9 +1,54 @@
 // api.go
 package main
 
+// PutRequest 中 TTLSeconds 大于 0 时写入在该秒数之后过期，只对 /put 有效
 type PutRequest struct {
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
+
+// BatchOp 中 Op 为 "put" 或 "delete"，CF 为空时写入默认列族
+type BatchOp struct {
+	Op    string `json:"op"`
+	CF    string `json:"cf,omitempty"`
 	Key   string `json:"key"`
-	Value string `json:"value"`
+	Value string `json:"value,omitempty"`
+}
+
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// ColumnFamilyRequest 用于创建列族，新列族使用服务器打开数据库时的选项
+type ColumnFamilyRequest struct {
+	Name string `json:"name"`
+}
+
+// TxnRequest 中 LockTimeoutMs 只对悲观事务有效，0 表示使用默认值
+type TxnRequest struct {
+	Pessimistic   bool  `json:"pessimistic"`
+	LockTimeoutMs int64 `json:"lock_timeout_ms"`
+}
+
+type TxnResponse struct {
+	ID string `json:"id"`
+}
+
+// BackupRequest 用于基础备份和检查点，Dir 是备份根目录（LSMTREE_BACKUP_ROOT，默认 ./backups）下的目标目录，
+// 必须不存在或为空
+type BackupRequest struct {
+	Dir string `json:"dir"`
+}
+
+// BackupEngineRequest 用于增量备份的管理接口，Dir 是备份目录。ID 为 0 表示最新的备份；
+// Target 是恢复的目标目录，Dir 和 Target 都是备份根目录下的相对路径；Keep 和 MaxAgeSeconds 是清理条件，为 0 时不按对应条件清理
+type BackupEngineRequest struct {
+	Dir           string `json:"dir"`
+	ID            uint64 `json:"id"`
+	Target        string `json:"target"`
+	Keep          int    `json:"keep"`
+	MaxAgeSeconds int64  `json:"max_age_seconds"`
 }
 
 type GetRequest struct {
@@ -15,3 +60,13 @@ type GetResponse struct {
 	Value string `json:"value"`
 	Found bool   `json:"found"`
 }
+
+type ScanEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ScanCursor 在达到 limit 时作为最后一行返回，Next 作为下一页的 start
+type ScanCursor struct {
+	Next string `json:"next"`
+}
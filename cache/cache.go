@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy 决定分片满了之后淘汰哪个条目
+type Policy int
+
+const (
+	// LRU 淘汰最久没有被访问的条目
+	LRU Policy = iota
+	// CLOCK 用一个指针扫描环形队列，跳过最近访问过的条目并清除它们的访问标记，
+	// 命中时只设置标记，不需要移动链表节点
+	CLOCK
+)
+
+const numShards = 16
+
+// Key 由表文件的 ID 和 block 在文件中的偏移组成
+type Key struct {
+	ID     uint64
+	Offset uint64
+}
+
+// Stats 是缓存的统计信息，Usage 包括固定的条目
+type Stats struct {
+	Hits     uint64
+	Misses   uint64
+	Usage    int64
+	Capacity int64
+}
+
+// Cache 是按键哈希分片、按字节数限制容量的缓存，每个分片有自己的锁。
+// 固定（pinned）的条目计入用量但不会被淘汰，直到调用 Erase
+type Cache struct {
+	shards   [numShards]shard
+	capacity int64
+	nextID   atomic.Uint64
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type entry struct {
+	key     Key
+	value   any
+	charge  int64
+	pinned  bool
+	visited bool
+}
+
+type shard struct {
+	mutex    sync.Mutex
+	policy   Policy
+	capacity int64
+	usage    int64
+	table    map[Key]*list.Element
+	// LRU 中越靠前越新；CLOCK 中是环形队列，hand 是下一个要检查的位置
+	list *list.List
+	hand *list.Element
+}
+
+// New 创建总容量为 capacity 字节的缓存，容量平均分给各个分片
+func New(capacity int64, policy Policy) *Cache {
+	c := &Cache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = shard{
+			policy:   policy,
+			capacity: (capacity + numShards - 1) / numShards,
+			table:    make(map[Key]*list.Element),
+			list:     list.New(),
+		}
+	}
+	return c
+}
+
+// NewID 返回一个新的 ID，用于没有稳定 ID 的表文件。返回的 ID 最高位为 1，
+// 不会与调用方用作 ID 的文件号冲突
+func (c *Cache) NewID() uint64 {
+	return c.nextID.Add(1) | 1<<63
+}
+
+func (c *Cache) shard(key Key) *shard {
+	h := key.ID*0x9e3779b97f4a7c15 ^ key.Offset
+	h ^= h >> 29
+	return &c.shards[h%numShards]
+}
+
+// Get 返回缓存的值并更新命中和未命中计数
+func (c *Cache) Get(key Key) (any, bool) {
+	value, ok := c.shard(key).get(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return value, ok
+}
+
+// Set 插入或替换一个条目，charge 是它占用的字节数
+func (c *Cache) Set(key Key, value any, charge int64) {
+	c.shard(key).set(key, value, charge, false)
+}
+
+// SetPinned 插入一个不会被淘汰的条目
+func (c *Cache) SetPinned(key Key, value any, charge int64) {
+	c.shard(key).set(key, value, charge, true)
+}
+
+// Erase 删除一个条目，包括固定的条目
+func (c *Cache) Erase(key Key) {
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if elem, ok := s.table[key]; ok {
+		s.remove(elem)
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	stats := Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Capacity: c.capacity}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mutex.Lock()
+		stats.Usage += s.usage
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+func (s *shard) get(key Key) (any, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.table[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if s.policy == CLOCK {
+		e.visited = true
+	} else {
+		s.list.MoveToFront(elem)
+	}
+	return e.value, true
+}
+
+func (s *shard) set(key Key, value any, charge int64, pinned bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if elem, ok := s.table[key]; ok {
+		s.remove(elem)
+	}
+	e := &entry{key: key, value: value, charge: charge, pinned: pinned}
+	var elem *list.Element
+	switch {
+	case s.policy == LRU:
+		elem = s.list.PushFront(e)
+	case s.hand != nil:
+		// 插在指针之前，新条目要等指针转一圈之后才会被检查
+		elem = s.list.InsertBefore(e, s.hand)
+	default:
+		elem = s.list.PushBack(e)
+	}
+	s.table[key] = elem
+	s.usage += charge
+	s.evict()
+}
+
+func (s *shard) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	if s.hand == elem {
+		s.hand = elem.Next()
+	}
+	s.list.Remove(elem)
+	delete(s.table, e.key)
+	s.usage -= e.charge
+}
+
+// evict 淘汰条目直到用量不超过容量。全部是固定条目时允许超出容量
+func (s *shard) evict() {
+	if s.policy == CLOCK {
+		s.evictClock()
+		return
+	}
+	for elem := s.list.Back(); elem != nil && s.usage > s.capacity; {
+		prev := elem.Prev()
+		if !elem.Value.(*entry).pinned {
+			s.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+func (s *shard) evictClock() {
+	// 每个条目最多被检查两次：第一次清除访问标记，第二次淘汰
+	for budget := 2 * s.list.Len(); s.usage > s.capacity && budget > 0; budget-- {
+		if s.hand == nil {
+			s.hand = s.list.Front()
+		}
+		elem := s.hand
+		e := elem.Value.(*entry)
+		switch {
+		case e.pinned:
+			s.hand = elem.Next()
+		case e.visited:
+			e.visited = false
+			s.hand = elem.Next()
+		default:
+			s.remove(elem)
+		}
+	}
+}
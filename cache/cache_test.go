@@ -0,0 +1,68 @@
+package cache
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	c := New(numShards*3, LRU)
+	// 同一个 ID 的键可能落在不同分片，这里直接测试单个分片
+	s := &c.shards[0]
+	for i := uint64(0); i < 3; i++ {
+		s.set(Key{Offset: i}, i, 1, false)
+	}
+	s.get(Key{Offset: 0})
+	s.set(Key{Offset: 3}, 3, 1, false)
+	if _, ok := s.get(Key{Offset: 1}); ok {
+		t.Errorf("Least recently used entry was not evicted")
+	}
+	for _, offset := range []uint64{0, 2, 3} {
+		if _, ok := s.get(Key{Offset: offset}); !ok {
+			t.Errorf("Entry %d was evicted", offset)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := New(numShards*3, CLOCK)
+	s := &c.shards[0]
+	for i := uint64(0); i < 3; i++ {
+		s.set(Key{Offset: i}, i, 1, false)
+	}
+	// 访问过的条目得到第二次机会
+	s.get(Key{Offset: 0})
+	s.get(Key{Offset: 2})
+	s.set(Key{Offset: 3}, 3, 1, false)
+	if _, ok := s.get(Key{Offset: 1}); ok {
+		t.Errorf("Unvisited entry was not evicted")
+	}
+	if s.usage != 3 {
+		t.Errorf("usage = %d, expected 3", s.usage)
+	}
+}
+
+func TestPinnedAndStats(t *testing.T) {
+	for _, policy := range []Policy{LRU, CLOCK} {
+		c := New(numShards, policy)
+		pinned := Key{ID: c.NewID()}
+		c.SetPinned(pinned, "index", 100)
+		for i := uint64(1); i <= 100; i++ {
+			c.Set(Key{ID: pinned.ID, Offset: i}, i, 1)
+		}
+		if _, ok := c.Get(pinned); !ok {
+			t.Errorf("policy %d: pinned entry was evicted", policy)
+		}
+		if _, ok := c.Get(Key{ID: pinned.ID + 1}); ok {
+			t.Errorf("policy %d: found a key that was never inserted", policy)
+		}
+		stats := c.Stats()
+		if stats.Hits != 1 || stats.Misses != 1 {
+			t.Errorf("policy %d: hits %d, misses %d", policy, stats.Hits, stats.Misses)
+		}
+		if stats.Usage > 100+stats.Capacity {
+			t.Errorf("policy %d: usage %d exceeds capacity %d plus pinned entries", policy, stats.Usage, stats.Capacity)
+		}
+		c.Erase(pinned)
+		if _, ok := c.Get(pinned); ok {
+			t.Errorf("policy %d: erased entry is still cached", policy)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package comparator
+
+import "bytes"
+
+// Comparator 定义键的全序。数据一旦用某个比较器写入就不能更换，
+// 否则 SSTable 索引和层内文件顺序都会失效
+type Comparator interface {
+	// Compare 返回负数、0 或正数，分别表示 a < b、a == b、a > b
+	Compare(a, b []byte) int
+	// Name 记录在 MANIFEST 和 SSTable 中，重新打开时用来检查比较器是否一致
+	Name() string
+}
+
+type bytewise struct{}
+
+func (bytewise) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewise) Name() string {
+	return "lsmtree.Bytewise"
+}
+
+// Bytewise 按字节序比较，是默认的比较器
+var Bytewise Comparator = bytewise{}
+
+type reverse struct {
+	c Comparator
+}
+
+func (r reverse) Compare(a, b []byte) int {
+	return r.c.Compare(b, a)
+}
+
+func (r reverse) Name() string {
+	return "lsmtree.Reverse(" + r.c.Name() + ")"
+}
+
+// Reverse 返回与 c 顺序相反的比较器
+func Reverse(c Comparator) Comparator {
+	return reverse{c: c}
+}
+
+type funcComparator struct {
+	name    string
+	compare func(a, b []byte) int
+}
+
+func (f funcComparator) Compare(a, b []byte) int {
+	return f.compare(a, b)
+}
+
+func (f funcComparator) Name() string {
+	return f.name
+}
+
+// New 用比较函数构造一个比较器，name 需要在不同的排序规则之间保持唯一
+func New(name string, compare func(a, b []byte) int) Comparator {
+	return funcComparator{name: name, compare: compare}
+}
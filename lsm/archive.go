@@ -0,0 +1,134 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// archiveDirName 是归档 WAL 段所在的子目录，文件名与原来相同
+const archiveDirName = "archive"
+
+func archiveDir(dir string) string {
+	return filepath.Join(dir, archiveDirName)
+}
+
+func (lsm *LSMTree) archivingLogs() bool {
+	return lsm.opts.WALTTL > 0 || lsm.opts.WALSizeLimit > 0
+}
+
+// releaseObsoleteLogs 处理编号小于 logNumber 的 WAL 段：开启归档时移到 archive 目录，
+// 否则删除。旧版本的 wal.log 没有序列号范围可言，总是直接删除
+func (lsm *LSMTree) releaseObsoleteLogs(logNumber uint64) error {
+	entries, err := os.ReadDir(lsm.baseDir)
+	if err != nil {
+		return err
+	}
+	archived := false
+	for _, entry := range entries {
+		name := entry.Name()
+		number, ok := parseLogName(name)
+		if entry.IsDir() || name != legacyLogName && (!ok || number >= logNumber) {
+			continue
+		}
+		path := filepath.Join(lsm.baseDir, name)
+		if name == legacyLogName || !lsm.archivingLogs() {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if !archived {
+			if err := os.MkdirAll(archiveDir(lsm.baseDir), 0755); err != nil {
+				return err
+			}
+			archived = true
+		}
+		if err := os.Rename(path, filepath.Join(archiveDir(lsm.baseDir), name)); err != nil {
+			return err
+		}
+	}
+	if archived {
+		return lsm.purgeArchivedLogs()
+	}
+	return nil
+}
+
+// ArchivedLogs 返回归档的 WAL 段，按编号从小到大排列，可以用于复制或按时间点恢复
+func (lsm *LSMTree) ArchivedLogs() ([]string, error) {
+	lsm.archiveMutex.Lock()
+	defer lsm.archiveMutex.Unlock()
+	logs, err := archivedLogs(lsm.baseDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(logs))
+	for i, l := range logs {
+		paths[i] = l.path
+	}
+	return paths, nil
+}
+
+type archivedLog struct {
+	number  uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func archivedLogs(dir string) ([]archivedLog, error) {
+	entries, err := os.ReadDir(archiveDir(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var logs []archivedLog
+	for _, entry := range entries {
+		number, ok := parseLogName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, archivedLog{
+			number:  number,
+			path:    filepath.Join(archiveDir(dir), entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].number < logs[j].number })
+	return logs, nil
+}
+
+// purgeArchivedLogs 删除超过 WALTTL 的归档段，再从最旧的开始删除，直到总大小不超过 WALSizeLimit
+func (lsm *LSMTree) purgeArchivedLogs() error {
+	lsm.archiveMutex.Lock()
+	defer lsm.archiveMutex.Unlock()
+	logs, err := archivedLogs(lsm.baseDir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, l := range logs {
+		total += l.size
+	}
+	now := time.Now()
+	for _, l := range logs {
+		expired := lsm.opts.WALTTL > 0 && now.Sub(l.modTime) > lsm.opts.WALTTL
+		oversize := lsm.opts.WALSizeLimit > 0 && total > lsm.opts.WALSizeLimit
+		if !expired && !oversize {
+			continue
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= l.size
+	}
+	return nil
+}
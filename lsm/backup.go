@@ -0,0 +1,402 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 备份目录布局：
+//
+//	root/shared/sstable-N   各个备份共享的 SSTable 和 blob 文件，每个文件只复制一次
+//	root/meta/ID            备份 ID 对应的描述文件（JSON），写完之后备份才可见
+//
+// SSTable 写完之后不再修改，所以新备份只需要复制之前的备份中没有的表。
+// 一个备份目录只用于一个数据库（以及从它的备份恢复出来的数据库），同一时间只能有一个操作。
+// 恢复出来的数据库与原数据库各自分配文件号，可能产生同名但内容不同的文件，
+// 因此只有名字、大小和校验和都相同时才复用共享文件，否则换一个名字保存
+const (
+	backupSharedDir = "shared"
+	backupMetaDir   = "meta"
+)
+
+// ErrBackupCorrupted 表示备份引用的文件缺失，或者大小、校验和与记录的不一致
+var ErrBackupCorrupted = errors.New("backup is corrupted")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Backup 描述一个备份。Families、Tables 和 Blobs 是恢复时写入 MANIFEST 的列族和文件集合，
+// Files 是需要复制回数据库目录的文件，包括 blob 文件和旧版本留下的 .bloom 文件
+type Backup struct {
+	ID         uint64             `json:"id"`
+	Time       time.Time          `json:"time"`
+	Sequence   uint64             `json:"sequence"`
+	Comparator string             `json:"comparator"`
+	Families   []ColumnFamilyMeta `json:"families,omitempty"`
+	Tables     []FileMeta         `json:"tables"`
+	Blobs      []BlobMeta         `json:"blobs,omitempty"`
+	Files      []BackupFile       `json:"files"`
+	// Size 是备份引用的文件总大小，Copied 是创建备份时新复制的部分
+	Size   int64 `json:"size"`
+	Copied int64 `json:"copied"`
+}
+
+// BackupFile 是备份中的一个文件，Name 是数据库目录中的文件名。
+// Shared 是 shared 目录中的文件名，为空时与 Name 相同
+type BackupFile struct {
+	Name   string `json:"name"`
+	Shared string `json:"shared,omitempty"`
+	Size   int64  `json:"size"`
+	CRC32  uint32 `json:"crc32"`
+}
+
+func (f BackupFile) sharedName() string {
+	if f.Shared != "" {
+		return f.Shared
+	}
+	return f.Name
+}
+
+// CreateBackup 把当前 MemTable 刷盘，然后在 root 中创建一个新的备份，
+// 只复制之前的备份中还没有的 SSTable 和 blob 文件。第一个备份是全量备份
+func (lsm *LSMTree) CreateBackup(root string) (*Backup, error) {
+	for _, dir := range []string{backupSharedDir, backupMetaDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	backups, err := ListBackups(root)
+	if err != nil {
+		return nil, err
+	}
+	// shared 按数据库中的文件名记录已经保存的文件，同名的可能有多个；used 是 shared 目录中已经占用的名字
+	shared := make(map[string][]BackupFile)
+	used := make(map[string]bool)
+	var id uint64 = 1
+	for _, b := range backups {
+		for _, f := range b.Files {
+			if !used[f.sharedName()] {
+				shared[f.Name] = append(shared[f.Name], f)
+				used[f.sharedName()] = true
+			}
+		}
+		id = b.ID + 1
+	}
+
+	versions, state, err := lsm.flushAndRefVersions()
+	if err != nil {
+		return nil, err
+	}
+	defer lsm.unrefVersions(versions)
+	backup := &Backup{
+		ID:         id,
+		Time:       time.Now(),
+		Sequence:   state.lastSequence,
+		Comparator: state.comparator,
+		Families:   state.families,
+		Blobs:      state.blobs,
+	}
+	var names []string
+	for _, b := range state.blobs {
+		names = append(names, filepath.Base(blobFileName(lsm.baseDir, b.Number)))
+	}
+	for _, v := range versions {
+		for _, files := range v.levels {
+			for _, t := range files {
+				backup.Tables = append(backup.Tables, t.meta)
+				table := filepath.Base(tableFileName(lsm.baseDir, t.meta.Number))
+				names = append(names, table, table+".bloom")
+			}
+		}
+	}
+	for _, name := range names {
+		src := filepath.Join(lsm.baseDir, name)
+		crc, size, err := fileChecksum(src)
+		if err != nil {
+			if os.IsNotExist(err) && strings.HasSuffix(name, ".bloom") {
+				continue
+			}
+			return nil, err
+		}
+		f, ok := findSharedFile(shared[name], crc, size)
+		if !ok {
+			// 已经保存的文件永远不覆盖，同名文件内容不同时换一个名字
+			f = BackupFile{Name: name}
+			for n := 1; used[f.sharedName()]; n++ {
+				f.Shared = name + "." + strconv.Itoa(n)
+			}
+			if f.CRC32, f.Size, err = copyWithChecksum(src, filepath.Join(root, backupSharedDir, f.sharedName())); err != nil {
+				return nil, err
+			}
+			if err := f.check(id, crc, size); err != nil {
+				return nil, err
+			}
+			shared[name] = append(shared[name], f)
+			used[f.sharedName()] = true
+			backup.Copied += f.Size
+		}
+		backup.Files = append(backup.Files, f)
+		backup.Size += f.Size
+	}
+	if err := syncDir(filepath.Join(root, backupSharedDir)); err != nil {
+		return nil, err
+	}
+	if err := writeBackupMeta(root, backup); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+func findSharedFile(files []BackupFile, crc uint32, size int64) (BackupFile, bool) {
+	for _, f := range files {
+		if f.Size == size && f.CRC32 == crc {
+			return f, true
+		}
+	}
+	return BackupFile{}, false
+}
+
+// ListBackups 返回 root 中的所有备份，按 ID 从小到大排列
+func ListBackups(root string) ([]*Backup, error) {
+	entries, err := os.ReadDir(filepath.Join(root, backupMetaDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backups []*Backup
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		b, err := readBackupMeta(root, id)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID < backups[j].ID })
+	return backups, nil
+}
+
+// VerifyBackup 检查备份引用的每个文件都存在，并且大小和校验和与记录一致。id 为 0 时检查最新的备份
+func VerifyBackup(root string, id uint64) error {
+	b, err := loadBackup(root, id)
+	if err != nil {
+		return err
+	}
+	for _, f := range b.Files {
+		crc, size, err := fileChecksum(filepath.Join(root, backupSharedDir, f.sharedName()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%w: backup %d: %s is missing", ErrBackupCorrupted, b.ID, f.Name)
+			}
+			return err
+		}
+		if err := f.check(b.ID, crc, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreBackup 把备份复制到 dstDir，复制时检查校验和，恢复出的目录可以直接用 NewLSMTree 打开。
+// id 为 0 时恢复最新的备份。dstDir 必须不存在或为空
+func RestoreBackup(root string, id uint64, dstDir string) error {
+	b, err := loadBackup(root, id)
+	if err != nil {
+		return err
+	}
+	if err := ensureEmptyDir(dstDir); err != nil {
+		return err
+	}
+	for _, f := range b.Files {
+		crc, size, err := copyWithChecksum(filepath.Join(root, backupSharedDir, f.sharedName()), filepath.Join(dstDir, f.Name))
+		if err != nil {
+			return err
+		}
+		if err := f.check(b.ID, crc, size); err != nil {
+			return err
+		}
+	}
+	state := &versionState{comparator: b.Comparator, families: b.Families, files: b.Tables, blobs: b.Blobs, lastSequence: b.Sequence}
+	for _, meta := range b.Families {
+		state.nextFamilyID = max(state.nextFamilyID, meta.ID+1)
+	}
+	for _, meta := range b.Tables {
+		state.nextFileNumber = max(state.nextFileNumber, meta.Number+1)
+	}
+	for _, meta := range b.Blobs {
+		state.nextFileNumber = max(state.nextFileNumber, meta.Number+1)
+	}
+	if err := writeManifestSnapshot(dstDir, state); err != nil {
+		return err
+	}
+	return syncDir(dstDir)
+}
+
+// PurgeBackups 删除最新的 keep 个之外的备份，以及创建时间早于 maxAge 之前的备份，
+// 然后删除不再被任何备份引用的共享文件。keep 或 maxAge 为 0 时不按对应条件删除，
+// 返回被删除的备份 ID
+func PurgeBackups(root string, keep int, maxAge time.Duration) ([]uint64, error) {
+	backups, err := ListBackups(root)
+	if err != nil {
+		return nil, err
+	}
+	var purged []uint64
+	referenced := make(map[string]bool)
+	for i, b := range backups {
+		newer := len(backups) - 1 - i
+		if keep > 0 && newer >= keep || maxAge > 0 && time.Since(b.Time) > maxAge {
+			if err := os.Remove(filepath.Join(root, backupMetaDir, strconv.FormatUint(b.ID, 10))); err != nil {
+				return purged, err
+			}
+			purged = append(purged, b.ID)
+			continue
+		}
+		for _, f := range b.Files {
+			referenced[f.sharedName()] = true
+		}
+	}
+	if err := syncDir(filepath.Join(root, backupMetaDir)); err != nil && !os.IsNotExist(err) {
+		return purged, err
+	}
+
+	// 描述文件删除之后再删除共享文件，中途失败只会留下没有引用的文件，下次清理时删除
+	entries, err := os.ReadDir(filepath.Join(root, backupSharedDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return purged, nil
+		}
+		return purged, err
+	}
+	for _, entry := range entries {
+		if !referenced[entry.Name()] {
+			if err := os.Remove(filepath.Join(root, backupSharedDir, entry.Name())); err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+func (f BackupFile) check(id uint64, crc uint32, size int64) error {
+	if size != f.Size || crc != f.CRC32 {
+		return fmt.Errorf("%w: backup %d: %s has size %d and checksum %08x, expected %d and %08x",
+			ErrBackupCorrupted, id, f.Name, size, crc, f.Size, f.CRC32)
+	}
+	return nil
+}
+
+// loadBackup 读取编号为 id 的备份，id 为 0 时返回最新的备份
+func loadBackup(root string, id uint64) (*Backup, error) {
+	if id != 0 {
+		return readBackupMeta(root, id)
+	}
+	backups, err := ListBackups(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups in %s", root)
+	}
+	return backups[len(backups)-1], nil
+}
+
+func readBackupMeta(root string, id uint64) (*Backup, error) {
+	data, err := os.ReadFile(filepath.Join(root, backupMetaDir, strconv.FormatUint(id, 10)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("backup %d does not exist", id)
+		}
+		return nil, err
+	}
+	b := new(Backup)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("decode backup %d: %w", id, err)
+	}
+	return b, nil
+}
+
+// writeBackupMeta 先写临时文件再重命名，描述文件要么完整要么不存在
+func writeBackupMeta(root string, b *Backup) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(root, backupMetaDir)
+	tmp := filepath.Join(dir, strconv.FormatUint(b.ID, 10)+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, strconv.FormatUint(b.ID, 10))); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// copyWithChecksum 经由临时文件复制 src 并落盘，返回复制内容的校验和与大小
+func copyWithChecksum(src, dst string) (uint32, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	h := crc32.New(crcTable)
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	return h.Sum32(), n, nil
+}
+
+func fileChecksum(name string) (uint32, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	h := crc32.New(crcTable)
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return h.Sum32(), n, nil
+}
@@ -0,0 +1,279 @@
+package lsm
+
+import (
+	"sync"
+	"time"
+
+	"LSMTree/skiplist"
+	"LSMTree/wal"
+)
+
+// WriteBatch 收集多条写入，通过 LSMTree.Write 作为一条 WAL 记录原子地提交
+type WriteBatch struct {
+	entries []wal.Entry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put 复制 key 和 value，调用方之后可以继续复用它们
+func (b *WriteBatch) Put(key, value []byte) {
+	b.PutCF(nil, key, value)
+}
+
+// PutCF 写入列族 cf，cf 为 nil 时写入默认列族。同一个批次中不同列族的写入一起原子地提交
+func (b *WriteBatch) PutCF(cf *ColumnFamily, key, value []byte) {
+	b.entries = append(b.entries, wal.Entry{
+		Key:    append([]byte(nil), key...),
+		Value:  append([]byte(nil), value...),
+		Family: familyID(cf),
+	})
+}
+
+// PutWithTTL 与 Put 相同，但写入在 ttl 之后过期，读取时不再可见，合并时被删除
+func (b *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.PutWithTTLCF(nil, key, value, ttl)
+}
+
+func (b *WriteBatch) PutWithTTLCF(cf *ColumnFamily, key, value []byte, ttl time.Duration) {
+	b.entries = append(b.entries, wal.Entry{
+		Key:       append([]byte(nil), key...),
+		Value:     append([]byte(nil), value...),
+		ExpiresAt: time.Now().Add(ttl).UnixNano(),
+		Family:    familyID(cf),
+	})
+}
+
+// Merge 写入一个 merge 操作数，提交时要求列族的 Options.MergeOperator 不为空
+func (b *WriteBatch) Merge(key, operand []byte) {
+	b.MergeCF(nil, key, operand)
+}
+
+func (b *WriteBatch) MergeCF(cf *ColumnFamily, key, operand []byte) {
+	b.entries = append(b.entries, wal.Entry{
+		Key:    append([]byte(nil), key...),
+		Value:  append([]byte(nil), operand...),
+		Merge:  true,
+		Family: familyID(cf),
+	})
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.DeleteCF(nil, key)
+}
+
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) {
+	b.entries = append(b.entries, wal.Entry{Key: append([]byte(nil), key...), Deleted: true, Family: familyID(cf)})
+}
+
+// Clear 清空批次以便复用
+func (b *WriteBatch) Clear() {
+	b.entries = b.entries[:0]
+}
+
+func (b *WriteBatch) Count() int {
+	return len(b.entries)
+}
+
+// memTableEntries 把批次按列族编号分组转换为 MemTable 中的内部键，第 i 条记录的序列号为 seq+i
+func (b *WriteBatch) memTableEntries(seq uint64) map[uint32][]skiplist.Entry {
+	entries := make(map[uint32][]skiplist.Entry)
+	for i, e := range b.entries {
+		key, value := internalEntry(e, seq+uint64(i))
+		entries[e.Family] = append(entries[e.Family], skiplist.Entry{Key: key, Value: value})
+	}
+	return entries
+}
+
+// internalEntry 把 WAL 中的一条记录转换为 MemTable 中的内部键和值
+func internalEntry(e wal.Entry, seq uint64) ([]byte, []byte) {
+	switch {
+	case e.Deleted:
+		return makeInternalKey(nil, e.Key, seq, kindDelete), e.Value
+	case e.Merge:
+		return makeInternalKey(nil, e.Key, seq, kindMerge), e.Value
+	case e.ExpiresAt != 0:
+		return makeInternalKey(nil, e.Key, seq, kindPutTTL), appendTTLValue(nil, e.ExpiresAt, e.Value)
+	}
+	return makeInternalKey(nil, e.Key, seq, kindPut), e.Value
+}
+
+// checkBatch 检查批次写入的列族都存在，写入 merge 操作数的列族设置了 MergeOperator，调用方需持有 mutex
+func (lsm *LSMTree) checkBatch(batch *WriteBatch) error {
+	for _, e := range batch.entries {
+		cf, ok := lsm.families[e.Family]
+		if !ok {
+			return errColumnFamilyDropped
+		}
+		if e.Merge && cf.opts.MergeOperator == nil {
+			return errNoMergeOperator
+		}
+	}
+	return nil
+}
+
+// size 返回批次中键和值的总字节数，用于限制一次组提交的大小
+func (b *WriteBatch) size() int {
+	n := 0
+	for _, e := range b.entries {
+		n += len(e.Key) + len(e.Value)
+	}
+	return n
+}
+
+// WriteOptions 控制单次写入的持久性，nil 表示按 Options.SyncMode 落盘
+type WriteOptions struct {
+	// Sync 为真时写入返回前 WAL 一定已经落盘，与 SyncMode 无关
+	Sync bool
+	// DisableWAL 为真时不写 WAL，进程崩溃会丢失尚未刷盘的写入。
+	// 开启 WAL 归档时不能使用，见 ErrDisableWALWithArchive
+	DisableWAL bool
+}
+
+// writer 是写入队列中的一项。batch 为 nil 表示 Flush 或 Close 需要独占写入队列
+type writer struct {
+	batch      *WriteBatch
+	sync       bool
+	disableWAL bool
+	validate   func() error
+	done       bool
+	err        error
+	cond       *sync.Cond
+}
+
+const (
+	maxGroupSize   = 1 << 20
+	smallGroupSize = 128 << 10
+)
+
+// Write 先把整个批次写入 WAL，再一次性应用到 MemTable。
+// 读操作在持有 mutex 时获取序列号，lastSequence 在批次全部写入后才推进，因此批次整体可见
+func (lsm *LSMTree) Write(batch *WriteBatch) error {
+	return lsm.write(batch, nil, nil)
+}
+
+func (lsm *LSMTree) WriteWithOptions(batch *WriteBatch, opts *WriteOptions) error {
+	return lsm.write(batch, opts, nil)
+}
+
+// write 把批次加入写入队列。队首的写入者成为 leader，把排在后面的批次合并成一条 WAL 记录，
+// 在 mutex 之外写入并落盘，然后代替它们写入 MemTable，其余写入者只需等待结果。
+// validate 不为空时该批次单独提交，leader 在持有 mutex 的情况下先调用 validate，
+// 事务借此保证校验和写入之间没有其他写入插入
+func (lsm *LSMTree) write(batch *WriteBatch, opts *WriteOptions, validate func() error) error {
+	if batch.Count() == 0 {
+		return nil
+	}
+	w := &writer{batch: batch, validate: validate, cond: sync.NewCond(&lsm.mutex)}
+	if opts != nil {
+		w.sync = opts.Sync
+		w.disableWAL = opts.DisableWAL
+	}
+	if w.disableWAL && lsm.archivingLogs() {
+		return ErrDisableWALWithArchive
+	}
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+
+	if !lsm.waitForTurn(w) {
+		return w.err
+	}
+	group := []*writer{w}
+	err := lsm.makeRoomForWrite()
+	if err == nil {
+		err = lsm.checkBatch(batch)
+	}
+	if err == nil && validate != nil {
+		err = validate()
+	}
+	if err == nil {
+		if validate == nil {
+			group = lsm.buildGroup(w)
+		}
+		err = lsm.commitGroup(group)
+	}
+	lsm.finishWriters(group, err)
+	return err
+}
+
+// waitForTurn 把 w 加入写入队列，等到它成为队首时返回 true；
+// 如果在此之前已经被其他 leader 提交，返回 false，结果在 w.err 中
+func (lsm *LSMTree) waitForTurn(w *writer) bool {
+	lsm.writers = append(lsm.writers, w)
+	for !w.done && lsm.writers[0] != w {
+		w.cond.Wait()
+	}
+	return !w.done
+}
+
+// buildGroup 从队首开始收集可以一起提交的写入者。需要落盘的写入不会并入不落盘的组，
+// 带校验的事务、Flush 和不能提交的批次单独处理；leader 的批次较小时限制组的大小，避免小写入的延迟被放大
+func (lsm *LSMTree) buildGroup(leader *writer) []*writer {
+	size := leader.batch.size()
+	maxSize := maxGroupSize
+	if size <= smallGroupSize {
+		maxSize = size + smallGroupSize
+	}
+	group := []*writer{leader}
+	for _, w := range lsm.writers[1:] {
+		if w.batch == nil || w.validate != nil || (w.sync && !leader.sync) || w.disableWAL != leader.disableWAL || lsm.checkBatch(w.batch) != nil {
+			break
+		}
+		size += w.batch.size()
+		if size > maxSize {
+			break
+		}
+		group = append(group, w)
+	}
+	return group
+}
+
+// commitGroup 把一组批次作为一条 WAL 记录写入。调用方是队首的 leader 并持有 mutex，
+// 写 WAL 期间释放 mutex，其他写入者只能排队，因此 lsm.wal 和 MemTable 不会被切换
+func (lsm *LSMTree) commitGroup(group []*writer) error {
+	batch := group[0].batch
+	if len(group) > 1 {
+		batch = NewWriteBatch()
+		for _, w := range group {
+			batch.entries = append(batch.entries, w.batch.entries...)
+		}
+	}
+	seq := lsm.lastSequence + 1
+	leader := group[0]
+	if !leader.disableWAL {
+		logFile := lsm.wal
+		lsm.mutex.Unlock()
+		//写入WAL
+		err := logFile.WriteBatch(seq, batch.entries)
+		if err == nil && leader.sync && lsm.opts.SyncMode != wal.SyncEveryWrite {
+			err = logFile.Sync()
+		}
+		lsm.mutex.Lock()
+		if err != nil {
+			// 失败的写入可能已经部分落到 WAL 中，继续追加会让恢复在日志中间遇到损坏的记录
+			lsm.bgErr = err
+			lsm.flushCond.Broadcast()
+			return err
+		}
+	}
+	//写入MemTable，批次中的列族都已通过检查，删除列族需要排到写入队列队首，因此此时都还存在
+	for family, entries := range batch.memTableEntries(seq) {
+		lsm.families[family].memTable.Write(entries)
+	}
+	lsm.lastSequence += uint64(batch.Count())
+	return nil
+}
+
+// finishWriters 把完成的写入者移出队列并唤醒它们，然后唤醒新的队首
+func (lsm *LSMTree) finishWriters(group []*writer, err error) {
+	for _, w := range group {
+		w.done = true
+		w.err = err
+		w.cond.Signal()
+	}
+	lsm.writers = lsm.writers[len(group):]
+	if len(lsm.writers) > 0 {
+		lsm.writers[0].cond.Signal()
+	}
+}
@@ -0,0 +1,466 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blob 文件保存键值分离之后的大值，只追加不修改：
+//
+//	| crc32 (4) | keyLen (uvarint) | valueLen (uvarint) | user key | value |
+//
+// crc32 覆盖之后的全部字节。刷盘和合并时，不小于 BlobValueThreshold 的值写进 blob 文件，
+// SSTable 中对应记录的 kind 改为 kindBlob，值换成指向记录的 blobIndex，之后的合并只搬动指针。
+// 合并丢弃 kindBlob 记录时把记录计为所在 blob 文件的垃圾，有效比例低于 BlobGCRatio 的文件
+// 在合并时把仍然有效的值搬到新的 blob 文件，所有记录都成为垃圾之后文件被删除
+func blobFileName(dir string, number uint64) string {
+	return fmt.Sprintf("%s/%06d.blob", dir, number)
+}
+
+func parseBlobName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".blob") {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(name, ".blob"), 10, 64)
+	return number, err == nil
+}
+
+var errBlobCorrupted = errors.New("blob record is corrupted")
+
+// BlobMeta 描述 MANIFEST 中记录的一个 blob 文件，Count 和 Size 是全部记录的个数和字节数，
+// GarbageCount 和 GarbageSize 是其中已经没有 SSTable 引用的部分
+type BlobMeta struct {
+	Number       uint64 `json:"number"`
+	Count        int64  `json:"count"`
+	Size         int64  `json:"size"`
+	GarbageCount int64  `json:"garbage_count,omitempty"`
+	GarbageSize  int64  `json:"garbage_size,omitempty"`
+}
+
+// LiveRatio 返回仍被引用的字节所占的比例
+func (m *BlobMeta) LiveRatio() float64 {
+	if m.Size == 0 {
+		return 0
+	}
+	return float64(m.Size-m.GarbageSize) / float64(m.Size)
+}
+
+// obsolete 表示所有记录都已经成为垃圾
+func (m *BlobMeta) obsolete() bool {
+	return m.GarbageCount >= m.Count
+}
+
+// blobGarbage 是一次合并在某个 blob 文件中新产生的垃圾
+type blobGarbage struct {
+	Number uint64 `json:"number"`
+	Count  int64  `json:"count"`
+	Size   int64  `json:"size"`
+}
+
+// blobIndex 是 kindBlob 记录的值，size 是整条 blob 记录的长度
+type blobIndex struct {
+	number uint64
+	offset uint64
+	size   uint64
+}
+
+func (idx blobIndex) encode() []byte {
+	buf := binary.AppendUvarint(nil, idx.number)
+	buf = binary.AppendUvarint(buf, idx.offset)
+	return binary.AppendUvarint(buf, idx.size)
+}
+
+func decodeBlobIndex(data []byte) (blobIndex, error) {
+	var idx blobIndex
+	var n int
+	for _, field := range []*uint64{&idx.number, &idx.offset, &idx.size} {
+		v, m := binary.Uvarint(data[n:])
+		if m <= 0 {
+			return blobIndex{}, fmt.Errorf("%w: invalid blob index", errBlobCorrupted)
+		}
+		*field = v
+		n += m
+	}
+	return idx, nil
+}
+
+// blobWriter 顺序写一个 blob 文件
+type blobWriter struct {
+	path   string
+	file   *os.File
+	buf    *bufio.Writer
+	meta   BlobMeta
+	record []byte
+}
+
+func newBlobWriter(dir string, number uint64) (*blobWriter, error) {
+	path := blobFileName(dir, number)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{path: path, file: file, buf: bufio.NewWriter(file), meta: BlobMeta{Number: number}}, nil
+}
+
+func (w *blobWriter) add(userKey, value []byte) (blobIndex, error) {
+	w.record = append(w.record[:0], 0, 0, 0, 0)
+	w.record = binary.AppendUvarint(w.record, uint64(len(userKey)))
+	w.record = binary.AppendUvarint(w.record, uint64(len(value)))
+	w.record = append(w.record, userKey...)
+	w.record = append(w.record, value...)
+	binary.LittleEndian.PutUint32(w.record, crc32.Checksum(w.record[4:], crcTable))
+	if _, err := w.buf.Write(w.record); err != nil {
+		return blobIndex{}, err
+	}
+	idx := blobIndex{number: w.meta.Number, offset: uint64(w.meta.Size), size: uint64(len(w.record))}
+	w.meta.Count++
+	w.meta.Size += int64(len(w.record))
+	return idx, nil
+}
+
+// finish 把文件落盘，之后才能把引用它的 SSTable 写入 MANIFEST
+func (w *blobWriter) finish() (BlobMeta, error) {
+	err := w.buf.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.path)
+		return BlobMeta{}, err
+	}
+	return w.meta, nil
+}
+
+func (w *blobWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
+
+// blobFiles 缓存打开的 blob 文件。文件只在没有任何版本引用之后才删除，
+// 读取期间调用方持有版本引用，所以不需要引用计数
+type blobFiles struct {
+	dir   string
+	mutex sync.Mutex
+	files map[uint64]*os.File
+}
+
+func newBlobFiles(dir string) *blobFiles {
+	return &blobFiles{dir: dir, files: make(map[uint64]*os.File)}
+}
+
+func (c *blobFiles) open(number uint64) (*os.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if f, ok := c.files[number]; ok {
+		return f, nil
+	}
+	f, err := os.Open(blobFileName(c.dir, number))
+	if err != nil {
+		return nil, err
+	}
+	c.files[number] = f
+	return f, nil
+}
+
+// read 读取 value 指向的记录，检查校验和以及记录中的键是否为 userKey，返回值的副本
+func (c *blobFiles) read(userKey, value []byte) ([]byte, error) {
+	idx, err := decodeBlobIndex(value)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.open(idx.number)
+	if err != nil {
+		return nil, fmt.Errorf("open blob %d: %w", idx.number, err)
+	}
+	record := make([]byte, idx.size)
+	if _, err := f.ReadAt(record, int64(idx.offset)); err != nil {
+		return nil, fmt.Errorf("read blob %d: %w", idx.number, err)
+	}
+	if len(record) < 4 || crc32.Checksum(record[4:], crcTable) != binary.LittleEndian.Uint32(record) {
+		return nil, fmt.Errorf("%w: checksum mismatch in blob %d at %d", errBlobCorrupted, idx.number, idx.offset)
+	}
+	rest := record[4:]
+	keyLen, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: blob %d at %d", errBlobCorrupted, idx.number, idx.offset)
+	}
+	rest = rest[n:]
+	valueLen, n := binary.Uvarint(rest)
+	if n <= 0 || keyLen+valueLen != uint64(len(rest)-n) {
+		return nil, fmt.Errorf("%w: blob %d at %d", errBlobCorrupted, idx.number, idx.offset)
+	}
+	rest = rest[n:]
+	if string(rest[:keyLen]) != string(userKey) {
+		return nil, fmt.Errorf("%w: blob %d at %d belongs to another key", errBlobCorrupted, idx.number, idx.offset)
+	}
+	return rest[keyLen:], nil
+}
+
+func (c *blobFiles) evict(number uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if f, ok := c.files[number]; ok {
+		f.Close()
+		delete(c.files, number)
+	}
+}
+
+func (c *blobFiles) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for number, f := range c.files {
+		f.Close()
+		delete(c.files, number)
+	}
+}
+
+// blobSeparator 在写 SSTable 时决定哪些值放进 blob 文件：不小于 BlobValueThreshold 的 Put，
+// 以及指向待回收 blob 文件的值。blob 文件在第一次需要时创建，一次刷盘或合并最多写一个
+type blobSeparator struct {
+	lsm       *LSMTree
+	threshold int
+	victims   map[uint64]bool
+	writer    *blobWriter
+	// refs 是当前输出的 SSTable 引用的 blob 文件
+	refs    map[uint64]bool
+	garbage map[uint64]*blobGarbage
+}
+
+// newBlobSeparator 按列族 cf 的 BlobValueThreshold 分离值
+func (lsm *LSMTree) newBlobSeparator(cf *ColumnFamily, victims map[uint64]bool) *blobSeparator {
+	return &blobSeparator{
+		lsm:       lsm,
+		threshold: cf.opts.BlobValueThreshold,
+		victims:   victims,
+		refs:      make(map[uint64]bool),
+		garbage:   make(map[uint64]*blobGarbage),
+	}
+}
+
+// add 返回写入 SSTable 的内部键和值，需要搬进 blob 文件时键的 kind 改为 kindBlob
+func (s *blobSeparator) add(key, value []byte) ([]byte, []byte, error) {
+	userKey, seq, kind := parseInternalKey(key)
+	switch kind {
+	case kindPut:
+		if s.threshold <= 0 || len(value) < s.threshold {
+			return key, value, nil
+		}
+	case kindBlob:
+		idx, err := decodeBlobIndex(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !s.victims[idx.number] {
+			s.refs[idx.number] = true
+			return key, value, nil
+		}
+		// 待回收文件中仍然有效的值搬到新的 blob 文件
+		if value, err = s.lsm.blobFiles.read(userKey, value); err != nil {
+			return nil, nil, err
+		}
+		s.addGarbage(idx)
+	default:
+		return key, value, nil
+	}
+
+	if s.writer == nil {
+		w, err := newBlobWriter(s.lsm.baseDir, s.lsm.allocFileNumber())
+		if err != nil {
+			return nil, nil, err
+		}
+		s.writer = w
+	}
+	idx, err := s.writer.add(userKey, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.refs[idx.number] = true
+	return makeInternalKey(nil, userKey, seq, kindBlob), idx.encode(), nil
+}
+
+// drop 记录合并丢弃的一条记录，kindBlob 记录指向的数据成为垃圾
+func (s *blobSeparator) drop(key, value []byte) {
+	if _, _, kind := parseInternalKey(key); kind != kindBlob {
+		return
+	}
+	if idx, err := decodeBlobIndex(value); err == nil {
+		s.addGarbage(idx)
+	}
+}
+
+func (s *blobSeparator) addGarbage(idx blobIndex) {
+	g, ok := s.garbage[idx.number]
+	if !ok {
+		g = &blobGarbage{Number: idx.number}
+		s.garbage[idx.number] = g
+	}
+	g.Count++
+	g.Size += int64(idx.size)
+}
+
+// takeRefs 返回当前 SSTable 引用的 blob 文件，并为下一个 SSTable 重新开始统计
+func (s *blobSeparator) takeRefs() []uint64 {
+	if len(s.refs) == 0 {
+		return nil
+	}
+	refs := make([]uint64, 0, len(s.refs))
+	for number := range s.refs {
+		refs = append(refs, number)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	s.refs = make(map[uint64]bool)
+	return refs
+}
+
+// finish 把写入的 blob 文件落盘，返回它的元数据和产生的垃圾
+func (s *blobSeparator) finish() ([]BlobMeta, []blobGarbage, error) {
+	var added []BlobMeta
+	if s.writer != nil {
+		meta, err := s.writer.finish()
+		s.writer = nil
+		if err != nil {
+			return nil, nil, err
+		}
+		added = append(added, meta)
+	}
+	garbage := make([]blobGarbage, 0, len(s.garbage))
+	for _, g := range s.garbage {
+		garbage = append(garbage, *g)
+	}
+	sort.Slice(garbage, func(i, j int) bool { return garbage[i].Number < garbage[j].Number })
+	return added, garbage, nil
+}
+
+func (s *blobSeparator) abort() {
+	if s.writer != nil {
+		s.writer.abort()
+		s.writer = nil
+	}
+}
+
+// applyBlobEdit 把新增的 blob 文件和垃圾计入 lsm.blobs，全部成为垃圾的文件等没有版本引用后删除。
+// 调用方持有 mutex，并且要在安装新版本之前调用
+func (lsm *LSMTree) applyBlobEdit(added []BlobMeta, garbage []blobGarbage) {
+	for _, meta := range added {
+		m := meta
+		lsm.blobs[m.Number] = &m
+	}
+	for _, g := range garbage {
+		m, ok := lsm.blobs[g.Number]
+		if !ok {
+			continue
+		}
+		m.GarbageCount += g.Count
+		m.GarbageSize += g.Size
+		if m.obsolete() {
+			delete(lsm.blobs, g.Number)
+			lsm.obsoleteBlobs[g.Number] = true
+		}
+	}
+}
+
+// blobGCVictims 返回有效比例低于 BlobGCRatio 的 blob 文件，调用方持有 mutex
+func (lsm *LSMTree) blobGCVictims() map[uint64]bool {
+	victims := make(map[uint64]bool)
+	for number, m := range lsm.blobs {
+		if m.LiveRatio() < lsm.opts.BlobGCRatio {
+			victims[number] = true
+		}
+	}
+	return victims
+}
+
+// blobMetas 返回当前所有 blob 文件的元数据，按编号排列，调用方持有 mutex
+func (lsm *LSMTree) blobMetas() []BlobMeta {
+	metas := make([]BlobMeta, 0, len(lsm.blobs))
+	for _, m := range lsm.blobs {
+		metas = append(metas, *m)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Number < metas[j].Number })
+	return metas
+}
+
+// BlobFiles 返回当前的 blob 文件及其垃圾统计
+func (lsm *LSMTree) BlobFiles() []BlobMeta {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	return lsm.blobMetas()
+}
+
+// GarbageCollectBlobs 重写所有引用了待回收 blob 文件的 SSTable，把其中仍然有效的值搬到新的 blob 文件。
+// 待回收的文件是有效比例低于 BlobGCRatio 的 blob 文件，引用全部消失后文件被删除
+func (lsm *LSMTree) GarbageCollectBlobs() error {
+	lsm.compactionMutex.Lock()
+	defer lsm.compactionMutex.Unlock()
+
+	for {
+		lsm.mutex.Lock()
+		if lsm.closed {
+			lsm.mutex.Unlock()
+			return errClosed
+		}
+		c := lsm.pickBlobCompaction()
+		lsm.mutex.Unlock()
+		if c == nil {
+			return nil
+		}
+		if err := lsm.runCompaction(c); err != nil {
+			return err
+		}
+	}
+}
+
+// pickBlobCompaction 找到一个引用了待回收 blob 文件的 SSTable 并生成重写它的合并，调用方持有 mutex。
+// L0 的文件互相重叠，和普通合并一样一起合并到 L1；更深的层单独重写该文件，输出仍在原来的层
+func (lsm *LSMTree) pickBlobCompaction() *compaction {
+	victims := lsm.blobGCVictims()
+	if len(victims) == 0 {
+		return nil
+	}
+	references := func(f *tableFile) bool {
+		for _, number := range f.meta.Blobs {
+			if victims[number] {
+				return true
+			}
+		}
+		return false
+	}
+	for _, cf := range lsm.families {
+		levels := cf.current.levels
+		for _, f := range levels[0] {
+			if references(f) {
+				c := cf.newCompaction(0, true)
+				c.inputs[0] = append([]*tableFile(nil), levels[0]...)
+				lsm.setupCompaction(c)
+				return c
+			}
+		}
+		for level := 1; level < len(levels); level++ {
+			for _, f := range levels[level] {
+				if !references(f) {
+					continue
+				}
+				c := cf.newCompaction(level-1, true)
+				c.blobVictims = victims
+				c.inputs[1] = []*tableFile{f}
+				for deeper := level + 1; deeper < len(levels); deeper++ {
+					c.deeper = append(c.deeper, levels[deeper]...)
+				}
+				c.snapshots = lsm.snapshotSequences()
+				return c
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package lsm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint 在 dir 中生成一个与当前数据库一致、可以独立打开的副本，不阻塞读取，
+// 写入只在记录 WAL 位置的一瞬间暂停。SSTable 和 blob 文件不会再被修改，直接硬链接（跨文件系统时复制）；
+// 尚未刷盘的 WAL 段复制开始时已经写入的部分，MemTable 中的数据在打开副本时从这些段回放，
+// 因此不包含 DisableWAL 的写入。dir 必须不存在或为空
+func (lsm *LSMTree) Checkpoint(dir string) error {
+	if err := ensureEmptyDir(dir); err != nil {
+		return err
+	}
+
+	lsm.mutex.Lock()
+	// 排到写入队列队首，此时没有写入正在追加 WAL，也不会切换 MemTable
+	w := &writer{cond: sync.NewCond(&lsm.mutex)}
+	lsm.waitForTurn(w)
+	cp, err := lsm.captureCheckpoint()
+	lsm.finishWriters([]*writer{w}, err)
+	lsm.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer cp.release(lsm)
+
+	for _, b := range cp.state.blobs {
+		if err := linkOrCopy(blobFileName(lsm.baseDir, b.Number), blobFileName(dir, b.Number)); err != nil {
+			return err
+		}
+	}
+	for _, v := range cp.versions {
+		for _, files := range v.levels {
+			for _, f := range files {
+				if err := linkTableFile(lsm.baseDir, dir, f.meta.Number); err != nil {
+					return err
+				}
+				cp.state.files = append(cp.state.files, f.meta)
+			}
+		}
+	}
+	for _, log := range cp.logs {
+		if err := copyPrefix(log.file, filepath.Join(dir, filepath.Base(log.file.Name())), log.size); err != nil {
+			return err
+		}
+	}
+	if err := writeManifestSnapshot(dir, cp.state); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// checkpoint 是在写入队列队首记录下的状态：各列族的版本引用、新 MANIFEST 的内容，
+// 以及尚未刷盘的 WAL 段。段在持有锁时打开，之后即使刷盘完成被删除或归档也能继续读取
+type checkpoint struct {
+	versions []*version
+	state    *versionState
+	logs     []checkpointLog
+}
+
+// checkpointLog 是打开的 WAL 段和记录检查点时的长度，之后追加的记录不复制
+type checkpointLog struct {
+	file *os.File
+	size int64
+}
+
+func (cp *checkpoint) release(lsm *LSMTree) {
+	cp.closeLogs()
+	lsm.unrefVersions(cp.versions)
+}
+
+func (cp *checkpoint) closeLogs() {
+	for _, log := range cp.logs {
+		log.file.Close()
+	}
+}
+
+// captureCheckpoint 需要持有 mutex 并位于写入队列队首
+func (lsm *LSMTree) captureCheckpoint() (*checkpoint, error) {
+	if lsm.closed {
+		return nil, errClosed
+	}
+	if lsm.bgErr != nil {
+		return nil, lsm.bgErr
+	}
+	logNumber := lsm.memLogNumber
+	if len(lsm.imm) > 0 {
+		logNumber = lsm.imm[0].logNumber
+	}
+	names, err := liveLogs(lsm.baseDir, logNumber)
+	if err != nil {
+		return nil, err
+	}
+	state := lsm.snapshotState()
+	state.nextFileNumber = lsm.nextFileNumber
+	state.logNumber = logNumber
+	cp := &checkpoint{state: state}
+	active := logFileName(lsm.baseDir, lsm.logNumber)
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			cp.closeLogs()
+			return nil, err
+		}
+		size := lsm.wal.Size()
+		if name != active {
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				cp.closeLogs()
+				return nil, err
+			}
+			size = info.Size()
+		}
+		cp.logs = append(cp.logs, checkpointLog{file: file, size: size})
+	}
+	cp.versions = lsm.refVersions()
+	return cp, nil
+}
+
+// snapshotState 返回写新 MANIFEST 需要的比较器、列族、blob 文件和序列号，SSTable 由调用方补充，
+// 调用方需持有 mutex
+func (lsm *LSMTree) snapshotState() *versionState {
+	return &versionState{
+		comparator:   lsm.opts.Comparator.Name(),
+		families:     lsm.familyMetas(),
+		nextFamilyID: lsm.nextFamilyID,
+		blobs:        lsm.blobMetas(),
+		lastSequence: lsm.lastSequence,
+	}
+}
+
+// copyPrefix 把 src 的前 size 个字节复制到新文件 dst 并落盘
+func copyPrefix(src *os.File, dst string, size int64) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(src, 0, size)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// linkTableFile 硬链接一个 SSTable，旧版本留下的 .bloom 文件一并链接
+func linkTableFile(srcDir, dstDir string, number uint64) error {
+	if err := linkOrCopy(tableFileName(srcDir, number), tableFileName(dstDir, number)); err != nil {
+		return err
+	}
+	err := linkOrCopy(tableFileName(srcDir, number)+".bloom", tableFileName(dstDir, number)+".bloom")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// linkOrCopy 创建硬链接，源文件和目标不在同一个文件系统时退回到复制
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	var linkErr *os.LinkError
+	if os.IsNotExist(err) || !errors.As(err, &linkErr) {
+		return err
+	}
+	return copyFile(src, dst)
+}
@@ -0,0 +1,312 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"LSMTree/skiplist"
+	"LSMTree/sstable"
+)
+
+// DefaultColumnFamilyName 是默认列族的名字。默认列族的编号为 0，总是存在，不能删除，
+// LSMTree 自己的读写方法都作用于它
+const DefaultColumnFamilyName = "default"
+
+var (
+	// ErrColumnFamilyExists 表示同名的列族已经存在
+	ErrColumnFamilyExists = errors.New("column family already exists")
+	// ErrColumnFamilyNotFound 表示没有该名字的列族
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+	errColumnFamilyDropped  = errors.New("column family has been dropped")
+)
+
+// ColumnFamilyMeta 是 MANIFEST 中记录的一个列族，Comparator 是创建时使用的比较器的名字
+type ColumnFamilyMeta struct {
+	ID         uint32 `json:"id"`
+	Name       string `json:"name"`
+	Comparator string `json:"comparator"`
+}
+
+// ColumnFamily 是一个独立的键空间，有自己的比较器、MemTable、SSTable 和合并参数。
+// 所有列族共享 WAL、MANIFEST、序列号、快照和 blob 文件，WriteBatch 可以原子地写入多个列族。
+// 列族被删除之后，通过它的读写都会失败
+type ColumnFamily struct {
+	lsm  *LSMTree
+	id   uint32
+	name string
+	opts *Options
+	// icmp 比较内部键，tableOpts 是读写 SSTable 时使用的选项，tables 缓存该列族打开的 SSTable
+	icmp      internalComparator
+	tableOpts *sstable.Options
+	tables    *tableCache
+	// 以下字段由 lsm.mutex 保护。current 中 levels[0] 的文件可能重叠，从旧到新排列；
+	// levels[1:] 中每层文件互不重叠，按最小键排序
+	memTable       *skiplist.SkipList
+	current        *version
+	compactPointer [][]byte
+	dropped        bool
+}
+
+// newColumnFamily 创建列族和空的 MemTable，版本由调用方安装
+func (lsm *LSMTree) newColumnFamily(meta ColumnFamilyMeta, opts *Options) *ColumnFamily {
+	icmp := internalComparator{user: opts.Comparator}
+	tableOpts := &sstable.Options{
+		Comparator:           icmp,
+		FilterKey:            extractUserKey,
+		BlockCache:           lsm.blockCache,
+		PinIndexAndFilter:    opts.PinIndexAndFilterBlocks,
+		BlockRestartInterval: opts.BlockRestartInterval,
+	}
+	cf := &ColumnFamily{
+		lsm:       lsm,
+		id:        meta.ID,
+		name:      meta.Name,
+		opts:      opts,
+		icmp:      icmp,
+		tableOpts: tableOpts,
+		// 表文件在第一次读取时才打开
+		tables:         newTableCache(lsm.baseDir, tableOpts, lsm.opts.MaxOpenFiles),
+		compactPointer: make([][]byte, opts.NumLevels),
+	}
+	cf.memTable = cf.newMemTable()
+	return cf
+}
+
+// loadFiles 用 MANIFEST 中属于该列族的文件建立初始版本
+func (cf *ColumnFamily) loadFiles(files []FileMeta) error {
+	v := newVersion(cf.opts.NumLevels)
+	for _, meta := range files {
+		if meta.Family != cf.id {
+			continue
+		}
+		if meta.Level >= cf.opts.NumLevels {
+			return fmt.Errorf("table %d is in level %d, but NumLevels is %d", meta.Number, meta.Level, cf.opts.NumLevels)
+		}
+		v.levels[meta.Level] = append(v.levels[meta.Level], &tableFile{meta: meta, tables: cf.tables})
+	}
+	for level := 1; level < len(v.levels); level++ {
+		sortFiles(cf.icmp, v.levels[level])
+	}
+	cf.lsm.installVersion(cf, v)
+	return nil
+}
+
+func (cf *ColumnFamily) meta() ColumnFamilyMeta {
+	return ColumnFamilyMeta{ID: cf.id, Name: cf.name, Comparator: cf.opts.Comparator.Name()}
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// memTables 返回列族的 MemTable 和冻结的 MemTable，从新到旧排列，调用方持有 mutex
+func (cf *ColumnFamily) memTables() []*skiplist.SkipList {
+	lists := []*skiplist.SkipList{cf.memTable}
+	imm := cf.lsm.imm
+	for i := len(imm) - 1; i >= 0; i-- {
+		if list := imm[i].lists[cf]; list != nil {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// familyID 返回写入 WAL 的列族编号，nil 表示默认列族
+func familyID(cf *ColumnFamily) uint32 {
+	if cf == nil {
+		return 0
+	}
+	return cf.id
+}
+
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	batch := NewWriteBatch()
+	batch.PutCF(cf, key, value)
+	return cf.lsm.Write(batch)
+}
+
+func (cf *ColumnFamily) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutWithTTLCF(cf, key, value, ttl)
+	return cf.lsm.Write(batch)
+}
+
+// Merge 写入一个 merge 操作数，需要列族的 Options.MergeOperator 不为空
+func (cf *ColumnFamily) Merge(key, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.MergeCF(cf, key, operand)
+	return cf.lsm.Write(batch)
+}
+
+func (cf *ColumnFamily) Delete(key []byte) error {
+	batch := NewWriteBatch()
+	batch.DeleteCF(cf, key)
+	return cf.lsm.Write(batch)
+}
+
+func (cf *ColumnFamily) Get(key []byte) ([]byte, bool) {
+	return cf.lsm.get(cf, key, nil)
+}
+
+func (cf *ColumnFamily) GetWithOptions(key []byte, opts *ReadOptions) ([]byte, bool) {
+	return cf.lsm.get(cf, key, opts)
+}
+
+func (cf *ColumnFamily) NewIterator(opts *IterOptions) (*Iterator, error) {
+	return cf.lsm.newIterator(cf, opts)
+}
+
+// Compact 手动合并该列族，见 LSMTree.Compact
+func (cf *ColumnFamily) Compact() error {
+	return cf.lsm.compactFamily(cf)
+}
+
+// DefaultColumnFamily 返回默认列族
+func (lsm *LSMTree) DefaultColumnFamily() *ColumnFamily {
+	return lsm.defaultFamily
+}
+
+// GetColumnFamily 按名字查找列族
+func (lsm *LSMTree) GetColumnFamily(name string) (*ColumnFamily, bool) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	cf := lsm.findFamily(name)
+	return cf, cf != nil
+}
+
+func (lsm *LSMTree) findFamily(name string) *ColumnFamily {
+	for _, cf := range lsm.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// ListColumnFamilies 返回所有列族的名字，按创建顺序排列，默认列族在最前面
+func (lsm *LSMTree) ListColumnFamilies() []string {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	families := lsm.sortedFamilies()
+	names := make([]string, len(families))
+	for i, cf := range families {
+		names[i] = cf.name
+	}
+	return names
+}
+
+// sortedFamilies 返回按编号排列的列族，调用方持有 mutex
+func (lsm *LSMTree) sortedFamilies() []*ColumnFamily {
+	families := make([]*ColumnFamily, 0, len(lsm.families))
+	for _, cf := range lsm.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	return families
+}
+
+// familyMetas 返回默认列族之外的列族，用于写 MANIFEST 快照，调用方持有 mutex
+func (lsm *LSMTree) familyMetas() []ColumnFamilyMeta {
+	var metas []ColumnFamilyMeta
+	for _, cf := range lsm.sortedFamilies() {
+		if cf.id != 0 {
+			metas = append(metas, cf.meta())
+		}
+	}
+	return metas
+}
+
+// CreateColumnFamily 创建一个空的列族并记录到 MANIFEST，opts 为 nil 时使用打开数据库时的选项。
+// 只有比较器、MergeOperator、MemTable 大小、分层合并、压缩和 blob 分离的参数按列族生效，
+// WAL、缓存和后台任务的参数仍然使用打开数据库时的选项。
+// 之后重新打开数据库时，列族的选项从 Options.ColumnFamilyOptions 中按名字查找
+func (lsm *LSMTree) CreateColumnFamily(name string, opts *Options) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, fmt.Errorf("column family name is empty")
+	}
+	if opts == nil {
+		opts = lsm.opts
+	} else {
+		opts = opts.sanitize()
+	}
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	if lsm.closed {
+		return nil, errClosed
+	}
+	if lsm.findFamily(name) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrColumnFamilyExists, name)
+	}
+	// 列族编号不会重复使用，WAL 中已删除的列族的记录在回放时被跳过
+	cf := lsm.newColumnFamily(ColumnFamilyMeta{ID: lsm.nextFamilyID, Name: name}, opts)
+	edit := &versionEdit{CreateFamilies: []ColumnFamilyMeta{cf.meta()}, NextFamilyID: cf.id + 1}
+	if err := lsm.manifest.logEdit(edit); err != nil {
+		return nil, err
+	}
+	lsm.nextFamilyID++
+	lsm.installVersion(cf, newVersion(opts.NumLevels))
+	lsm.families[cf.id] = cf
+	return cf, nil
+}
+
+// DropColumnFamily 删除列族，它的 SSTable 在没有读操作引用之后被删除。
+// 尚未刷盘的写入留在 WAL 中，回放时被跳过。默认列族不能删除
+func (lsm *LSMTree) DropColumnFamily(name string) error {
+	if name == DefaultColumnFamilyName {
+		return fmt.Errorf("cannot drop the default column family")
+	}
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+
+	// 排到写入队列队首，已经通过检查、正在提交的批次不会写入被删除的列族
+	w := &writer{cond: sync.NewCond(&lsm.mutex)}
+	lsm.waitForTurn(w)
+	err := lsm.dropColumnFamily(name)
+	lsm.finishWriters([]*writer{w}, err)
+	return err
+}
+
+// dropColumnFamily 调用方持有 mutex 并位于写入队列队首
+func (lsm *LSMTree) dropColumnFamily(name string) error {
+	if lsm.closed {
+		return errClosed
+	}
+	if lsm.bgErr != nil {
+		return lsm.bgErr
+	}
+	cf := lsm.findFamily(name)
+	if cf == nil {
+		return fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, name)
+	}
+	// 刷盘和合并为每个列族单独写 blob 文件，被删除的列族引用的 blob 文件全部成为垃圾
+	edit := &versionEdit{DropFamilies: []uint32{cf.id}}
+	referenced := make(map[uint64]bool)
+	for _, files := range cf.current.levels {
+		for _, f := range files {
+			for _, number := range f.meta.Blobs {
+				referenced[number] = true
+			}
+		}
+	}
+	for number := range referenced {
+		if m, ok := lsm.blobs[number]; ok {
+			edit.BlobGarbage = append(edit.BlobGarbage, blobGarbage{Number: number, Count: m.Count - m.GarbageCount, Size: m.Size - m.GarbageSize})
+		}
+	}
+	if err := lsm.manifest.logEdit(edit); err != nil {
+		return err
+	}
+	lsm.applyBlobEdit(nil, edit.BlobGarbage)
+	cf.dropped = true
+	delete(lsm.families, cf.id)
+	for _, files := range cf.current.levels {
+		for _, f := range files {
+			lsm.obsoleteFiles[f.meta.Number] = f
+		}
+	}
+	lsm.unrefVersionLocked(cf.current)
+	return nil
+}
@@ -0,0 +1,608 @@
+package lsm
+
+import (
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"LSMTree/sstable"
+)
+
+// compaction 描述一次从 level 合并到 level+1 的任务。
+// inputs[0] 是 level 中参与合并的文件，inputs[1] 是 level+1 中与之重叠的文件
+type compaction struct {
+	cf     *ColumnFamily
+	cmp    internalComparator
+	level  int
+	inputs [2][]*tableFile
+	// deeper 是比输出层更深的所有文件，用来判断墓碑能否丢弃
+	deeper []*tableFile
+	// 手动合并不做平移，保证墓碑被真正清理
+	manual bool
+	// snapshots 是开始合并时存活快照的序列号，这些快照可见的版本都要保留
+	snapshots []uint64
+	// blobVictims 是待回收的 blob 文件，指向它们的值在合并时搬到新的 blob 文件
+	blobVictims map[uint64]bool
+}
+
+// keyRange 返回文件集合的最小和最大内部键
+func keyRange(cmp internalComparator, files []*tableFile) ([]byte, []byte) {
+	smallest, largest := files[0].meta.Smallest, files[0].meta.Largest
+	for _, f := range files[1:] {
+		if cmp.Compare(f.meta.Smallest, smallest) < 0 {
+			smallest = f.meta.Smallest
+		}
+		if cmp.Compare(f.meta.Largest, largest) > 0 {
+			largest = f.meta.Largest
+		}
+	}
+	return smallest, largest
+}
+
+// overlappingFiles 按用户键判断重叠，同一个用户键的所有版本必须进入同一次合并
+func overlappingFiles(cmp internalComparator, files []*tableFile, smallest, largest []byte) []*tableFile {
+	ucmp := cmp.user
+	smallest, largest = extractUserKey(smallest), extractUserKey(largest)
+	var result []*tableFile
+	for _, f := range files {
+		if ucmp.Compare(extractUserKey(f.meta.Largest), smallest) >= 0 && ucmp.Compare(extractUserKey(f.meta.Smallest), largest) <= 0 {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+func totalSize(files []*tableFile) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.meta.Size
+	}
+	return size
+}
+
+// levelScore 大于等于 1 表示该层需要合并
+func (cf *ColumnFamily) levelScore(level int) float64 {
+	if level == 0 {
+		return float64(len(cf.current.levels[0])) / float64(cf.opts.L0CompactionTrigger)
+	}
+	return float64(totalSize(cf.current.levels[level])) / cf.opts.maxBytesForLevel(level)
+}
+
+func (lsm *LSMTree) needsCompaction() bool {
+	for _, cf := range lsm.families {
+		for level := 0; level < len(cf.current.levels)-1; level++ {
+			if cf.levelScore(level) >= 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newCompaction 创建列族 cf 从 level 合并到 level+1 的任务
+func (cf *ColumnFamily) newCompaction(level int, manual bool) *compaction {
+	return &compaction{cf: cf, cmp: cf.icmp, level: level, manual: manual}
+}
+
+// pickCompaction 在所有列族中选择得分最高的层，调用方需持有 mutex
+func (lsm *LSMTree) pickCompaction() *compaction {
+	var best *ColumnFamily
+	bestLevel, bestScore := -1, 1.0
+	for _, cf := range lsm.families {
+		for level := 0; level < len(cf.current.levels)-1; level++ {
+			if score := cf.levelScore(level); score >= bestScore {
+				best, bestLevel, bestScore = cf, level, score
+			}
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	c := best.newCompaction(bestLevel, false)
+	if bestLevel == 0 {
+		// L0 文件之间互相重叠，一次全部合并
+		c.inputs[0] = append([]*tableFile(nil), best.current.levels[0]...)
+	} else {
+		// 轮流选择：取上次合并位置之后的第一个文件
+		files := best.current.levels[bestLevel]
+		pick := files[0]
+		if pointer := best.compactPointer[bestLevel]; pointer != nil {
+			for _, f := range files {
+				if c.cmp.Compare(f.meta.Smallest, pointer) > 0 {
+					pick = f
+					break
+				}
+			}
+		}
+		c.inputs[0] = []*tableFile{pick}
+	}
+	lsm.setupCompaction(c)
+	return c
+}
+
+func (lsm *LSMTree) setupCompaction(c *compaction) {
+	levels := c.cf.current.levels
+	smallest, largest := keyRange(c.cmp, c.inputs[0])
+	c.inputs[1] = overlappingFiles(c.cmp, levels[c.level+1], smallest, largest)
+	for level := c.level + 2; level < len(levels); level++ {
+		c.deeper = append(c.deeper, levels[level]...)
+	}
+	c.snapshots = lsm.snapshotSequences()
+	c.blobVictims = lsm.blobGCVictims()
+}
+
+// isBaseLevelForKey 判断更深的层中是否还可能存在用户键 key 的旧版本
+func (c *compaction) isBaseLevelForKey(key []byte) bool {
+	ucmp := c.cmp.user
+	for _, f := range c.deeper {
+		if ucmp.Compare(extractUserKey(f.meta.Smallest), key) <= 0 && ucmp.Compare(key, extractUserKey(f.meta.Largest)) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// maybeCompact 在后台循环执行合并，直到没有层需要合并
+func (lsm *LSMTree) maybeCompact() {
+	lsm.compactionMutex.Lock()
+	defer lsm.compactionMutex.Unlock()
+
+	for {
+		lsm.mutex.Lock()
+		var c *compaction
+		if !lsm.closed {
+			c = lsm.pickCompaction()
+		}
+		lsm.mutex.Unlock()
+		if c == nil {
+			return
+		}
+		if err := lsm.runCompaction(c); err != nil {
+			log.Printf("Compaction error: %v", err)
+			return
+		}
+	}
+}
+
+// Compact 手动把默认列族的所有数据逐层合并到最底下有数据的那一层，期间会清理掉墓碑
+func (lsm *LSMTree) Compact() error {
+	return lsm.compactFamily(lsm.defaultFamily)
+}
+
+func (lsm *LSMTree) compactFamily(cf *ColumnFamily) error {
+	lsm.compactionMutex.Lock()
+	defer lsm.compactionMutex.Unlock()
+
+	lsm.mutex.Lock()
+	if cf.dropped {
+		lsm.mutex.Unlock()
+		return errColumnFamilyDropped
+	}
+	target := 1
+	for level := len(cf.current.levels) - 1; level > 1; level-- {
+		if len(cf.current.levels[level]) > 0 {
+			target = level
+			break
+		}
+	}
+	lsm.mutex.Unlock()
+
+	for level := 0; level < target; level++ {
+		lsm.mutex.Lock()
+		if lsm.closed {
+			lsm.mutex.Unlock()
+			return errClosed
+		}
+		if cf.dropped {
+			lsm.mutex.Unlock()
+			return errColumnFamilyDropped
+		}
+		var c *compaction
+		if len(cf.current.levels[level]) > 0 {
+			c = cf.newCompaction(level, true)
+			c.inputs[0] = append([]*tableFile(nil), cf.current.levels[level]...)
+			lsm.setupCompaction(c)
+		}
+		lsm.mutex.Unlock()
+
+		if c != nil {
+			if err := lsm.runCompaction(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runCompaction 在不持有 mutex 的情况下归并输入文件，最后加锁安装结果
+func (lsm *LSMTree) runCompaction(c *compaction) error {
+	outputLevel := c.level + 1
+
+	// 没有重叠时直接把文件移到下一层
+	if !c.manual && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 {
+		f := c.inputs[0][0]
+		moved := &tableFile{meta: f.meta, tables: f.tables}
+		moved.meta.Level = outputLevel
+		return lsm.installCompaction(c, []*tableFile{moved}, nil, nil)
+	}
+
+	// 数据源从新到旧排列：L0 中越靠后越新，level+1 整体比 level 旧
+	var children []internalIterator
+	closeChildren := func() {
+		for _, child := range children {
+			child.Close()
+		}
+	}
+	for i := len(c.inputs[0]) - 1; i >= 0; i-- {
+		it, err := c.inputs[0][i].NewIterator()
+		if err != nil {
+			closeChildren()
+			return err
+		}
+		children = append(children, it)
+	}
+	if len(c.inputs[1]) > 0 {
+		children = append(children, newLevelIterator(c.cmp, c.inputs[1]))
+	}
+	merged := newMergingIterator(c.cmp, children)
+
+	var outputs []*tableFile
+	var writer *sstable.Writer
+	var number uint64
+	separator := lsm.newBlobSeparator(c.cf, c.blobVictims)
+	var blobs []BlobMeta
+	abort := func(err error) error {
+		if writer != nil {
+			writer.Abort()
+		}
+		separator.abort()
+		for _, b := range blobs {
+			os.Remove(blobFileName(lsm.baseDir, b.Number))
+		}
+		for _, f := range outputs {
+			c.cf.tables.evict(f.meta.Number)
+			os.Remove(tableFileName(lsm.baseDir, f.meta.Number))
+		}
+		closeChildren()
+		return err
+	}
+	finishOutput := func() error {
+		sst, err := writer.Finish()
+		writer = nil
+		if err != nil {
+			os.Remove(tableFileName(lsm.baseDir, number))
+			return err
+		}
+		f := c.cf.newTableFile(sst, number, outputLevel)
+		f.meta.Blobs = separator.takeRefs()
+		outputs = append(outputs, f)
+		return nil
+	}
+
+	// emit 写出一条记录。输出文件只在用户键变化时切分，保证同一个用户键的版本不会跨文件
+	var outputKey []byte
+	emit := func(key, value []byte) error {
+		userKey := extractUserKey(key)
+		newKey := outputKey == nil || c.cmp.user.Compare(userKey, outputKey) != 0
+		if newKey {
+			outputKey = append(outputKey[:0], userKey...)
+		}
+		if writer != nil && newKey && writer.EstimatedSize() >= c.cf.opts.TargetFileSize {
+			if err := finishOutput(); err != nil {
+				return err
+			}
+		}
+		if writer == nil {
+			number = lsm.allocFileNumber()
+			w, err := sstable.NewWriter(tableFileName(lsm.baseDir, number), c.cf.writerOptions(number, outputLevel))
+			if err != nil {
+				return err
+			}
+			writer = w
+		}
+		key, value, err := separator.add(key, value)
+		if err != nil {
+			return err
+		}
+		return writer.Add(tableEntry(key, value))
+	}
+
+	// run 是 runKey 在同一个快照区间内连续的 merge 操作数，从新到旧排列。遇到同一区间内更旧的版本时
+	// 与它合并成普通写入；遇到其他区间或其他键时，如果更旧的版本都不存在也合并成普通写入，
+	// 否则尽量用 PartialMerge 合并之后作为操作数写出
+	now := time.Now().UnixNano()
+	var run []mergeOperand
+	var runKey []byte
+	runStripe := -1
+	// foldRun 把 run 与 existing 合并成一条普通写入，序列号取最新的操作数
+	foldRun := func(existing []byte) error {
+		values := make([][]byte, len(run))
+		for i, o := range run {
+			values[len(run)-1-i] = o.value
+		}
+		value, err := c.cf.fullMerge(runKey, existing, values)
+		if err != nil {
+			return err
+		}
+		seq := run[0].seq
+		run = nil
+		return emit(makeInternalKey(nil, runKey, seq, kindPut), value)
+	}
+	finishRun := func(endOfKey bool) error {
+		if endOfKey && c.cf.opts.MergeOperator != nil && c.isBaseLevelForKey(runKey) {
+			return foldRun(nil)
+		}
+		operands := run
+		run = nil
+		for _, o := range c.cf.partialMerge(runKey, operands) {
+			if err := emit(makeInternalKey(nil, runKey, o.seq, kindMerge), o.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// 同一个用户键的版本按从新到旧依次出现。某个版本与更新的版本落在同一个快照区间时，
+	// 任何读者都看不到它，可以丢弃
+	var currentKey []byte
+	lastStripe := -1
+	for merged.SeekToFirst(); merged.Valid(); merged.Next() {
+		key := merged.Key()
+		userKey, seq, kind := parseInternalKey(key)
+		newKey := currentKey == nil || c.cmp.user.Compare(userKey, currentKey) != 0
+		stripe := snapshotStripe(c.snapshots, seq)
+		if len(run) > 0 {
+			if !newKey && stripe == runStripe {
+				if kind == kindMerge {
+					run = append(run, mergeOperand{seq: seq, value: append([]byte(nil), merged.Value()...)})
+					continue
+				}
+				if c.cf.opts.MergeOperator != nil {
+					// 操作数下面的版本合并进结果，它指向的 blob 记录成为垃圾，同一区间内更旧的版本随后被丢弃
+					existing, err := c.cf.mergeBase(userKey, kind, merged.Value(), now)
+					if err == nil {
+						err = foldRun(existing)
+					}
+					if err != nil {
+						return abort(err)
+					}
+					separator.drop(key, merged.Value())
+					continue
+				}
+			}
+			if err := finishRun(newKey); err != nil {
+				return abort(err)
+			}
+			// 操作数已经写出，当前记录不是它们的重复版本。没有 MergeOperator 时操作数下面的版本必须保留
+			lastStripe = -1
+		}
+		if newKey {
+			currentKey = append(currentKey[:0], userKey...)
+			lastStripe = -1
+		}
+		if stripe == lastStripe {
+			separator.drop(key, merged.Value())
+			continue
+		}
+		lastStripe = stripe
+		value := merged.Value()
+		if kind == kindMerge {
+			run = []mergeOperand{{seq: seq, value: append([]byte(nil), value...)}}
+			runKey = append(runKey[:0], userKey...)
+			runStripe = stripe
+			continue
+		}
+		// 已经过期的写入对任何读者都不可见，改写成墓碑，继续遮蔽更旧的版本
+		if expired(kind, value, now) {
+			key, value, kind = makeInternalKey(nil, userKey, seq, kindDelete), nil, kindDelete
+		}
+		// 所有快照都能看到这个墓碑，并且更深的层没有旧版本时，墓碑已经没有需要遮蔽的数据
+		if kind == kindDelete && stripe == 0 && c.isBaseLevelForKey(userKey) {
+			continue
+		}
+		if err := emit(key, value); err != nil {
+			return abort(err)
+		}
+	}
+	if len(run) > 0 {
+		if err := finishRun(true); err != nil {
+			return abort(err)
+		}
+	}
+	if writer != nil {
+		if err := finishOutput(); err != nil {
+			return abort(err)
+		}
+	}
+	blobs, garbage, err := separator.finish()
+	if err != nil {
+		return abort(err)
+	}
+
+	var iterErr error
+	for _, child := range children {
+		if err := child.Close(); err != nil && iterErr == nil {
+			iterErr = err
+		}
+	}
+	children = nil
+	if iterErr != nil {
+		return abort(iterErr)
+	}
+
+	if err := lsm.installCompaction(c, outputs, blobs, garbage); err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// installCompaction 把合并结果写入 MANIFEST 并安装新版本。
+// 输入文件在没有读操作引用旧版本之后才会被删除。合并期间列族被删除时放弃结果
+func (lsm *LSMTree) installCompaction(c *compaction, outputs []*tableFile, blobs []BlobMeta, garbage []blobGarbage) error {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	if c.cf.dropped {
+		return errColumnFamilyDropped
+	}
+
+	outputLevel := c.level + 1
+	edit := &versionEdit{}
+	removed := make(map[uint64]bool)
+	for _, files := range c.inputs {
+		for _, f := range files {
+			edit.DeleteFiles = append(edit.DeleteFiles, f.meta.Number)
+			removed[f.meta.Number] = true
+		}
+	}
+	added := make(map[uint64]bool)
+	for _, f := range outputs {
+		edit.AddFiles = append(edit.AddFiles, f.meta)
+		added[f.meta.Number] = true
+	}
+	edit.AddBlobs = blobs
+	edit.BlobGarbage = garbage
+	edit.NextFileNumber = lsm.nextFileNumber
+	if err := lsm.manifest.logEdit(edit); err != nil {
+		return err
+	}
+	lsm.applyBlobEdit(blobs, garbage)
+
+	v := c.cf.current.clone()
+	for _, level := range []int{c.level, outputLevel} {
+		kept := make([]*tableFile, 0, len(v.levels[level])+len(outputs))
+		for _, f := range v.levels[level] {
+			if !removed[f.meta.Number] {
+				kept = append(kept, f)
+			}
+		}
+		v.levels[level] = kept
+	}
+	v.levels[outputLevel] = append(v.levels[outputLevel], outputs...)
+	sortFiles(c.cmp, v.levels[outputLevel])
+
+	// 平移的文件编号不变，不能删除
+	for _, files := range c.inputs {
+		for _, f := range files {
+			if !added[f.meta.Number] {
+				lsm.obsoleteFiles[f.meta.Number] = f
+			}
+		}
+	}
+	lsm.installVersion(c.cf, v)
+
+	// 重写单个文件回收 blob 时没有 level 层的输入
+	if len(c.inputs[0]) > 0 {
+		_, largest := keyRange(c.cmp, c.inputs[0])
+		c.cf.compactPointer[c.level] = largest
+	}
+	return nil
+}
+
+// sortFiles 按最小键排序 L1 及以下的文件
+func sortFiles(cmp internalComparator, files []*tableFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return cmp.Compare(files[i].meta.Smallest, files[j].meta.Smallest) < 0
+	})
+}
+
+// levelIterator 依次遍历同一层中互不重叠的文件，同一时刻只打开一个文件
+type levelIterator struct {
+	cmp   internalComparator
+	files []*tableFile
+	index int
+	iter  *tableIterator
+	err   error
+}
+
+func newLevelIterator(cmp internalComparator, files []*tableFile) *levelIterator {
+	return &levelIterator{cmp: cmp, files: files, index: -1}
+}
+
+func (l *levelIterator) openFile(i int) bool {
+	if l.iter != nil {
+		if err := l.iter.Close(); err != nil && l.err == nil {
+			l.err = err
+		}
+		l.iter = nil
+	}
+	l.index = i
+	if l.err != nil || i < 0 || i >= len(l.files) {
+		return false
+	}
+	it, err := l.files[i].NewIterator()
+	if err != nil {
+		l.err = err
+		return false
+	}
+	l.iter = it
+	return true
+}
+
+func (l *levelIterator) Valid() bool {
+	return l.iter != nil && l.iter.Valid()
+}
+
+func (l *levelIterator) Key() []byte {
+	return l.iter.Key()
+}
+
+func (l *levelIterator) Value() []byte {
+	return l.iter.Value()
+}
+
+func (l *levelIterator) SeekToFirst() {
+	if l.openFile(0) {
+		l.iter.SeekToFirst()
+	}
+	l.skipForward()
+}
+
+func (l *levelIterator) SeekToLast() {
+	if l.openFile(len(l.files) - 1) {
+		l.iter.SeekToLast()
+	}
+	l.skipBackward()
+}
+
+func (l *levelIterator) Seek(key []byte) {
+	i := sort.Search(len(l.files), func(i int) bool {
+		return l.cmp.Compare(l.files[i].meta.Largest, key) >= 0
+	})
+	if l.openFile(i) {
+		l.iter.Seek(key)
+	}
+	l.skipForward()
+}
+
+func (l *levelIterator) Next() {
+	l.iter.Next()
+	l.skipForward()
+}
+
+func (l *levelIterator) Prev() {
+	l.iter.Prev()
+	l.skipBackward()
+}
+
+func (l *levelIterator) skipForward() {
+	for l.iter != nil && !l.iter.Valid() {
+		if l.openFile(l.index + 1) {
+			l.iter.SeekToFirst()
+		}
+	}
+}
+
+func (l *levelIterator) skipBackward() {
+	for l.iter != nil && !l.iter.Valid() {
+		if l.openFile(l.index - 1) {
+			l.iter.SeekToLast()
+		}
+	}
+}
+
+func (l *levelIterator) Close() error {
+	l.openFile(-1)
+	return l.err
+}
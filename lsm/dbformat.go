@@ -0,0 +1,101 @@
+package lsm
+
+import (
+	"encoding/binary"
+
+	"LSMTree/comparator"
+	"LSMTree/sstable"
+)
+
+// 内部键的格式：
+//
+//	| user key | seq << 8 | kind (8 字节小端) |
+//
+// MemTable 和 SSTable 中保存的都是内部键，同一个用户键的多个版本按序列号从新到旧排列
+type keyKind uint8
+
+const (
+	kindDelete keyKind = 0
+	kindPut    keyKind = 1
+	// kindBlob 的值是指向 blob 文件中记录的 blobIndex，只出现在 SSTable 中
+	kindBlob keyKind = 2
+	// kindPutTTL 的值是 过期时间 (8 字节小端，Unix 纳秒) | value，过期之后等同于墓碑
+	kindPutTTL keyKind = 3
+	// kindMerge 的值是 merge 操作数，读取时与更旧的版本一起交给 MergeOperator
+	kindMerge keyKind = 4
+	// kindSeek 是最大的 kind，(key, seq, kindSeek) 排在同一序列号的所有记录之前
+	kindSeek = kindMerge
+)
+
+const (
+	internalKeyTrailer = 8
+	maxSequence        = uint64(1)<<56 - 1
+)
+
+// tableEntry 返回写入 SSTable 的记录，墓碑标记由内部键的 kind 决定
+func tableEntry(ikey, value []byte) sstable.Entry {
+	_, _, kind := parseInternalKey(ikey)
+	return sstable.Entry{Key: ikey, Value: value, Deleted: kind == kindDelete}
+}
+
+func makeInternalKey(dst, userKey []byte, seq uint64, kind keyKind) []byte {
+	dst = append(dst, userKey...)
+	return binary.LittleEndian.AppendUint64(dst, seq<<8|uint64(kind))
+}
+
+func parseInternalKey(ikey []byte) ([]byte, uint64, keyKind) {
+	n := len(ikey) - internalKeyTrailer
+	trailer := binary.LittleEndian.Uint64(ikey[n:])
+	return ikey[:n], trailer >> 8, keyKind(trailer & 0xff)
+}
+
+// appendTTLValue 把过期时间和值编码为 kindPutTTL 记录的值
+func appendTTLValue(dst []byte, expiresAt int64, value []byte) []byte {
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(expiresAt))
+	return append(dst, value...)
+}
+
+// parseTTLValue 返回 kindPutTTL 记录的过期时间和用户值，长度不足时视为已经过期
+func parseTTLValue(value []byte) (int64, []byte) {
+	if len(value) < 8 {
+		return 0, nil
+	}
+	return int64(binary.LittleEndian.Uint64(value)), value[8:]
+}
+
+// expired 判断记录在 now（Unix 纳秒）时是否已经过期，只有 kindPutTTL 记录会过期
+func expired(kind keyKind, value []byte, now int64) bool {
+	if kind != kindPutTTL {
+		return false
+	}
+	expiresAt, _ := parseTTLValue(value)
+	return expiresAt <= now
+}
+
+func extractUserKey(ikey []byte) []byte {
+	return ikey[:len(ikey)-internalKeyTrailer]
+}
+
+// internalComparator 先按用户比较器比较用户键，再按序列号和 kind 降序
+type internalComparator struct {
+	user comparator.Comparator
+}
+
+func (c internalComparator) Compare(a, b []byte) int {
+	if r := c.user.Compare(extractUserKey(a), extractUserKey(b)); r != 0 {
+		return r
+	}
+	ta := binary.LittleEndian.Uint64(a[len(a)-internalKeyTrailer:])
+	tb := binary.LittleEndian.Uint64(b[len(b)-internalKeyTrailer:])
+	switch {
+	case ta > tb:
+		return -1
+	case ta < tb:
+		return 1
+	}
+	return 0
+}
+
+func (c internalComparator) Name() string {
+	return "lsmtree.InternalKey(" + c.user.Name() + ")"
+}
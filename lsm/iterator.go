@@ -0,0 +1,524 @@
+package lsm
+
+import (
+	"bytes"
+	"time"
+
+	"LSMTree/comparator"
+	"LSMTree/skiplist"
+)
+
+// internalIterator 是 MemTable 和 SSTable 迭代器的公共接口，
+// 按内部键顺序返回所有版本，包括墓碑
+type internalIterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	SeekToFirst()
+	SeekToLast()
+	Seek(key []byte)
+	Next()
+	Prev()
+	Close() error
+}
+
+type direction int
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// mergingIterator 对多个有序数据源做 k 路归并，children 按从新到旧排列。
+// 内部键互不相同，同一个用户键的所有版本都会依次返回
+type mergingIterator struct {
+	cmp       comparator.Comparator
+	children  []internalIterator
+	current   internalIterator
+	direction direction
+}
+
+func newMergingIterator(cmp comparator.Comparator, children []internalIterator) *mergingIterator {
+	return &mergingIterator{cmp: cmp, children: children}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.current != nil
+}
+
+func (m *mergingIterator) Key() []byte {
+	return m.current.Key()
+}
+
+func (m *mergingIterator) Value() []byte {
+	return m.current.Value()
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.direction = reverse
+	m.findLargest()
+}
+
+func (m *mergingIterator) Seek(key []byte) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Next() {
+	key := m.current.Key()
+	// 反向切换为正向时，先让所有数据源都回到 >= key 的位置
+	if m.direction != forward {
+		for _, child := range m.children {
+			child.Seek(key)
+		}
+		m.direction = forward
+	}
+	for _, child := range m.children {
+		if child.Valid() && m.cmp.Compare(child.Key(), key) == 0 {
+			child.Next()
+		}
+	}
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	key := m.current.Key()
+	if m.direction != reverse {
+		// 让所有数据源都停在 < key 的最后一个位置
+		for _, child := range m.children {
+			child.Seek(key)
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+		m.direction = reverse
+	} else {
+		for _, child := range m.children {
+			if child.Valid() && m.cmp.Compare(child.Key(), key) == 0 {
+				child.Prev()
+			}
+		}
+	}
+	m.findLargest()
+}
+
+// 键相同时取靠前的数据源
+func (m *mergingIterator) findSmallest() {
+	m.current = nil
+	for _, child := range m.children {
+		if child.Valid() && (m.current == nil || m.cmp.Compare(child.Key(), m.current.Key()) < 0) {
+			m.current = child
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = nil
+	for _, child := range m.children {
+		if child.Valid() && (m.current == nil || m.cmp.Compare(child.Key(), m.current.Key()) > 0) {
+			m.current = child
+		}
+	}
+}
+
+// IterOptions 限定迭代范围，nil 表示不设限，上下界按比较器的顺序解释。
+// 设置 Prefix 后只返回带该前缀的键，设置 Snapshot 后只能看到快照时刻的数据
+type IterOptions struct {
+	LowerBound []byte // 包含
+	UpperBound []byte // 不包含
+	Prefix     []byte
+	Snapshot   *Snapshot
+}
+
+// Iterator 是整棵树上的有序迭代器，对每个用户键只返回序列号不超过 seq 的最新版本，
+// 会跳过墓碑。Key 和 Value 返回的切片不能修改，迭代器关闭后不再有效
+type Iterator struct {
+	lsm        *LSMTree
+	cf         *ColumnFamily
+	version    *version
+	cmp        comparator.Comparator
+	iter       *mergingIterator
+	seq        uint64
+	lowerBound []byte
+	upperBound []byte
+	prefix     []byte
+	valid      bool
+	// 反向遍历时 iter 停在当前用户键的所有版本之前，当前记录保存在 savedKey 和 savedValue 中，
+	// savedBlob 表示 savedValue 是指向 blob 文件的指针
+	direction  direction
+	savedKey   []byte
+	savedValue []byte
+	savedBlob  bool
+	// merged 为真时正向遍历的当前键由 merge 操作数合并得到，键和值在 savedKey 和 savedValue 中，
+	// iter 已经越过了用到的操作数
+	merged bool
+	// now 是创建迭代器的时间（Unix 纳秒），之后的遍历都按这个时间判断记录是否过期
+	now int64
+	// err 是读取 blob 文件时遇到的第一个错误，由 Close 返回
+	err error
+}
+
+// NewIterator 遍历默认列族
+func (lsm *LSMTree) NewIterator(opts *IterOptions) (*Iterator, error) {
+	return lsm.newIterator(lsm.defaultFamily, opts)
+}
+
+func (lsm *LSMTree) newIterator(cf *ColumnFamily, opts *IterOptions) (*Iterator, error) {
+	lsm.mutex.Lock()
+	if cf.dropped {
+		lsm.mutex.Unlock()
+		return nil, errColumnFamilyDropped
+	}
+	lists := cf.memTables()
+	v := cf.refVersion()
+	seq := lsm.lastSequence
+	if opts != nil && opts.Snapshot != nil {
+		seq = opts.Snapshot.seq
+	}
+	lsm.mutex.Unlock()
+
+	// 迭代器持有版本引用，关闭前其中的文件不会被删除
+	iter, err := cf.newInternalIterator(lists, v)
+	if err != nil {
+		lsm.unrefVersion(v)
+		return nil, err
+	}
+
+	cmp := cf.opts.Comparator
+	it := &Iterator{lsm: lsm, cf: cf, version: v, cmp: cmp, iter: iter, seq: seq, now: time.Now().UnixNano()}
+	if opts != nil {
+		it.lowerBound = opts.LowerBound
+		it.upperBound = opts.UpperBound
+		it.prefix = opts.Prefix
+		// 只有字节序下带同一前缀的键才是连续区间，可以转换成上下界；
+		// 其他比较器逐个过滤
+		if len(opts.Prefix) > 0 && cmp == comparator.Bytewise {
+			if bytes.Compare(opts.Prefix, it.lowerBound) > 0 {
+				it.lowerBound = opts.Prefix
+			}
+			if end := prefixSuccessor(opts.Prefix); end != nil && (it.upperBound == nil || bytes.Compare(end, it.upperBound) < 0) {
+				it.upperBound = end
+			}
+		}
+	}
+	return it, nil
+}
+
+// newInternalIterator 归并 memTables 返回的 MemTable 和版本中的所有文件，调用方需要持有 v 的引用，
+// 用完之后关闭返回的迭代器的 children
+func (cf *ColumnFamily) newInternalIterator(lists []*skiplist.SkipList, v *version) (*mergingIterator, error) {
+	var children []internalIterator
+	for _, list := range lists {
+		children = append(children, list.NewIterator())
+	}
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		it, err := v.levels[0][i].NewIterator()
+		if err != nil {
+			for _, child := range children {
+				child.Close()
+			}
+			return nil, err
+		}
+		children = append(children, it)
+	}
+	for level := 1; level < len(v.levels); level++ {
+		if len(v.levels[level]) > 0 {
+			children = append(children, newLevelIterator(cf.icmp, v.levels[level]))
+		}
+	}
+	return newMergingIterator(cf.icmp, children), nil
+}
+
+// prefixSuccessor 返回大于所有以 prefix 开头的键的最小字节串，
+// prefix 全部由 0xff 组成时返回 nil 表示没有上界
+func prefixSuccessor(prefix []byte) []byte {
+	b := append([]byte(nil), prefix...)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			b[i]++
+			return b[:i+1]
+		}
+	}
+	return nil
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	if it.direction == reverse || it.merged {
+		return it.savedKey
+	}
+	return extractUserKey(it.iter.Key())
+}
+
+// Value 返回当前的值，保存在 blob 文件中的值每次调用都会读取文件，读取失败时返回 nil
+func (it *Iterator) Value() []byte {
+	if it.merged {
+		return it.savedValue
+	}
+	if it.direction == reverse {
+		if it.savedBlob {
+			return it.readBlob(it.savedKey, it.savedValue)
+		}
+		return it.savedValue
+	}
+	userKey, _, kind := parseInternalKey(it.iter.Key())
+	switch kind {
+	case kindBlob:
+		return it.readBlob(userKey, it.iter.Value())
+	case kindPutTTL:
+		_, value := parseTTLValue(it.iter.Value())
+		return value
+	}
+	return it.iter.Value()
+}
+
+func (it *Iterator) readBlob(userKey, index []byte) []byte {
+	value, err := it.lsm.blobFiles.read(userKey, index)
+	if err != nil {
+		it.setErr(err)
+		return nil
+	}
+	return value
+}
+
+func (it *Iterator) setErr(err error) {
+	if it.err == nil {
+		it.err = err
+	}
+}
+
+func (it *Iterator) First() {
+	it.direction = forward
+	if it.lowerBound != nil {
+		it.iter.Seek(makeInternalKey(nil, it.lowerBound, maxSequence, kindSeek))
+	} else {
+		it.iter.SeekToFirst()
+	}
+	it.findNextUserEntry(false)
+}
+
+func (it *Iterator) Last() {
+	it.direction = reverse
+	it.merged = false
+	if it.upperBound != nil {
+		// 定位到上界的第一个版本，再退回到所有更小的键
+		it.iter.Seek(makeInternalKey(nil, it.upperBound, maxSequence, kindSeek))
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+	} else {
+		it.iter.SeekToLast()
+	}
+	it.findPrevUserEntry()
+}
+
+// Seek 定位到第一个大于等于 key 的可见键
+func (it *Iterator) Seek(key []byte) {
+	if it.lowerBound != nil && it.cmp.Compare(key, it.lowerBound) < 0 {
+		key = it.lowerBound
+	}
+	it.direction = forward
+	it.iter.Seek(makeInternalKey(nil, key, it.seq, kindSeek))
+	it.findNextUserEntry(false)
+}
+
+func (it *Iterator) Next() {
+	if it.merged {
+		// iter 已经停在合并结果之后，savedKey 是当前键
+		it.merged = false
+	} else if it.direction == reverse {
+		// iter 停在 savedKey 之前，向前移动后跳过 savedKey 的所有版本
+		it.direction = forward
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.SeekToFirst()
+		}
+	} else {
+		it.savedKey = append(it.savedKey[:0], extractUserKey(it.iter.Key())...)
+		it.iter.Next()
+	}
+	it.findNextUserEntry(true)
+}
+
+func (it *Iterator) Prev() {
+	if it.direction == forward {
+		// 退回到当前用户键的所有版本之前。合并结果的 iter 已经越过当前键，可能已经失效
+		if it.merged {
+			it.merged = false
+			if !it.iter.Valid() {
+				it.iter.SeekToLast()
+			}
+		} else {
+			it.savedKey = append(it.savedKey[:0], extractUserKey(it.iter.Key())...)
+		}
+		for it.iter.Valid() && it.cmp.Compare(extractUserKey(it.iter.Key()), it.savedKey) >= 0 {
+			it.iter.Prev()
+		}
+		if !it.iter.Valid() {
+			it.valid = false
+			it.savedKey = it.savedKey[:0]
+			it.savedValue = nil
+			return
+		}
+		it.direction = reverse
+	}
+	it.findPrevUserEntry()
+}
+
+// Close 释放底层数据源，返回遍历过程中遇到的第一个错误
+func (it *Iterator) Close() error {
+	var firstErr error
+	for _, child := range it.iter.children {
+		if err := child.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.valid = false
+	if it.version != nil {
+		it.lsm.unrefVersion(it.version)
+		it.version = nil
+	}
+	if firstErr == nil {
+		firstErr = it.err
+	}
+	return firstErr
+}
+
+// findNextUserEntry 正向寻找下一个可见的用户键。skipping 为真时跳过所有不大于 savedKey 的版本，
+// 遇到墓碑或已经过期的写入时同样跳过该用户键更旧的版本。最新的版本是 merge 操作数时，
+// 向后读出更旧的版本合并，结果保存在 savedValue 中
+func (it *Iterator) findNextUserEntry(skipping bool) {
+	it.merged = false
+	for ; it.iter.Valid(); it.iter.Next() {
+		userKey, seq, kind := parseInternalKey(it.iter.Key())
+		if it.upperBound != nil && it.cmp.Compare(userKey, it.upperBound) >= 0 {
+			break
+		}
+		if seq > it.seq {
+			continue
+		}
+		if skipping && it.cmp.Compare(userKey, it.savedKey) <= 0 {
+			continue
+		}
+		if kind == kindDelete || expired(kind, it.iter.Value(), it.now) || !it.matchPrefix(userKey) {
+			it.savedKey = append(it.savedKey[:0], userKey...)
+			skipping = true
+			continue
+		}
+		if kind == kindMerge {
+			it.savedKey = append(it.savedKey[:0], userKey...)
+			value, err := it.cf.mergeForward(it.iter, it.savedKey, it.now)
+			if err != nil {
+				it.setErr(err)
+				break
+			}
+			it.savedValue = value
+			it.merged = true
+		}
+		it.valid = true
+		return
+	}
+	it.valid = false
+}
+
+// findPrevUserEntry 反向寻找上一个可见的用户键。同一个用户键的版本从旧到新出现，
+// 最后一个不超过 seq 的版本决定该键是否可见；之后的 merge 操作数依次收集，最后与它合并
+func (it *Iterator) findPrevUserEntry() {
+	kind := kindDelete
+	// operands 是当前键最新的普通写入或墓碑之后的操作数，从旧到新排列。
+	// hasBase 表示操作数下面有一个可见的值，保存在 savedValue 中
+	var operands [][]byte
+	hasBase := false
+	for ; it.iter.Valid(); it.iter.Prev() {
+		userKey, seq, k := parseInternalKey(it.iter.Key())
+		if seq > it.seq {
+			continue
+		}
+		if kind != kindDelete && it.cmp.Compare(userKey, it.savedKey) < 0 {
+			// 已经越过了 savedKey 的所有版本
+			break
+		}
+		if kind == kindDelete && it.lowerBound != nil && it.cmp.Compare(userKey, it.lowerBound) < 0 {
+			break
+		}
+		switch {
+		case k == kindDelete || expired(k, it.iter.Value(), it.now) || !it.matchPrefix(userKey):
+			kind = kindDelete
+			it.savedKey = it.savedKey[:0]
+			it.savedValue = nil
+			operands = nil
+		case k == kindMerge:
+			if kind != kindMerge {
+				hasBase = kind != kindDelete
+			}
+			kind = kindMerge
+			it.savedKey = append(it.savedKey[:0], userKey...)
+			operands = append(operands, append([]byte(nil), it.iter.Value()...))
+		default:
+			kind = k
+			it.savedKey = append(it.savedKey[:0], userKey...)
+			value := it.iter.Value()
+			if kind == kindPutTTL {
+				_, value = parseTTLValue(value)
+			}
+			it.savedValue = append(it.savedValue[:0], value...)
+			it.savedBlob = kind == kindBlob
+			operands = nil
+		}
+	}
+	if kind == kindDelete {
+		it.valid = false
+		it.savedKey = it.savedKey[:0]
+		it.savedValue = nil
+		it.direction = forward
+		return
+	}
+	if kind == kindMerge {
+		var existing []byte
+		var err error
+		if hasBase {
+			existing = it.savedValue
+			if it.savedBlob {
+				existing, err = it.lsm.blobFiles.read(it.savedKey, it.savedValue)
+			}
+		}
+		var value []byte
+		if err == nil {
+			value, err = it.cf.fullMerge(it.savedKey, existing, operands)
+		}
+		if err != nil {
+			it.setErr(err)
+			it.valid = false
+			return
+		}
+		it.savedValue = value
+		it.savedBlob = false
+	}
+	it.valid = true
+}
+
+func (it *Iterator) matchPrefix(userKey []byte) bool {
+	return it.prefix == nil || bytes.HasPrefix(userKey, it.prefix)
+}
@@ -0,0 +1,184 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ErrLockTimeout 表示在 LockTimeout 内没有拿到锁，事务仍然可以继续使用
+var ErrLockTimeout = errors.New("lock wait timeout")
+
+// DeadlockError 表示加锁会形成环形等待，请求加锁的事务被选为牺牲者并回滚。
+// Cycle 是从该事务出发的等待链，最后一个事务等待的是第一个
+type DeadlockError struct {
+	Key   []byte
+	Cycle []uint64
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("deadlock detected while locking %q: wait cycle %v", e.Key, e.Cycle)
+}
+
+type lockMode int
+
+const (
+	lockShared lockMode = iota
+	lockExclusive
+)
+
+const lockStripes = 16
+
+// keyLock 记录一个键的持有者。changed 在持有者变化时关闭并替换，等待者借此被唤醒
+type keyLock struct {
+	holders map[uint64]lockMode
+	changed chan struct{}
+}
+
+type lockStripe struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+// lockManager 按键的哈希把锁分散到多个条带上，不同条带的加锁互不阻塞。
+// waitFor 是全局的等待图，加锁前先拿条带的 mutex 再拿 waitMutex
+type lockManager struct {
+	stripes   [lockStripes]lockStripe
+	waitMutex sync.Mutex
+	waitFor   map[uint64][]uint64
+}
+
+func newLockManager() *lockManager {
+	m := &lockManager{waitFor: make(map[uint64][]uint64)}
+	for i := range m.stripes {
+		m.stripes[i].locks = make(map[string]*keyLock)
+	}
+	return m
+}
+
+func (m *lockManager) stripe(key string) *lockStripe {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.stripes[h.Sum32()%lockStripes]
+}
+
+// lock 为事务 txnID 获取 key 上的锁，已持有共享锁时可以升级为排他锁。
+// 等待超过 timeout 返回 ErrLockTimeout，等待会形成环时立即返回 *DeadlockError
+func (m *lockManager) lock(txnID uint64, key string, mode lockMode, timeout time.Duration) error {
+	s := m.stripe(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var timer *time.Timer
+	for {
+		kl := s.locks[key]
+		if kl == nil {
+			kl = &keyLock{holders: make(map[uint64]lockMode), changed: make(chan struct{})}
+			s.locks[key] = kl
+		}
+		blockers := kl.conflicts(txnID, mode)
+		if len(blockers) == 0 {
+			if held, ok := kl.holders[txnID]; !ok || held < mode {
+				kl.holders[txnID] = mode
+			}
+			m.clearWait(txnID)
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		}
+
+		if cycle := m.setWait(txnID, blockers); cycle != nil {
+			m.clearWait(txnID)
+			if timer != nil {
+				timer.Stop()
+			}
+			return &DeadlockError{Key: []byte(key), Cycle: cycle}
+		}
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+		}
+		changed := kl.changed
+		s.mutex.Unlock()
+		select {
+		case <-changed:
+			s.mutex.Lock()
+		case <-timer.C:
+			s.mutex.Lock()
+			m.clearWait(txnID)
+			return ErrLockTimeout
+		}
+	}
+}
+
+// conflicts 返回阻止 txnID 以 mode 加锁的其他持有者
+func (kl *keyLock) conflicts(txnID uint64, mode lockMode) []uint64 {
+	var blockers []uint64
+	for holder, held := range kl.holders {
+		if holder != txnID && (mode == lockExclusive || held == lockExclusive) {
+			blockers = append(blockers, holder)
+		}
+	}
+	return blockers
+}
+
+// unlockAll 释放事务持有的所有锁并唤醒等待者
+func (m *lockManager) unlockAll(txnID uint64, keys map[string]struct{}) {
+	for key := range keys {
+		s := m.stripe(key)
+		s.mutex.Lock()
+		if kl := s.locks[key]; kl != nil {
+			delete(kl.holders, txnID)
+			close(kl.changed)
+			if len(kl.holders) == 0 {
+				delete(s.locks, key)
+			} else {
+				kl.changed = make(chan struct{})
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// setWait 记录 txnID 正在等待 blockers，如果某个 blocker 沿等待图能回到 txnID，
+// 返回这条环路
+func (m *lockManager) setWait(txnID uint64, blockers []uint64) []uint64 {
+	m.waitMutex.Lock()
+	defer m.waitMutex.Unlock()
+	m.waitFor[txnID] = blockers
+
+	visited := make(map[uint64]bool)
+	var path []uint64
+	var dfs func(txn uint64) bool
+	dfs = func(txn uint64) bool {
+		if txn == txnID {
+			return true
+		}
+		if visited[txn] {
+			return false
+		}
+		visited[txn] = true
+		path = append(path, txn)
+		for _, next := range m.waitFor[txn] {
+			if dfs(next) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	for _, blocker := range blockers {
+		if dfs(blocker) {
+			return append([]uint64{txnID}, path...)
+		}
+	}
+	return nil
+}
+
+func (m *lockManager) clearWait(txnID uint64) {
+	m.waitMutex.Lock()
+	defer m.waitMutex.Unlock()
+	delete(m.waitFor, txnID)
+}
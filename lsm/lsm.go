@@ -1,250 +1,807 @@
 package lsm
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"LSMTree/cache"
 	"LSMTree/skiplist"
 	"LSMTree/sstable"
 	"LSMTree/wal"
 	"sync"
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
+	"time"
 )
 
 type LSMTree struct {
-	memTable    *skiplist.SkipList
-	wal         *wal.WAL
-	sstables    []*sstable.SSTable
-	maxSize     int
-	baseDir     string
-	mutex       sync.Mutex
-	sstableSeq  int
+	// families 是所有未删除的列族，按编号索引，defaultFamily 是编号为 0 的默认列族
+	families      map[uint32]*ColumnFamily
+	defaultFamily *ColumnFamily
+	nextFamilyID  uint32
+	wal           *wal.WAL
+	// logNumber 是正在写入的 WAL 段的编号，memLogNumber 是当前 MemTable 的记录所在的最早的段。
+	// 段超过 MaxWALSegmentSize 时轮转，一个 MemTable 的记录可能分布在多个段中。
+	// 所有列族的 MemTable 一起冻结，因此共用同一个 memLogNumber
+	logNumber    uint64
+	memLogNumber uint64
+	// imm 是已冻结、等待后台刷盘的 MemTable，从旧到新排列
+	imm           []*immMemTable
+	manifest      *manifest
+	liveVersions  map[*version]struct{}
+	obsoleteFiles map[uint64]*tableFile
+	// blobs 是 MANIFEST 中仍有有效记录的 blob 文件，obsoleteBlobs 是已经全部成为垃圾、
+	// 等待没有版本引用之后删除的 blob 文件
+	blobs         map[uint64]*BlobMeta
+	obsoleteBlobs map[uint64]bool
+	blobFiles     *blobFiles
+	opts          *Options
+	baseDir       string
+	blockCache    *cache.Cache
+	mutex         sync.Mutex
+	// flushCond 在 imm 变化时广播，写入在 imm 排满时在此等待
+	flushCond *sync.Cond
+	// writers 是等待提交的写入队列，只有队首可以写 WAL 或切换 MemTable
+	writers         []*writer
+	compactionMutex sync.Mutex
+	// archiveMutex 串行化对 archive 目录的清理和列举
+	archiveMutex   sync.Mutex
+	nextFileNumber uint64
+	// lastSequence 是最后一次写入使用的序列号
+	lastSequence uint64
+	// snapshots 是存活的快照，按序列号从小到大排列
+	snapshots []*Snapshot
+	// locks 是悲观事务使用的行锁
+	locks *lockManager
+	// bgErr 记录后台刷盘或写 WAL 失败，之后的写入都返回该错误
+	bgErr       error
 	flushChan   chan struct{}
 	compactChan chan struct{}
+	closeChan   chan struct{}
 	wg          sync.WaitGroup
 	closed      bool
 }
 
-func NewLSMTree(baseDir string, maxSize int) (*LSMTree, error) {
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
+var errClosed = fmt.Errorf("lsm tree is closed")
+
+// tableFile 是 MANIFEST 中的一个文件，读取时通过表缓存打开
+type tableFile struct {
+	meta   FileMeta
+	tables *tableCache
+}
+
+// Lookup 返回第一个大于等于 key 的记录，见 sstable.SSTable.Lookup
+func (f *tableFile) Lookup(key []byte) (sstable.Entry, bool, error) {
+	t, err := f.tables.get(f.meta.Number)
+	if err != nil {
+		return sstable.Entry{}, false, err
+	}
+	defer f.tables.release(t)
+	return t.sst.Lookup(key)
+}
+
+// NewIterator 返回的迭代器持有表的引用，关闭前文件不会被关闭
+func (f *tableFile) NewIterator() (*tableIterator, error) {
+	t, err := f.tables.get(f.meta.Number)
+	if err != nil {
 		return nil, err
 	}
-	walFile := fmt.Sprintf("%s/wal.log", baseDir)
-	walInstance, err := wal.NewWAL(walFile)
+	it, err := t.sst.NewIterator()
 	if err != nil {
+		f.tables.release(t)
 		return nil, err
 	}
+	return &tableIterator{Iterator: it, cache: f.tables, table: t}, nil
+}
 
-	recovered, err := wal.RecoverWAL(walFile)
-	if err != nil {
+// immMemTable 是同时冻结的各列族的 MemTable，空的 MemTable 不在其中，logNumber 是记录它们的最早的 WAL 段
+type immMemTable struct {
+	lists     map[*ColumnFamily]*skiplist.SkipList
+	logNumber uint64
+}
+
+// flushOutput 是刷盘时为一个列族写出的 L0 文件和 blob 文件
+type flushOutput struct {
+	cf    *ColumnFamily
+	table *tableFile
+	blobs []BlobMeta
+}
+
+func (o *flushOutput) remove(dir string) {
+	o.cf.tables.evict(o.table.meta.Number)
+	os.Remove(tableFileName(dir, o.table.meta.Number))
+	for _, b := range o.blobs {
+		os.Remove(blobFileName(dir, b.Number))
+	}
+}
+
+func NewLSMTree(baseDir string, opts *Options) (*LSMTree, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	opts = opts.sanitize()
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, err
 	}
 
-	memTable := skiplist.NewSkipList(16)
-	for k, v := range recovered {
-		memTable.Put(k, v)
+	// 根据 MANIFEST 重建 SSTable 集合，未被引用的文件移到 lost 目录
+	state, currentManifest, err := loadManifest(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if state.comparator != "" && state.comparator != opts.Comparator.Name() {
+		return nil, fmt.Errorf("comparator mismatch: data was written with %s, options specify %s", state.comparator, opts.Comparator.Name())
+	}
+	state.comparator = opts.Comparator.Name()
+	for _, meta := range state.families {
+		if name := opts.familyOptions(meta.Name).Comparator.Name(); name != meta.Comparator {
+			return nil, fmt.Errorf("column family %s: comparator mismatch: data was written with %s, options specify %s", meta.Name, meta.Comparator, name)
+		}
+	}
+	if err := moveAsideUnreferenced(baseDir, state, currentManifest); err != nil {
+		return nil, err
+	}
+	logs, err := liveLogs(baseDir, state.logNumber)
+	if err != nil {
+		return nil, err
+	}
+	// 新分配的文件号不能与尚未回放的 WAL 段冲突
+	for _, name := range logs {
+		if number, ok := parseLogName(filepath.Base(name)); ok && number >= state.nextFileNumber {
+			state.nextFileNumber = number + 1
+		}
+	}
+	manifestNumber := state.nextFileNumber
+	state.nextFileNumber++
+	m, err := createManifest(baseDir, manifestNumber, state)
+	if err != nil {
+		return nil, err
+	}
+	if currentManifest != "" {
+		if err := os.Remove(filepath.Join(baseDir, currentManifest)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
 	}
 
 	lsm := &LSMTree{
-		memTable:    memTable,
-		wal:         walInstance,
-		sstables:    make([]*sstable.SSTable, 0),
-		maxSize:     maxSize,
-		baseDir:     baseDir,
-		sstableSeq:  0,
-		flushChan:   make(chan struct{}, 1),
-		compactChan: make(chan struct{}, 1),
+		families:       make(map[uint32]*ColumnFamily),
+		nextFamilyID:   max(state.nextFamilyID, 1),
+		manifest:       m,
+		liveVersions:   make(map[*version]struct{}),
+		obsoleteFiles:  make(map[uint64]*tableFile),
+		blobs:          make(map[uint64]*BlobMeta),
+		obsoleteBlobs:  make(map[uint64]bool),
+		blobFiles:      newBlobFiles(baseDir),
+		opts:           opts,
+		blockCache:     cache.New(opts.BlockCacheSize, opts.BlockCachePolicy),
+		baseDir:        baseDir,
+		nextFileNumber: state.nextFileNumber,
+		lastSequence:   state.lastSequence,
+		locks:          newLockManager(),
+		flushChan:      make(chan struct{}, 1),
+		compactChan:    make(chan struct{}, 1),
+		closeChan:      make(chan struct{}),
+	}
+	lsm.flushCond = sync.NewCond(&lsm.mutex)
+	lsm.applyBlobEdit(state.blobs, nil)
+	families := append([]ColumnFamilyMeta{{Name: DefaultColumnFamilyName}}, state.families...)
+	for _, meta := range families {
+		cf := lsm.newColumnFamily(meta, opts.familyOptions(meta.Name))
+		if err := cf.loadFiles(state.files); err != nil {
+			m.Close()
+			return nil, err
+		}
+		lsm.families[cf.id] = cf
 	}
+	lsm.defaultFamily = lsm.families[0]
 
-	lsm.wg.Add(1)
+	if err := lsm.recoverLogs(logs); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	lsm.wg.Add(2)
+	go lsm.flushWorker()
 	go lsm.backgroundWorker()
 
 	return lsm, nil
 }
-func (lsm *LSMTree) flush() error {
-	sstableFile := fmt.Sprintf("%s/sstable-%d", lsm.baseDir, lsm.sstableSeq)
-	sst := sstable.NewSSTable(sstableFile)
-	if err := sst.Write(lsm.memTable.ToMap()); err != nil {
-		return err
-	}
-	lsm.sstables = append(lsm.sstables, sst)
-
-	lsm.sstableSeq++
 
-	lsm.memTable = skiplist.NewSkipList(16)
+// recoverLogs 回放尚未刷盘的 WAL 段并把结果直接写成 L0 文件，
+// 之后切换到新的 WAL 段，旧的段在 MANIFEST 落盘后删除
+func (lsm *LSMTree) recoverLogs(logs []string) error {
+	memTables := make(map[*ColumnFamily]*skiplist.SkipList)
+	for _, name := range logs {
+		// 先回放并截断日志尾部，旧版本的 wal.log 是 JSON 行格式，回放后随其他段一起删除
+		var recovered []wal.Entry
+		var err error
+		if filepath.Base(name) == legacyLogName {
+			recovered, err = wal.RecoverLegacyWAL(name)
+		} else {
+			recovered, err = wal.RecoverWAL(name)
+		}
+		if err != nil {
+			return fmt.Errorf("recover %s: %w", name, err)
+		}
+		for _, entry := range recovered {
+			// 单条写入的旧记录没有序列号，按回放顺序分配
+			seq := entry.Seq
+			if seq == 0 {
+				seq = lsm.lastSequence + 1
+			}
+			lsm.lastSequence = max(lsm.lastSequence, seq)
+			// 已经删除的列族的记录不再需要
+			cf, ok := lsm.families[entry.Family]
+			if !ok {
+				continue
+			}
+			if memTables[cf] == nil {
+				memTables[cf] = cf.newMemTable()
+			}
+			memTables[cf].Put(internalEntry(entry, seq))
+		}
+	}
 
-	if err := lsm.wal.Close(); err != nil {
+	lsm.logNumber = lsm.allocFileNumber()
+	edit := &versionEdit{LogNumber: lsm.logNumber, LastSequence: lsm.lastSequence}
+	outputs, err := lsm.writeLevel0Tables(memTables)
+	if err != nil {
 		return err
 	}
-
-	walFile := fmt.Sprintf("%s/wal.log", lsm.baseDir)
-	if err := os.Remove(walFile); err != nil {
+	for _, o := range outputs {
+		edit.AddFiles = append(edit.AddFiles, o.table.meta)
+		edit.AddBlobs = append(edit.AddBlobs, o.blobs...)
+	}
+	edit.NextFileNumber = lsm.nextFileNumber
+	if err := lsm.manifest.logEdit(edit); err != nil {
+		return err
+	}
+	lsm.installFlushOutputs(outputs)
+	if err := lsm.releaseObsoleteLogs(lsm.logNumber); err != nil {
 		return err
 	}
 
-	walInstance, err := wal.NewWAL(walFile)
+	walInstance, err := wal.NewWALWithOptions(logFileName(lsm.baseDir, lsm.logNumber), lsm.opts.walOptions())
 	if err != nil {
 		return err
 	}
-
 	lsm.wal = walInstance
-
-	//判断是否需要合并SSTable文件
-	if len(lsm.sstables) >= 3 {
-		select {
-		case lsm.compactChan <- struct{}{}:
-		default:
-		}
-	}
+	lsm.memLogNumber = lsm.logNumber
 	return nil
+}
+
+// writerOptions 返回写入 level 层编号为 number 的文件时使用的表选项
+func (cf *ColumnFamily) writerOptions(number uint64, level int) *sstable.Options {
+	opts := *cf.tableOpts
+	opts.Compression = cf.opts.compressionForLevel(level)
+	opts.CacheID = number
+	return &opts
+}
+
+// newMemTable 创建以内部键排序的跳表，同一个用户键的每次写入都是一个新节点
+func (cf *ColumnFamily) newMemTable() *skiplist.SkipList {
+	return skiplist.NewSkipList(16, cf.icmp)
+}
 
+// newTableFile 根据刚写完的 SSTable 生成 MANIFEST 元数据，并把它放进列族的表缓存
+func (cf *ColumnFamily) newTableFile(sst *sstable.SSTable, number uint64, level int) *tableFile {
+	props := sst.Properties()
+	meta := FileMeta{
+		Number:   number,
+		Level:    level,
+		Smallest: props.SmallestKey,
+		Largest:  props.LargestKey,
+		Size:     props.DataSize,
+		Entries:  props.NumEntries,
+		Family:   cf.id,
+	}
+	if info, err := os.Stat(sst.GetFilePath()); err == nil {
+		meta.Size = info.Size()
+	}
+	cf.tables.add(number, sst)
+	return &tableFile{meta: meta, tables: cf.tables}
 }
-func (lsm *LSMTree) Put(key, value string) error {
+
+func (lsm *LSMTree) allocFileNumber() uint64 {
 	lsm.mutex.Lock()
 	defer lsm.mutex.Unlock()
+	number := lsm.nextFileNumber
+	lsm.nextFileNumber++
+	return number
+}
 
-	if lsm.closed {
-		return fmt.Errorf("lsm tree is closed")
+// appendFile 返回追加了 f 的新切片，不修改旧版本共享的底层数组
+func appendFile(files []*tableFile, f *tableFile) []*tableFile {
+	result := make([]*tableFile, 0, len(files)+1)
+	result = append(result, files...)
+	return append(result, f)
+}
+
+// writeLevel0Tables 把各列族的 MemTable 分别写成 L0 文件，不需要持有 mutex。
+// 失败时删除已经写出的文件
+func (lsm *LSMTree) writeLevel0Tables(lists map[*ColumnFamily]*skiplist.SkipList) ([]flushOutput, error) {
+	var outputs []flushOutput
+	for cf, list := range lists {
+		table, blobs, err := lsm.writeLevel0Table(cf, list)
+		if err != nil {
+			for _, o := range outputs {
+				o.remove(lsm.baseDir)
+			}
+			return nil, err
+		}
+		if table != nil {
+			outputs = append(outputs, flushOutput{cf: cf, table: table, blobs: blobs})
+		}
 	}
-	//写入WAL
-	if err := lsm.wal.Write(key, value); err != nil {
-		return err
+	return outputs, nil
+}
+
+// installFlushOutputs 把已经记录到 MANIFEST 的 L0 文件加入各列族的版本，调用方需持有 mutex
+func (lsm *LSMTree) installFlushOutputs(outputs []flushOutput) {
+	for _, o := range outputs {
+		lsm.applyBlobEdit(o.blobs, nil)
+		v := o.cf.current.clone()
+		v.levels[0] = appendFile(v.levels[0], o.table)
+		lsm.installVersion(o.cf, v)
 	}
+}
 
-	//写入MemTable
-	lsm.memTable.Put(key, value)
+// writeLevel0Table 把 MemTable 写成一个 SSTable，大的值写进新的 blob 文件，不需要持有 mutex。
+// 每个列族单独写 blob 文件。MemTable 为空时返回 nil
+func (lsm *LSMTree) writeLevel0Table(cf *ColumnFamily, list *skiplist.SkipList) (*tableFile, []BlobMeta, error) {
+	if list.Size() == 0 {
+		return nil, nil, nil
+	}
+	number := lsm.allocFileNumber()
+	writer, err := sstable.NewWriter(tableFileName(lsm.baseDir, number), cf.writerOptions(number, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	separator := lsm.newBlobSeparator(cf, nil)
+	it := list.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key, value, err := separator.add(it.Key(), it.Value())
+		if err == nil {
+			err = writer.Add(tableEntry(key, value))
+		}
+		if err != nil {
+			writer.Abort()
+			separator.abort()
+			return nil, nil, err
+		}
+	}
+	sst, err := writer.Finish()
+	if err != nil {
+		os.Remove(tableFileName(lsm.baseDir, number))
+		separator.abort()
+		return nil, nil, err
+	}
+	table := cf.newTableFile(sst, number, 0)
+	table.meta.Blobs = separator.takeRefs()
+	blobs, _, err := separator.finish()
+	if err != nil {
+		cf.tables.evict(number)
+		os.Remove(tableFileName(lsm.baseDir, number))
+		return nil, nil, err
+	}
+	return table, blobs, nil
+}
 
-	if lsm.memTable.Size() >= lsm.maxSize {
-		select {
-		case lsm.flushChan <- struct{}{}:
-		default:
+// switchMemTable 冻结所有列族非空的 MemTable 并切换到新的 WAL 段，调用方需持有 mutex
+func (lsm *LSMTree) switchMemTable() error {
+	if err := lsm.rotateLog(); err != nil {
+		return err
+	}
+	imm := &immMemTable{lists: make(map[*ColumnFamily]*skiplist.SkipList), logNumber: lsm.memLogNumber}
+	for _, cf := range lsm.families {
+		if cf.memTable.Size() > 0 {
+			imm.lists[cf] = cf.memTable
+			cf.memTable = cf.newMemTable()
 		}
+	}
+	lsm.imm = append(lsm.imm, imm)
+	lsm.memLogNumber = lsm.logNumber
 
+	select {
+	case lsm.flushChan <- struct{}{}:
+	default:
 	}
 	return nil
+}
 
+// rotateLog 先创建新的 WAL 段再关闭旧的段，任何时刻磁盘上都有一个可以追加的段。
+// 调用方持有 mutex 并位于写入队列队首
+func (lsm *LSMTree) rotateLog() error {
+	number := lsm.nextFileNumber
+	lsm.nextFileNumber++
+	walInstance, err := wal.NewWALWithOptions(logFileName(lsm.baseDir, number), lsm.opts.walOptions())
+	if err != nil {
+		return err
+	}
+	if err := lsm.wal.Close(); err != nil {
+		walInstance.Close()
+		os.Remove(logFileName(lsm.baseDir, number))
+		// 旧的段已经关闭，其中的记录是否落盘未知，之后的写入都返回该错误
+		lsm.bgErr = err
+		lsm.flushCond.Broadcast()
+		return err
+	}
+	lsm.wal = walInstance
+	lsm.logNumber = number
+	return nil
 }
 
-func (lsm *LSMTree) Get(Key string) (string, bool) {
-	lsm.mutex.Lock()
-	defer lsm.mutex.Unlock()
+// memTableFull 判断是否有列族的 MemTable 达到了它的 MemTableSize，调用方需持有 mutex
+func (lsm *LSMTree) memTableFull() bool {
+	for _, cf := range lsm.families {
+		if cf.memTable.Size() >= cf.opts.MemTableSize {
+			return true
+		}
+	}
+	return false
+}
 
-	if value, ok := lsm.memTable.Get(Key); ok {
-		return value, true
+// memTablesEmpty 判断所有列族的 MemTable 是否都为空，调用方需持有 mutex
+func (lsm *LSMTree) memTablesEmpty() bool {
+	for _, cf := range lsm.families {
+		if cf.memTable.Size() > 0 {
+			return false
+		}
 	}
+	return true
+}
 
-	for i := len(lsm.sstables) - 1; i >= 0; i-- {
-		if value, ok := lsm.sstables[i].Get(Key); ok {
-			return value, true
+// makeRoomForWrite 在任一列族的 MemTable 写满时冻结所有列族的 MemTable，冻结队列排满时等待后台刷盘，
+// 调用方需持有 mutex
+func (lsm *LSMTree) makeRoomForWrite() error {
+	for {
+		switch {
+		case lsm.closed:
+			return errClosed
+		case lsm.bgErr != nil:
+			return lsm.bgErr
+		case !lsm.memTableFull():
+			if lsm.wal.Size() >= lsm.opts.MaxWALSegmentSize {
+				return lsm.rotateLog()
+			}
+			return nil
+		case len(lsm.imm) >= lsm.opts.MaxImmutableMemTables:
+			lsm.flushCond.Wait()
+		default:
+			return lsm.switchMemTable()
 		}
 	}
-	return "", false
 }
 
-func (lsm *LSMTree) Compact() error {
+// flushImmutable 把最旧的一组冻结 MemTable 写成各列族的 L0 文件，作为一条 MANIFEST 记录提交。
+// 同一时刻只有一个刷盘者，写 SSTable 期间不持有 mutex
+func (lsm *LSMTree) flushImmutable() (bool, error) {
 	lsm.mutex.Lock()
-	defer lsm.mutex.Unlock()
+	if len(lsm.imm) == 0 || lsm.bgErr != nil {
+		lsm.mutex.Unlock()
+		return false, nil
+	}
+	imm := lsm.imm[0]
+	lsm.mutex.Unlock()
 
-	if len(lsm.sstables) < 2 {
-		return nil
+	outputs, err := lsm.writeLevel0Tables(imm.lists)
+	if err != nil {
+		return false, err
 	}
 
-	merged := make(map[string]string)
+	lsm.mutex.Lock()
+	// 之后最旧的仍需回放的 WAL 段
+	logNumber := lsm.memLogNumber
+	if len(lsm.imm) > 1 {
+		logNumber = lsm.imm[1].logNumber
+	}
+	edit := &versionEdit{LogNumber: logNumber, NextFileNumber: lsm.nextFileNumber, LastSequence: lsm.lastSequence}
+	// 写 SSTable 期间被删除的列族的文件直接删除
+	live := outputs[:0]
+	for _, o := range outputs {
+		if o.cf.dropped {
+			o.remove(lsm.baseDir)
+			continue
+		}
+		live = append(live, o)
+		edit.AddFiles = append(edit.AddFiles, o.table.meta)
+		edit.AddBlobs = append(edit.AddBlobs, o.blobs...)
+	}
+	outputs = live
+	if err := lsm.manifest.logEdit(edit); err != nil {
+		lsm.mutex.Unlock()
+		for _, o := range outputs {
+			o.remove(lsm.baseDir)
+		}
+		return false, err
+	}
+	lsm.installFlushOutputs(outputs)
+	lsm.imm = lsm.imm[1:]
+	lsm.flushCond.Broadcast()
+	needsCompaction := lsm.needsCompaction()
+	lsm.mutex.Unlock()
+
+	// 新文件已经记录到 MANIFEST，可以删除或归档对应的 WAL 段
+	if err := lsm.releaseObsoleteLogs(logNumber); err != nil {
+		log.Printf("Failed to release WAL segments before %d: %v", logNumber, err)
+	}
+	if needsCompaction {
+		select {
+		case lsm.compactChan <- struct{}{}:
+		default:
+		}
+	}
+	return true, nil
+}
 
-	for _, sst := range lsm.sstables {
-		filepath := sst.GetFilePath()
-		file, err := os.Open(filepath)
+// flushImmutables 依次刷盘所有冻结的 MemTable，失败后记录到 bgErr
+func (lsm *LSMTree) flushImmutables() error {
+	for {
+		flushed, err := lsm.flushImmutable()
 		if err != nil {
+			lsm.mutex.Lock()
+			lsm.bgErr = err
+			lsm.flushCond.Broadcast()
+			lsm.mutex.Unlock()
 			return err
 		}
-		defer file.Close()
+		if !flushed {
+			return nil
+		}
+	}
+}
 
-		decoder := json.NewDecoder(file)
+// Flush 冻结当前 MemTable，并等待所有冻结的 MemTable 写入 SSTable
+func (lsm *LSMTree) Flush() error {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
 
-		for {
-			var entry struct {
-				Key   string `json:"key"`
-				Value string `json:"value"`
-			}
-			if err := decoder.Decode(&entry); err != nil {
-				break
-			}
-			merged[entry.Key] = entry.Value
+	// 排到写入队列的队首，保证没有写入正在使用当前的 WAL
+	w := &writer{cond: sync.NewCond(&lsm.mutex)}
+	lsm.waitForTurn(w)
+	err := lsm.freezeMemTable()
+	lsm.finishWriters([]*writer{w}, err)
+	if err != nil {
+		return err
+	}
+	for lsm.bgErr == nil && len(lsm.imm) > 0 {
+		lsm.flushCond.Wait()
+	}
+	return lsm.bgErr
+}
+
+// freezeMemTable 在冻结队列有空位时冻结非空的 MemTable，调用方持有 mutex 并位于写入队列队首
+func (lsm *LSMTree) freezeMemTable() error {
+	for !lsm.closed && lsm.bgErr == nil && len(lsm.imm) >= lsm.opts.MaxImmutableMemTables {
+		lsm.flushCond.Wait()
+	}
+	if lsm.closed {
+		return errClosed
+	}
+	if lsm.bgErr != nil {
+		return lsm.bgErr
+	}
+	if !lsm.memTablesEmpty() {
+		return lsm.switchMemTable()
+	}
+	return nil
+}
+
+func (lsm *LSMTree) Put(key, value []byte) error {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return lsm.Write(batch)
+}
+
+// PutWithTTL 写入一个在 ttl 之后过期的值。过期时间随记录保存在 WAL 和 SSTable 中，
+// 过期之后 Get 和迭代器都看不到它，合并时被删除
+func (lsm *LSMTree) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutWithTTL(key, value, ttl)
+	return lsm.Write(batch)
+}
+
+// Delete 写入墓碑，旧版本在读取时被遮蔽，直到合并时才真正删除
+func (lsm *LSMTree) Delete(key []byte) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return lsm.Write(batch)
+}
+
+// Get 返回最新的值，返回的切片是副本，调用方可以自由修改
+func (lsm *LSMTree) Get(Key []byte) ([]byte, bool) {
+	return lsm.GetWithOptions(Key, nil)
+}
+
+// GetWithOptions 返回 opts.Snapshot 时刻可见的值
+func (lsm *LSMTree) GetWithOptions(Key []byte, opts *ReadOptions) ([]byte, bool) {
+	return lsm.get(lsm.defaultFamily, Key, opts)
+}
+
+func (lsm *LSMTree) get(cf *ColumnFamily, Key []byte, opts *ReadOptions) ([]byte, bool) {
+	// 只在获取快照时加锁，查找过程中刷盘和合并可以并行进行
+	lsm.mutex.Lock()
+	if cf.dropped {
+		lsm.mutex.Unlock()
+		return nil, false
+	}
+	lists := cf.memTables()
+	v := cf.refVersion()
+	seq := lsm.lastSequence
+	if opts != nil && opts.Snapshot != nil {
+		seq = opts.Snapshot.seq
+	}
+	lsm.mutex.Unlock()
+	defer lsm.unrefVersion(v)
+
+	ikey, value, ok, err := cf.lookup(lists, v, Key, seq)
+	if err != nil {
+		log.Printf("Failed to get %q: %v", Key, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	switch _, _, kind := parseInternalKey(ikey); kind {
+	case kindDelete:
+		return nil, false
+	case kindPutTTL:
+		expiresAt, value := parseTTLValue(value)
+		if expiresAt <= time.Now().UnixNano() {
+			return nil, false
 		}
+		return append([]byte(nil), value...), true
+	case kindMerge:
+		value, err := cf.getMerged(lists, v, Key, seq)
+		if err != nil {
+			log.Printf("Failed to get %q: %v", Key, err)
+			return nil, false
+		}
+		return value, true
+	case kindBlob:
+		// 从 blob 文件读出的值已经是副本
+		value, err := lsm.blobFiles.read(extractUserKey(ikey), value)
+		if err != nil {
+			log.Printf("Failed to get %q: %v", Key, err)
+			return nil, false
+		}
+		return value, true
 	}
-	newSSTableFile := fmt.Sprintf("%s/sstable_%d.sst", lsm.baseDir, lsm.sstableSeq)
-	newSST := sstable.NewSSTable(newSSTableFile)
-	if err := newSST.Write(merged); err != nil {
-		return err
+	return append([]byte(nil), value...), true
+}
+
+// lookup 按从新到旧的顺序查找序列号不大于 seq 的最新版本，返回它的内部键和值，
+// 找到的第一个版本即为结果。lists 是 memTables 返回的 MemTable
+func (cf *ColumnFamily) lookup(lists []*skiplist.SkipList, v *version, key []byte, seq uint64) ([]byte, []byte, bool, error) {
+	ucmp := cf.opts.Comparator
+	lkey := makeInternalKey(nil, key, seq, kindSeek)
+
+	for _, list := range lists {
+		it := list.NewIterator()
+		it.Seek(lkey)
+		if it.Valid() && ucmp.Compare(extractUserKey(it.Key()), key) == 0 {
+			return it.Key(), it.Value(), true, nil
+		}
 	}
 
-	for _, sst := range lsm.sstables {
-		if err := os.Remove(sst.GetFilePath()); err != nil {
-			return err
+	find := func(f *tableFile) ([]byte, []byte, bool, error) {
+		entry, ok, err := f.Lookup(lkey)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("read table %d: %w", f.meta.Number, err)
+		}
+		if !ok || ucmp.Compare(extractUserKey(entry.Key), key) != 0 {
+			return nil, nil, false, nil
+		}
+		return entry.Key, entry.Value, true, nil
+	}
+	// L0 从新到旧逐个查找
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		if ikey, value, ok, err := find(v.levels[0][i]); ok || err != nil {
+			return ikey, value, ok, err
 		}
 	}
+	// 其余各层最多只有一个文件的键范围包含 key
+	for level := 1; level < len(v.levels); level++ {
+		files := v.levels[level]
+		i := sort.Search(len(files), func(i int) bool {
+			return ucmp.Compare(extractUserKey(files[i].meta.Largest), key) >= 0
+		})
+		if i < len(files) && ucmp.Compare(extractUserKey(files[i].meta.Smallest), key) <= 0 {
+			if ikey, value, ok, err := find(files[i]); ok || err != nil {
+				return ikey, value, ok, err
+			}
+		}
+	}
+	return nil, nil, false, nil
+}
 
-	lsm.sstables = []*sstable.SSTable{newSST}
-	lsm.sstableSeq++
-	return nil
+// BlockCacheStats 返回 block 缓存的命中、未命中次数和用量
+func (lsm *LSMTree) BlockCacheStats() cache.Stats {
+	return lsm.blockCache.Stats()
 }
 
+// Close 停止后台任务，把所有 MemTable 刷盘后关闭 WAL 和 MANIFEST
 func (lsm *LSMTree) Close() error {
-	if err := lsm.flush(); err != nil {
+	lsm.mutex.Lock()
+	if lsm.closed {
+		lsm.mutex.Unlock()
+		return nil
+	}
+	lsm.closed = true
+	lsm.flushCond.Broadcast()
+	lsm.mutex.Unlock()
+
+	close(lsm.closeChan)
+	lsm.wg.Wait()
+	// 等待正在进行的手动合并结束
+	lsm.compactionMutex.Lock()
+	defer lsm.compactionMutex.Unlock()
+
+	lsm.mutex.Lock()
+	// 等待正在写 WAL 的 leader 结束，之后排队的写入都会因为 closed 失败
+	w := &writer{cond: sync.NewCond(&lsm.mutex)}
+	lsm.waitForTurn(w)
+	err := lsm.bgErr
+	if err == nil && !lsm.memTablesEmpty() {
+		err = lsm.switchMemTable()
+	}
+	lsm.finishWriters([]*writer{w}, err)
+	lsm.mutex.Unlock()
+	if err == nil {
+		err = lsm.flushImmutables()
+	}
+
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	for _, cf := range lsm.families {
+		cf.tables.close()
+	}
+	lsm.blobFiles.close()
+	if err != nil {
+		lsm.wal.Close()
+		lsm.manifest.Close()
 		return err
 	}
-	return lsm.wal.Close()
+	if err := lsm.wal.Close(); err != nil {
+		return err
+	}
+	return lsm.manifest.Close()
 }
 
-func (lsm *LSMTree) backgroundWorker() {
+// flushWorker 在后台把冻结的 MemTable 写入 SSTable
+func (lsm *LSMTree) flushWorker() {
 	defer lsm.wg.Done()
 
 	for {
 		select {
 		case <-lsm.flushChan:
-			// 加锁
-			lsm.mutex.Lock()
-			if !lsm.closed && lsm.memTable.Size() > 0 {
-				// 尝试刷新内存表
-				if err := lsm.flush(); err != nil {
-					log.Printf("Flush error: %v", err)
-				}
-			}
-			// 解锁
-			lsm.mutex.Unlock()
-		case <-lsm.compactChan:
-			// 加锁
-			lsm.mutex.Lock()
-			if !lsm.closed && len(lsm.sstables) > 1 {
-				// 尝试合并SSTables
-				if err := lsm.Compact(); err != nil {
-					log.Printf("Compaction error: %v", err)
-				}
-			}
-		case <-time.After(time.Second * 10):
-			// 加锁
-			lsm.mutex.Lock()
-			if !lsm.closed && len(lsm.sstables) >= 3 {
-				// 尝试合并SSTables
-				if err := lsm.Compact(); err != nil {
-					log.Printf("Compaction error: %v", err)
-				}
+			if err := lsm.flushImmutables(); err != nil {
+				log.Printf("Flush error: %v", err)
 			}
-			// 解锁
-			lsm.mutex.Unlock()
+		case <-lsm.closeChan:
+			return
 		}
+	}
+}
 
-		// 加锁
-		lsm.mutex.Lock()
+func (lsm *LSMTree) backgroundWorker() {
+	defer lsm.wg.Done()
 
-		if lsm.closed {
-			// 解锁
-			lsm.mutex.Unlock()
+	for {
+		select {
+		case <-lsm.compactChan:
+			// 按各层得分挑选并执行合并
+			lsm.maybeCompact()
+		case <-time.After(time.Second * 10):
+			lsm.maybeCompact()
+			if err := lsm.GarbageCollectBlobs(); err != nil && err != errClosed {
+				log.Printf("Blob GC error: %v", err)
+			}
+			if err := lsm.purgeArchivedLogs(); err != nil {
+				log.Printf("Failed to purge archived WAL segments: %v", err)
+			}
+		case <-lsm.closeChan:
 			return
 		}
-		// 解锁
-		lsm.mutex.Unlock()
 	}
 }
@@ -0,0 +1,2503 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"LSMTree/comparator"
+	"LSMTree/sstable"
+	"LSMTree/wal"
+)
+
+func flushForTest(t *testing.T, lsm *LSMTree) {
+	t.Helper()
+	if err := lsm.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+}
+
+// tableNumbers 按层返回所有文件号
+func tableNumbers(lsm *LSMTree) [][]uint64 {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	numbers := make([][]uint64, len(lsm.defaultFamily.current.levels))
+	for level, files := range lsm.defaultFamily.current.levels {
+		for _, sst := range files {
+			numbers[level] = append(numbers[level], sst.meta.Number)
+		}
+	}
+	return numbers
+}
+
+func allTables(lsm *LSMTree) []*tableFile {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	var files []*tableFile
+	for _, level := range lsm.defaultFamily.current.levels {
+		files = append(files, level...)
+	}
+	return files
+}
+
+func TestDelete(t *testing.T) {
+	dir := t.TempDir()
+	// 只有两层，L1 就是最底层
+	opts := &Options{MemTableSize: 1 << 20, NumLevels: 2}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer func() { lsm.Close() }()
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	flushForTest(t, lsm)
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if levels := tableNumbers(lsm); len(levels[0]) != 0 || len(levels[1]) == 0 {
+		t.Fatalf("Expected all tables in the last level, got %v", levels)
+	}
+
+	deleted := map[string]bool{"key3": true, "key7": true}
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key%d", i)
+			value, ok := lsm.Get([]byte(key))
+			if deleted[key] && ok {
+				t.Errorf("%s: deleted key %s = %q", stage, key, value)
+			}
+			if !deleted[key] && (!ok || string(value) != "value") {
+				t.Errorf("%s: Get(%s) = %q, %v", stage, key, value, ok)
+			}
+		}
+	}
+	for key := range deleted {
+		if err := lsm.Delete([]byte(key)); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	}
+	// MemTable 中的墓碑遮蔽 L1 中的旧值
+	check("memtable tombstone")
+	flushForTest(t, lsm)
+	// L0 中的墓碑遮蔽 L1 中的旧值
+	check("flushed tombstone")
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	lsm, err = NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	check("reopened")
+
+	// 合并到最底层后墓碑和被它遮蔽的值一起被丢弃
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("compacted")
+	entries := 0
+	for _, f := range allTables(lsm) {
+		if f.meta.Level != 1 {
+			t.Errorf("Table %d is in level %d after compaction", f.meta.Number, f.meta.Level)
+		}
+		it, err := f.NewIterator()
+		if err != nil {
+			t.Fatalf("Failed to open table %d: %v", f.meta.Number, err)
+		}
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			entries++
+			if key := string(extractUserKey(it.Key())); deleted[key] {
+				t.Errorf("Table %d still contains %q after compaction", f.meta.Number, it.Key())
+			}
+		}
+		it.Close()
+	}
+	if entries != 8 {
+		t.Errorf("Tables contain %d entries after compaction, expected 8", entries)
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	lsm, err = NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	check("reopened after compaction")
+}
+
+// iterKeys 从当前位置开始遍历，返回 "键=值" 列表
+func iterKeys(it *Iterator) []string {
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	return keys
+}
+
+func TestIterator(t *testing.T) {
+	lsm, err := NewLSMTree(t.TempDir(), &Options{MemTableSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	put := func(key, value string) {
+		t.Helper()
+		if err := lsm.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	del := func(key string) {
+		t.Helper()
+		if err := lsm.Delete([]byte(key)); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	}
+
+	// 最旧的数据合并到 L1 以下，墓碑在 L0，最新的写入留在 MemTable 中
+	for _, prefix := range []string{"a/", "b/", "c/"} {
+		for i := 0; i < 5; i++ {
+			put(fmt.Sprintf("%s%d", prefix, i), "1")
+		}
+	}
+	flushForTest(t, lsm)
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	del("a/0")
+	del("b/1")
+	del("b/3")
+	put("b/2", "2")
+	flushForTest(t, lsm)
+	put("b/1", "3")
+	put("b/5", "3")
+	del("b/4")
+	del("c/4")
+	if levels := tableNumbers(lsm); len(levels[0]) != 1 || len(allTables(lsm)) < 2 {
+		t.Fatalf("Unexpected table layout %v", levels)
+	}
+
+	all := []string{"a/1=1", "a/2=1", "a/3=1", "a/4=1", "b/0=1", "b/1=3", "b/2=2", "b/5=3", "c/0=1", "c/1=1", "c/2=1", "c/3=1"}
+	reversed := func(keys []string) []string {
+		r := make([]string, len(keys))
+		for i, key := range keys {
+			r[len(keys)-1-i] = key
+		}
+		return r
+	}
+	check := func(name string, opts *IterOptions, expected []string) {
+		t.Helper()
+		it, err := lsm.NewIterator(opts)
+		if err != nil {
+			t.Fatalf("%s: failed to create iterator: %v", name, err)
+		}
+		defer it.Close()
+		it.First()
+		if got := iterKeys(it); strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("%s forward: got %v, expected %v", name, got, expected)
+		}
+		var got []string
+		for it.Last(); it.Valid(); it.Prev() {
+			got = append(got, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+		}
+		if strings.Join(got, " ") != strings.Join(reversed(expected), " ") {
+			t.Errorf("%s reverse: got %v, expected %v", name, got, reversed(expected))
+		}
+	}
+	check("all", nil, all)
+	check("lower", &IterOptions{LowerBound: []byte("b/2")}, all[6:])
+	check("upper", &IterOptions{UpperBound: []byte("b/2")}, all[:6])
+	check("bounds", &IterOptions{LowerBound: []byte("a/3"), UpperBound: []byte("c/1")}, all[2:9])
+	check("empty", &IterOptions{LowerBound: []byte("b/3"), UpperBound: []byte("b/5")}, nil)
+	check("prefix", &IterOptions{Prefix: []byte("b/")}, all[4:8])
+	check("prefix-and-bounds", &IterOptions{Prefix: []byte("b/"), LowerBound: []byte("b/1"), UpperBound: []byte("b/5")}, all[5:7])
+	check("missing-prefix", &IterOptions{Prefix: []byte("d/")}, nil)
+
+	it, err := lsm.NewIterator(&IterOptions{LowerBound: []byte("a/3"), UpperBound: []byte("c/1")})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	defer it.Close()
+	expectKey := func(op, expected string) {
+		t.Helper()
+		got := ""
+		if it.Valid() {
+			got = fmt.Sprintf("%s=%s", it.Key(), it.Value())
+		}
+		if got != expected {
+			t.Errorf("%s: at %q, expected %q", op, got, expected)
+		}
+	}
+	// Seek 到被删除的键时停在下一个可见键，越出下界时从下界开始，越出上界时失效
+	it.Seek([]byte("b/3"))
+	expectKey("Seek(b/3)", "b/5=3")
+	it.Seek([]byte("b/1"))
+	expectKey("Seek(b/1)", "b/1=3")
+	it.Seek([]byte("a"))
+	expectKey("Seek(a)", "a/3=1")
+	it.Seek([]byte("c/1"))
+	expectKey("Seek(c/1)", "")
+	it.Seek([]byte("z"))
+	expectKey("Seek(z)", "")
+
+	// 遍历中途改变方向
+	it.Seek([]byte("b/0"))
+	expectKey("Seek(b/0)", "b/0=1")
+	it.Next()
+	expectKey("Next", "b/1=3")
+	it.Next()
+	expectKey("Next", "b/2=2")
+	it.Prev()
+	expectKey("Prev", "b/1=3")
+	it.Prev()
+	expectKey("Prev", "b/0=1")
+	it.Next()
+	expectKey("Next", "b/1=3")
+	it.Next()
+	it.Next()
+	expectKey("Next over tombstones", "b/5=3")
+	it.Prev()
+	expectKey("Prev over tombstones", "b/2=2")
+	it.Last()
+	expectKey("Last", "c/0=1")
+	it.Next()
+	expectKey("Next past upper bound", "")
+	it.Last()
+	it.Prev()
+	expectKey("Prev", "b/5=3")
+	it.Next()
+	expectKey("Next", "c/0=1")
+	it.First()
+	expectKey("First", "a/3=1")
+	it.Prev()
+	expectKey("Prev past lower bound", "")
+
+	// 前缀迭代器中 Seek 到前缀之前从前缀的第一个键开始
+	prefixed, err := lsm.NewIterator(&IterOptions{Prefix: []byte("b/")})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	defer prefixed.Close()
+	prefixed.Seek([]byte("a/4"))
+	if !prefixed.Valid() || string(prefixed.Key()) != "b/0" {
+		t.Errorf("Seek before the prefix did not land on b/0")
+	}
+	prefixed.Seek([]byte("b/6"))
+	if prefixed.Valid() {
+		t.Errorf("Seek after the prefix returned %q", prefixed.Key())
+	}
+}
+
+func TestManifestReopen(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 1000})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			if err := lsm.Put([]byte(fmt.Sprintf("key%d-%d", round, i)), []byte("value")); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+		flushForTest(t, lsm)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key3-%d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	flushForTest(t, lsm)
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	// 后台合并可能随时发生，这里只比较关闭前后的文件集合
+	expected := tableNumbers(lsm)
+	if len(allTables(lsm)) == 0 {
+		t.Fatalf("Expected tables after compaction and flush")
+	}
+
+	// 放入一个 MANIFEST 没有引用的文件
+	stray := filepath.Join(dir, "sstable-999")
+	if err := os.WriteFile(stray, []byte("stray"), 0644); err != nil {
+		t.Fatalf("Failed to write stray file: %v", err)
+	}
+
+	lsm, err = NewLSMTree(dir, &Options{MemTableSize: 1000})
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	got := tableNumbers(lsm)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Reopened tables %v, expected %v", got, expected)
+	}
+	for _, sst := range allTables(lsm) {
+		if sst.meta.Entries == 0 || sst.meta.Size == 0 || bytes.Compare(sst.meta.Smallest, sst.meta.Largest) > 0 {
+			t.Errorf("Invalid metadata for table %d: %+v", sst.meta.Number, sst.meta)
+		}
+	}
+	// 重启后索引从文件中重建，数据可以读到
+	for round := 0; round < 4; round++ {
+		key := fmt.Sprintf("key%d-%d", round, 4)
+		if value, ok := lsm.Get([]byte(key)); !ok || string(value) != "value" {
+			t.Errorf("Get(%q) after reopen = %q, %v", key, value, ok)
+		}
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("Unreferenced file was not moved aside")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lost", "sstable-999")); err != nil {
+		t.Errorf("Unreferenced file not found in lost directory: %v", err)
+	}
+
+	// 新分配的文件号不能与已有文件冲突
+	if err := lsm.Put([]byte("new"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	flushForTest(t, lsm)
+	var maxOld uint64
+	for _, level := range expected {
+		for _, number := range level {
+			maxOld = max(maxOld, number)
+		}
+	}
+	l0 := tableNumbers(lsm)[0]
+	if last := l0[len(l0)-1]; last <= maxOld {
+		t.Errorf("New table number %d reuses an old number", last)
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{
+		MemTableSize:        50,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       4096,
+		LevelSizeMultiplier: 2,
+		TargetFileSize:      2048,
+	}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%04d", i*7919%500)
+		if i%3 == 0 {
+			if err := lsm.Delete([]byte(key)); err != nil {
+				t.Fatalf("Failed to delete: %v", err)
+			}
+			delete(expected, key)
+		} else {
+			value := fmt.Sprintf("value%d", i)
+			if err := lsm.Put([]byte(key), []byte(value)); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+			expected[key] = value
+		}
+	}
+	flushForTest(t, lsm)
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	// L1 及以下每层的文件互不重叠
+	lsm.mutex.Lock()
+	var entries int64
+	for level, files := range lsm.defaultFamily.current.levels {
+		for i, f := range files {
+			entries += f.meta.Entries
+			if level > 0 && i > 0 && bytes.Compare(files[i-1].meta.Largest, f.meta.Smallest) >= 0 {
+				t.Errorf("Level %d files %d and %d overlap", level, files[i-1].meta.Number, f.meta.Number)
+			}
+		}
+	}
+	lsm.mutex.Unlock()
+
+	// 手动合并到最底层后墓碑全部被清理
+	if entries != int64(len(expected)) {
+		t.Errorf("Tables hold %d entries, expected %d live keys", entries, len(expected))
+	}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		value, ok := lsm.Get([]byte(key))
+		if want, exists := expected[key]; ok != exists || string(value) != want {
+			t.Errorf("Get(%q) = %q, %v, expected %q, %v", key, value, ok, want, exists)
+		}
+	}
+}
+
+func TestImmutableMemTableFlush(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 10, MaxImmutableMemTables: 1})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	// 写入期间后台不断冻结和刷盘，读操作需要同时查看冻结的 MemTable
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := lsm.Put([]byte(key), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		if value, ok := lsm.Get([]byte(key)); !ok || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Get(%q) right after put = %q, %v", key, value, ok)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	// 刷盘完成后只剩当前的 WAL 段
+	logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatalf("Failed to list WAL segments: %v", err)
+	}
+	if len(logs) != 1 || logs[0] != logFileName(dir, lsm.logNumber) {
+		t.Errorf("WAL segments after flush = %v, expected only the active one", logs)
+	}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if value, ok := lsm.Get([]byte(key)); !ok || string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(%q) after flush = %q, %v", key, value, ok)
+		}
+	}
+}
+
+// 最早的版本只有一个 JSON 行格式的 wal.log，升级后第一次打开时回放并删除
+func TestUpgradeLegacyWAL(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"key":"key1","value":"value1"}` + "\n" +
+		`{"key":"key2","value":"value2"}` + "\n" +
+		`{"key":"key1","value":"updated"}` + "\n" +
+		`{"key":"key3","val` // 写到一半被打断的最后一行
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write legacy WAL: %v", err)
+	}
+	expected := map[string]string{"key1": "updated", "key2": "value2"}
+	check := func(lsm *LSMTree, stage string) {
+		t.Helper()
+		for key, want := range expected {
+			if value, ok := lsm.Get([]byte(key)); !ok || string(value) != want {
+				t.Errorf("%s: Get(%s) = %q, %v, expected %q", stage, key, value, ok, want)
+			}
+		}
+		if _, ok := lsm.Get([]byte("key3")); ok {
+			t.Errorf("%s: recovered the torn record", stage)
+		}
+	}
+
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree with a legacy WAL: %v", err)
+	}
+	check(lsm, "upgraded")
+	if _, err := os.Stat(filepath.Join(dir, "wal.log")); !os.IsNotExist(err) {
+		t.Errorf("Legacy WAL was not removed after recovery: %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	lsm, err = NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	check(lsm, "reopened")
+
+	// 中间的行损坏时报告偏移量，不会丢弃之后的记录
+	corrupted := t.TempDir()
+	if err := os.WriteFile(filepath.Join(corrupted, "wal.log"), []byte(`{"key":"a","value":"1"}`+"\n"+"garbage\n"+`{"key":"b","value":"2"}`+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write legacy WAL: %v", err)
+	}
+	var corruption *wal.CorruptionError
+	if _, err := NewLSMTree(corrupted, nil); !errors.As(err, &corruption) || corruption.Offset != 24 {
+		t.Errorf("Opening a corrupted legacy WAL returned %v, expected CorruptionError at offset 24", err)
+	}
+}
+
+func TestRecoverWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	// 模拟崩溃时留下的多个 WAL 段，编号大的段更新
+	segments := [][]wal.Entry{
+		{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("1")}},
+		{{Key: []byte("a"), Value: []byte("2")}, {Key: []byte("c"), Value: []byte("2")}},
+		{{Key: []byte("b"), Deleted: true}},
+	}
+	for i, entries := range segments {
+		w, err := wal.NewWAL(logFileName(dir, uint64(i+1)))
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.Deleted {
+				err = w.Delete(entry.Key)
+			} else {
+				err = w.Write(entry.Key, entry.Value)
+			}
+			if err != nil {
+				t.Fatalf("Failed to write WAL: %v", err)
+			}
+		}
+		w.Close()
+	}
+
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	expected := map[string]string{"a": "2", "c": "2"}
+	for _, key := range []string{"a", "b", "c"} {
+		value, ok := lsm.Get([]byte(key))
+		if want, exists := expected[key]; ok != exists || string(value) != want {
+			t.Errorf("Get(%q) = %q, %v, expected %q, %v", key, value, ok, want, exists)
+		}
+	}
+	// 回放的数据已经写入 L0，旧的段被删除
+	for i := range segments {
+		if _, err := os.Stat(logFileName(dir, uint64(i+1))); !os.IsNotExist(err) {
+			t.Errorf("WAL segment %d was not removed after recovery", i+1)
+		}
+	}
+	if n := len(tableNumbers(lsm)[0]); n != 1 {
+		t.Errorf("Expected 1 table in level 0 after recovery, got %d", n)
+	}
+}
+
+func TestComparator(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{Comparator: comparator.Reverse(comparator.Bytewise), MemTableSize: 20, L0CompactionTrigger: 2}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+
+	// 大端序整数键，其中包含 0x00 和 0xff
+	var keys [][]byte
+	for i := 0; i < 300; i++ {
+		key := binary.BigEndian.AppendUint32([]byte{byte(i % 3)}, uint32(i)*0x01010101)
+		keys = append(keys, key)
+		if err := lsm.Put(key, append([]byte{0xff, 0x00}, key...)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	for _, key := range keys {
+		value, ok := lsm.Get(key)
+		if !ok || !bytes.Equal(value, append([]byte{0xff, 0x00}, key...)) {
+			t.Fatalf("Get(%x) = %x, %v", key, value, ok)
+		}
+	}
+
+	// 迭代顺序与字节序相反
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) > 0 })
+	it, err := lsm.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	i := 0
+	for it.First(); it.Valid(); it.Next() {
+		if i >= len(keys) || !bytes.Equal(it.Key(), keys[i]) {
+			t.Fatalf("Iterator entry %d = %x", i, it.Key())
+		}
+		i++
+	}
+	if err := it.Close(); err != nil || i != len(keys) {
+		t.Fatalf("Iterated %d entries, expected %d: %v", i, len(keys), err)
+	}
+
+	// 非字节序下前缀通过逐个过滤实现
+	it, err = lsm.NewIterator(&IterOptions{Prefix: []byte{1}})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		if it.Key()[0] != 1 {
+			t.Fatalf("Prefix iterator returned %x", it.Key())
+		}
+		n++
+	}
+	it.Close()
+	if n != 100 {
+		t.Errorf("Prefix iterator returned %d keys, expected 100", n)
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	// 用不同的比较器重新打开应当失败
+	if _, err := NewLSMTree(dir, nil); err == nil {
+		t.Fatalf("Expected error when reopening with a different comparator")
+	}
+	lsm, err = NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	if _, ok := lsm.Get(keys[0]); !ok {
+		t.Errorf("Get(%x) after reopen not found", keys[0])
+	}
+}
+
+// copyDir 复制打开中的数据目录，用来模拟进程崩溃时磁盘上的状态
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", entry.Name(), err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	if err := lsm.Put([]byte("b"), []byte("old")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	key := []byte("a")
+	batch.Put(key, []byte("1"))
+	// 批次保存的是副本，修改原切片不影响已加入的记录
+	key[0] = 'c'
+	batch.Put(key, []byte("3"))
+	batch.Delete([]byte("b"))
+	if batch.Count() != 3 {
+		t.Fatalf("Count() = %d, expected 3", batch.Count())
+	}
+	if err := lsm.Write(batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+
+	check := func(lsm *LSMTree) {
+		t.Helper()
+		expected := map[string]string{"a": "1", "c": "3"}
+		for _, key := range []string{"a", "b", "c"} {
+			value, ok := lsm.Get([]byte(key))
+			if want, exists := expected[key]; ok != exists || string(value) != want {
+				t.Errorf("Get(%q) = %q, %v, expected %q, %v", key, value, ok, want, exists)
+			}
+		}
+	}
+	check(lsm)
+
+	// 不关闭数据库直接复制目录，重启后从 WAL 中回放整个批次
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	recovered, err := NewLSMTree(crashed, nil)
+	if err != nil {
+		t.Fatalf("Failed to open copied LSM tree: %v", err)
+	}
+	defer recovered.Close()
+	check(recovered)
+
+	batch.Clear()
+	if batch.Count() != 0 {
+		t.Errorf("Count() after Clear = %d", batch.Count())
+	}
+	if err := lsm.Write(batch); err != nil {
+		t.Errorf("Writing an empty batch failed: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v1")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	snapshot := lsm.GetSnapshot()
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if i%2 == 0 {
+			err = lsm.Delete(key)
+		} else {
+			err = lsm.Put(key, []byte("v2"))
+		}
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			value, ok := lsm.GetWithOptions(key, &ReadOptions{Snapshot: snapshot})
+			if !ok || string(value) != "v1" {
+				t.Errorf("%s: snapshot Get(%s) = %q, %v, expected v1", stage, key, value, ok)
+			}
+			value, ok = lsm.Get(key)
+			if i%2 == 0 && ok || i%2 == 1 && string(value) != "v2" {
+				t.Errorf("%s: Get(%s) = %q, %v", stage, key, value, ok)
+			}
+		}
+
+		it, err := lsm.NewIterator(&IterOptions{Snapshot: snapshot})
+		if err != nil {
+			t.Fatalf("Failed to create iterator: %v", err)
+		}
+		count := 0
+		for it.Last(); it.Valid(); it.Prev() {
+			if string(it.Value()) != "v1" {
+				t.Errorf("%s: snapshot iterator %s = %q", stage, it.Key(), it.Value())
+			}
+			count++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("Iterator error: %v", err)
+		}
+		if count != 10 {
+			t.Errorf("%s: snapshot iterator returned %d keys, expected 10", stage, count)
+		}
+	}
+	check("memtable")
+	flushForTest(t, lsm)
+	check("flushed")
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("compacted")
+
+	var entries int64
+	for _, f := range allTables(lsm) {
+		entries += f.meta.Entries
+	}
+	if entries != 20 {
+		t.Errorf("%d entries with a live snapshot, expected 20", entries)
+	}
+
+	// 释放快照后合并只保留最新版本，墓碑也被清理。写入覆盖整个键范围的新文件，
+	// 让下一次合并重写 L1 的全部文件
+	lsm.ReleaseSnapshot(snapshot)
+	for _, key := range []string{"a", "z"} {
+		if err := lsm.Put([]byte(key), []byte("v3")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	flushForTest(t, lsm)
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	entries = 0
+	for _, f := range allTables(lsm) {
+		entries += f.meta.Entries
+	}
+	if entries != 7 {
+		t.Errorf("%d entries after releasing snapshot, expected 7", entries)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	if err := lsm.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	// 事务内可以读到自己的写入，提交前对外不可见
+	txn := lsm.BeginTransaction()
+	if err := txn.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("Failed to put in transaction: %v", err)
+	}
+	if err := txn.Delete([]byte("a")); err != nil {
+		t.Fatalf("Failed to delete in transaction: %v", err)
+	}
+	if value, ok, _ := txn.Get([]byte("b")); !ok || string(value) != "2" {
+		t.Errorf("txn.Get(b) = %q, %v", value, ok)
+	}
+	if _, ok, _ := txn.Get([]byte("a")); ok {
+		t.Errorf("txn.Get(a) found a deleted key")
+	}
+	if _, ok := lsm.Get([]byte("b")); ok {
+		t.Errorf("Uncommitted write is visible")
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if _, ok := lsm.Get([]byte("a")); ok {
+		t.Errorf("Get(a) found a key deleted by a committed transaction")
+	}
+	if err := txn.Put([]byte("c"), nil); err == nil {
+		t.Errorf("Put after Commit succeeded")
+	}
+
+	// 读过的键在提交前被修改，提交失败且写入全部丢弃
+	txn = lsm.BeginTransaction()
+	if _, _, err := txn.Get([]byte("b")); err != nil {
+		t.Fatalf("Failed to get in transaction: %v", err)
+	}
+	txn.Put([]byte("c"), []byte("3"))
+	if err := lsm.Put([]byte("b"), []byte("changed")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if value, _, _ := txn.Get([]byte("b")); string(value) != "2" {
+		t.Errorf("txn.Get(b) = %q, expected the value at transaction start", value)
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Commit() = %v, expected ErrConflict", err)
+	}
+	if _, ok := lsm.Get([]byte("c")); ok {
+		t.Errorf("Write of a conflicting transaction is visible")
+	}
+
+	txn = lsm.BeginTransaction()
+	txn.Put([]byte("d"), []byte("4"))
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if _, ok := lsm.Get([]byte("d")); ok {
+		t.Errorf("Write of a rolled back transaction is visible")
+	}
+	if len(lsm.snapshots) != 0 {
+		t.Errorf("%d snapshots left after transactions finished", len(lsm.snapshots))
+	}
+}
+
+func TestTransactionCounter(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 20})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	// 并发的读-改-写：乐观事务在冲突时重试，悲观事务用 GetForUpdate 加锁，都不会丢失更新。
+	// 两种事务之间互不感知，各自使用一个计数器
+	const workers, increments = 4, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(pessimistic bool) {
+			defer wg.Done()
+			key := []byte(fmt.Sprintf("counter-%v", pessimistic))
+			for i := 0; i < increments; i++ {
+				for {
+					txn := lsm.BeginTransactionWithOptions(&TransactionOptions{Pessimistic: pessimistic, LockTimeout: 10 * time.Second})
+					value, _, err := txn.GetForUpdate(key)
+					if err != nil {
+						t.Errorf("Failed to get: %v", err)
+						return
+					}
+					n, _ := strconv.Atoi(string(value))
+					txn.Put(key, []byte(strconv.Itoa(n+1)))
+					err = txn.Commit()
+					if err == nil {
+						break
+					}
+					if pessimistic || !errors.Is(err, ErrConflict) {
+						t.Errorf("Failed to commit: %v", err)
+						return
+					}
+				}
+			}
+		}(w%2 == 1)
+	}
+	wg.Wait()
+	for _, key := range []string{"counter-false", "counter-true"} {
+		if value, _ := lsm.Get([]byte(key)); string(value) != strconv.Itoa(workers/2*increments) {
+			t.Errorf("%s = %q, expected %d", key, value, workers/2*increments)
+		}
+	}
+}
+
+func TestPessimisticTransaction(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	opts := &TransactionOptions{Pessimistic: true, LockTimeout: 50 * time.Millisecond}
+
+	// 共享锁之间互不阻塞，排他锁等待超时
+	txn1 := lsm.BeginTransactionWithOptions(opts)
+	txn2 := lsm.BeginTransactionWithOptions(opts)
+	if _, _, err := txn1.Get([]byte("a")); err != nil {
+		t.Fatalf("txn1.Get(a) failed: %v", err)
+	}
+	if _, _, err := txn2.Get([]byte("a")); err != nil {
+		t.Fatalf("txn2.Get(a) failed: %v", err)
+	}
+	if err := txn1.Put([]byte("a"), []byte("1")); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("txn1.Put(a) = %v, expected ErrLockTimeout", err)
+	}
+	txn2.Rollback()
+	if err := txn1.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("txn1.Put(a) after txn2 rolled back failed: %v", err)
+	}
+
+	// txn1 持有 a 等待 b，txn2 持有 b 再请求 a 形成死锁，txn2 被回滚
+	txn2 = lsm.BeginTransactionWithOptions(&TransactionOptions{Pessimistic: true, LockTimeout: 10 * time.Second})
+	if err := txn2.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatalf("txn2.Put(b) failed: %v", err)
+	}
+	txn1.lockTimeout = 10 * time.Second
+	done := make(chan error, 1)
+	go func() {
+		done <- txn1.Put([]byte("b"), []byte("1"))
+	}()
+	for {
+		lsm.locks.waitMutex.Lock()
+		_, waiting := lsm.locks.waitFor[txn1.id]
+		lsm.locks.waitMutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var deadlock *DeadlockError
+	if err := txn2.Put([]byte("a"), []byte("2")); !errors.As(err, &deadlock) {
+		t.Fatalf("txn2.Put(a) = %v, expected a deadlock", err)
+	}
+	if len(deadlock.Cycle) != 2 || deadlock.Cycle[0] != txn2.id || deadlock.Cycle[1] != txn1.id {
+		t.Errorf("Cycle = %v, expected [%d %d]", deadlock.Cycle, txn2.id, txn1.id)
+	}
+	if err := txn2.Commit(); err == nil {
+		t.Errorf("Commit of a deadlock victim succeeded")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("txn1.Put(b) failed: %v", err)
+	}
+	if err := txn1.Commit(); err != nil {
+		t.Fatalf("txn1.Commit failed: %v", err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "1"} {
+		if value, _ := lsm.Get([]byte(key)); string(value) != want {
+			t.Errorf("Get(%s) = %q, expected %q", key, value, want)
+		}
+	}
+}
+
+func TestTransactionSavepoint(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	for _, opts := range []*TransactionOptions{nil, {Pessimistic: true}} {
+		txn := lsm.BeginTransactionWithOptions(opts)
+		txn.Put([]byte("x"), []byte("1"))
+		txn.SetSavepoint()
+		txn.Put([]byte("y"), []byte("2"))
+		txn.Delete([]byte("x"))
+		txn.SetSavepoint()
+		txn.Put([]byte("z"), []byte("3"))
+		if err := txn.RollbackToSavepoint(); err != nil {
+			t.Fatalf("RollbackToSavepoint failed: %v", err)
+		}
+		if _, ok, _ := txn.Get([]byte("z")); ok {
+			t.Errorf("z is visible after rolling back to the second savepoint")
+		}
+		if err := txn.RollbackToSavepoint(); err != nil {
+			t.Fatalf("RollbackToSavepoint failed: %v", err)
+		}
+		if err := txn.RollbackToSavepoint(); err == nil {
+			t.Errorf("RollbackToSavepoint without a savepoint succeeded")
+		}
+		if value, ok, _ := txn.Get([]byte("x")); !ok || string(value) != "1" {
+			t.Errorf("txn.Get(x) = %q, %v, expected 1", value, ok)
+		}
+		if err := txn.Commit(); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+		if _, ok := lsm.Get([]byte("y")); ok {
+			t.Errorf("Write rolled back to a savepoint was committed")
+		}
+		if value, _ := lsm.Get([]byte("x")); string(value) != "1" {
+			t.Errorf("Get(x) = %q, expected 1", value)
+		}
+		lsm.Delete([]byte("x"))
+	}
+}
+
+func TestTableCache(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 10, L0CompactionTrigger: 100, MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	flushForTest(t, lsm)
+	if n := len(allTables(lsm)); n < 5 {
+		t.Fatalf("Only %d tables were written", n)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if value, ok := lsm.Get([]byte(key)); !ok || string(value) != fmt.Sprintf("value%d", i) {
+				t.Fatalf("Get(%s) = %q, %v", key, value, ok)
+			}
+		}
+		lsm.defaultFamily.tables.mutex.Lock()
+		defer lsm.defaultFamily.tables.mutex.Unlock()
+		if n := lsm.defaultFamily.tables.lru.Len(); n > 2 {
+			t.Errorf("%d tables are open, MaxOpenFiles is 2", n)
+		}
+	}
+	check()
+
+	// 合并删除的文件被移出表缓存
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	live := make(map[uint64]bool)
+	for _, f := range allTables(lsm) {
+		live[f.meta.Number] = true
+	}
+	lsm.defaultFamily.tables.mutex.Lock()
+	for number := range lsm.defaultFamily.tables.tables {
+		if !live[number] {
+			t.Errorf("Deleted table %d is still in the table cache", number)
+		}
+	}
+	lsm.defaultFamily.tables.mutex.Unlock()
+	check()
+}
+
+func TestCompressionPerLevel(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{
+		MemTableSize:        50,
+		L0CompactionTrigger: 100,
+		Compression:         []sstable.Compression{{}, {Codec: sstable.ZlibCompression, Level: flate.BestCompression}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	value := []byte(strings.Repeat(`{"status":"ok","count":1}`, 10))
+	for i := 0; i < 200; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	flushForTest(t, lsm)
+
+	compression := func(f *tableFile) string {
+		t.Helper()
+		table, err := lsm.defaultFamily.tables.get(f.meta.Number)
+		if err != nil {
+			t.Fatalf("Failed to open table %d: %v", f.meta.Number, err)
+		}
+		defer lsm.defaultFamily.tables.release(table)
+		return table.sst.Properties().Compression
+	}
+	for _, f := range lsm.defaultFamily.current.levels[0] {
+		if c := compression(f); c != "none" {
+			t.Errorf("L0 table %d uses %s", f.meta.Number, c)
+		}
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	// L1 及以下使用列表的最后一项
+	for _, f := range allTables(lsm) {
+		if c := compression(f); f.meta.Level > 0 && c != "zlib" {
+			t.Errorf("L%d table %d uses %s", f.meta.Level, f.meta.Number, c)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if got, ok := lsm.Get([]byte(fmt.Sprintf("key%03d", i))); !ok || !bytes.Equal(got, value) {
+			t.Fatalf("Get(key%03d) = %q, %v", i, got, ok)
+		}
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	for _, mode := range []wal.SyncMode{wal.SyncEveryWrite, wal.SyncInterval, wal.SyncBytes, wal.SyncNever} {
+		dir := t.TempDir()
+		lsm, err := NewLSMTree(dir, &Options{MemTableSize: 1 << 20, SyncMode: mode, SyncBytes: 4096})
+		if err != nil {
+			t.Fatalf("Failed to open LSM tree: %v", err)
+		}
+
+		const writers, perWriter = 16, 100
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < perWriter; j++ {
+					batch := NewWriteBatch()
+					batch.Put([]byte(fmt.Sprintf("w%02d-%03d", i, j)), []byte(strconv.Itoa(j)))
+					if err := lsm.WriteWithOptions(batch, &WriteOptions{Sync: j%10 == 0}); err != nil {
+						t.Errorf("Failed to write: %v", err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		lsm.mutex.Lock()
+		lastSequence := lsm.lastSequence
+		lsm.mutex.Unlock()
+		if lastSequence != writers*perWriter {
+			t.Errorf("mode %d: lastSequence = %d", mode, lastSequence)
+		}
+
+		// 不关闭直接复制目录，所有写入都已经追加到 WAL
+		crashed := t.TempDir()
+		copyDir(t, dir, crashed)
+		lsm.Close()
+		recovered, err := NewLSMTree(crashed, nil)
+		if err != nil {
+			t.Fatalf("Failed to open copied LSM tree: %v", err)
+		}
+		for i := 0; i < writers; i++ {
+			for j := 0; j < perWriter; j++ {
+				if value, ok := recovered.Get([]byte(fmt.Sprintf("w%02d-%03d", i, j))); !ok || string(value) != strconv.Itoa(j) {
+					t.Fatalf("mode %d: w%02d-%03d = %q, %v", mode, i, j, value, ok)
+				}
+			}
+		}
+		recovered.Close()
+	}
+}
+
+func TestDisableWAL(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+
+	logged := NewWriteBatch()
+	logged.Put([]byte("logged"), []byte("1"))
+	if err := lsm.Write(logged); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	unlogged := NewWriteBatch()
+	unlogged.Put([]byte("unlogged"), []byte("2"))
+	if err := lsm.WriteWithOptions(unlogged, &WriteOptions{DisableWAL: true}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if value, ok := lsm.Get([]byte("unlogged")); !ok || string(value) != "2" {
+		t.Errorf("Get(unlogged) = %q, %v", value, ok)
+	}
+
+	// 崩溃后只有写了 WAL 的数据能恢复
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	recovered, err := NewLSMTree(crashed, nil)
+	if err != nil {
+		t.Fatalf("Failed to open copied LSM tree: %v", err)
+	}
+	defer recovered.Close()
+	if _, ok := recovered.Get([]byte("logged")); !ok {
+		t.Error("Lost a logged write")
+	}
+	if _, ok := recovered.Get([]byte("unlogged")); ok {
+		t.Error("Recovered a write that skipped the WAL")
+	}
+
+	// 刷盘之后不写 WAL 的数据也持久化了
+	if err := lsm.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	flushed := t.TempDir()
+	copyDir(t, dir, flushed)
+	reopened, err := NewLSMTree(flushed, nil)
+	if err != nil {
+		t.Fatalf("Failed to open copied LSM tree: %v", err)
+	}
+	defer reopened.Close()
+	if _, ok := reopened.Get([]byte("unlogged")); !ok {
+		t.Error("Lost a flushed write")
+	}
+}
+
+// BenchmarkWrite 比较不同落盘策略下并发写入的吞吐
+func BenchmarkWrite(b *testing.B) {
+	cases := []struct {
+		name  string
+		opts  Options
+		write WriteOptions
+	}{
+		{"every-write", Options{SyncMode: wal.SyncEveryWrite}, WriteOptions{}},
+		{"interval-10ms", Options{SyncMode: wal.SyncInterval, SyncInterval: 10 * time.Millisecond}, WriteOptions{}},
+		{"bytes-1MB", Options{SyncMode: wal.SyncBytes, SyncBytes: 1 << 20}, WriteOptions{}},
+		{"never", Options{SyncMode: wal.SyncNever}, WriteOptions{}},
+		{"disable-wal", Options{}, WriteOptions{DisableWAL: true}},
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	for _, c := range cases {
+		for _, parallel := range []bool{false, true} {
+			name := c.name + "/serial"
+			if parallel {
+				name = c.name + "/parallel"
+			}
+			b.Run(name, func(b *testing.B) {
+				opts := c.opts
+				opts.MemTableSize = 100000
+				lsm, err := NewLSMTree(b.TempDir(), &opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer lsm.Close()
+				var counter atomic.Uint64
+				put := func() {
+					batch := NewWriteBatch()
+					batch.Put([]byte(fmt.Sprintf("key%012d", counter.Add(1))), value)
+					if err := lsm.WriteWithOptions(batch, &c.write); err != nil {
+						b.Error(err)
+					}
+				}
+				b.ResetTimer()
+				if !parallel {
+					for i := 0; i < b.N; i++ {
+						put()
+					}
+					return
+				}
+				b.SetParallelism(16)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						put()
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestWALArchive(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 1 << 20, MaxWALSegmentSize: 1024, WALSizeLimit: 1 << 30})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	liveSegments := func(dir string) int {
+		logs, err := liveLogs(dir, 0)
+		if err != nil {
+			t.Fatalf("Failed to list WAL segments: %v", err)
+		}
+		return len(logs)
+	}
+	// 段超过大小后轮转，同一个 MemTable 的记录分布在多个段中
+	if n := liveSegments(dir); n < 5 {
+		t.Fatalf("Expected the WAL to rotate by size, found %d segments", n)
+	}
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	recovered, err := NewLSMTree(crashed, nil)
+	if err != nil {
+		t.Fatalf("Failed to open copied LSM tree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := recovered.Get([]byte(fmt.Sprintf("key%03d", i))); !ok {
+			t.Fatalf("key%03d was not recovered from rotated segments", i)
+		}
+	}
+	recovered.Close()
+
+	// 刷盘后旧的段移到 archive 目录，其中的记录仍然完整
+	flushForTest(t, lsm)
+	if n := liveSegments(dir); n != 1 {
+		t.Errorf("Expected only the active segment after flush, found %d", n)
+	}
+	archived, err := lsm.ArchivedLogs()
+	if err != nil {
+		t.Fatalf("Failed to list archived logs: %v", err)
+	}
+	total := 0
+	for _, name := range archived {
+		entries, err := wal.RecoverWAL(name)
+		if err != nil {
+			t.Fatalf("Failed to read archived segment %s: %v", name, err)
+		}
+		total += len(entries)
+	}
+	if total != 100 {
+		t.Errorf("Archived segments hold %d entries, expected 100", total)
+	}
+
+	// 超出大小限制时删除最旧的段，超过 TTL 的段全部删除
+	lsm.opts.WALSizeLimit = 2048
+	if err := lsm.purgeArchivedLogs(); err != nil {
+		t.Fatalf("Failed to purge archive: %v", err)
+	}
+	logs, err := archivedLogs(dir)
+	if err != nil {
+		t.Fatalf("Failed to list archived logs: %v", err)
+	}
+	var size int64
+	for _, l := range logs {
+		size += l.size
+	}
+	if len(logs) == 0 || len(logs) >= len(archived) || size > 2048 || logs[len(logs)-1].path != archived[len(archived)-1] {
+		t.Errorf("Size-based purge kept %d of %d segments (%d bytes)", len(logs), len(archived), size)
+	}
+	lsm.opts.WALTTL = time.Nanosecond
+	if err := lsm.purgeArchivedLogs(); err != nil {
+		t.Fatalf("Failed to purge archive: %v", err)
+	}
+	if archived, _ := lsm.ArchivedLogs(); len(archived) != 0 {
+		t.Errorf("TTL purge kept %d segments", len(archived))
+	}
+}
+
+func TestPointInTimeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 30, WALSizeLimit: 1 << 30})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	put := func(from, to int, value string) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(value)); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+	put(0, 100, "v1")
+	backupDir := t.TempDir() + "/backup"
+	info, err := lsm.CreateBaseBackup(backupDir)
+	if err != nil {
+		t.Fatalf("Failed to create base backup: %v", err)
+	}
+	if info.Sequence != 100 || info.Files == 0 {
+		t.Fatalf("Unexpected backup info: %+v", info)
+	}
+
+	put(0, 50, "v2")
+	good := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	// 误操作：删除一批键并写入错误的数据
+	for i := 0; i < 10; i++ {
+		if err := lsm.Delete([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	}
+	put(50, 100, "bad")
+
+	logDirs := []string{filepath.Join(dir, "archive"), dir}
+	check := func(name string, opts *RestoreOptions, wantSeq uint64, want func(i int) (string, bool)) {
+		t.Helper()
+		dst := t.TempDir() + "/" + name
+		opts.BackupDir = backupDir
+		opts.LogDirs = logDirs
+		seq, err := RestoreToPointInTime(dst, opts)
+		if err != nil {
+			t.Fatalf("%s: restore failed: %v", name, err)
+		}
+		if seq != wantSeq {
+			t.Errorf("%s: restored to sequence %d, expected %d", name, seq, wantSeq)
+		}
+		restored, err := NewLSMTree(dst, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to open restored tree: %v", name, err)
+		}
+		defer restored.Close()
+		for i := 0; i < 100; i++ {
+			wantValue, wantOK := want(i)
+			if value, ok := restored.Get([]byte(fmt.Sprintf("key%03d", i))); ok != wantOK || string(value) != wantValue {
+				t.Fatalf("%s: key%03d = %q, %v, expected %q, %v", name, i, value, ok, wantValue, wantOK)
+			}
+		}
+	}
+	beforeMistake := func(i int) (string, bool) {
+		if i < 50 {
+			return "v2", true
+		}
+		return "v1", true
+	}
+	check("by-sequence", &RestoreOptions{TargetSequence: 150}, 150, beforeMistake)
+	check("by-time", &RestoreOptions{TargetTime: good}, 150, beforeMistake)
+	check("latest", &RestoreOptions{}, 210, func(i int) (string, bool) {
+		switch {
+		case i < 10:
+			return "", false
+		case i < 50:
+			return "v2", true
+		}
+		return "bad", true
+	})
+
+	// 没有归档目录时缺少备份之后的段
+	_, err = RestoreToPointInTime(t.TempDir()+"/gap", &RestoreOptions{BackupDir: backupDir, LogDirs: []string{dir}})
+	if !errors.Is(err, ErrWALGap) {
+		t.Errorf("Expected ErrWALGap, got %v", err)
+	}
+	if _, err := RestoreToPointInTime(t.TempDir(), &RestoreOptions{BackupDir: backupDir, TargetSequence: 50}); err == nil {
+		t.Error("Restoring to a sequence before the backup succeeded")
+	}
+
+	// 备份之后中间的一个段丢失
+	logs := t.TempDir()
+	copyDir(t, filepath.Join(dir, "archive"), logs)
+	copyDir(t, dir, logs)
+	segments, err := collectLogs([]string{logs})
+	if err != nil {
+		t.Fatalf("Failed to list WAL segments: %v", err)
+	}
+	var replayed []uint64
+	for _, number := range segments {
+		batches, err := wal.ReadBatches(logFileName(logs, number))
+		if err != nil {
+			t.Fatalf("Failed to read WAL segment %d: %v", number, err)
+		}
+		if len(batches) > 0 && batches[0].Seq > info.Sequence {
+			replayed = append(replayed, number)
+		}
+	}
+	if len(replayed) < 3 {
+		t.Fatalf("Expected at least 3 WAL segments after the backup, got %d", len(replayed))
+	}
+	if err := os.Remove(logFileName(logs, replayed[len(replayed)/2])); err != nil {
+		t.Fatalf("Failed to remove WAL segment: %v", err)
+	}
+	_, err = RestoreToPointInTime(t.TempDir()+"/hole", &RestoreOptions{BackupDir: backupDir, LogDirs: []string{logs}})
+	if !errors.Is(err, ErrWALGap) {
+		t.Errorf("Restoring over a missing WAL segment returned %v, expected ErrWALGap", err)
+	}
+
+	// 最后一个段丢失时不能恢复到它包含的序列号
+	truncated := t.TempDir()
+	copyDir(t, filepath.Join(dir, "archive"), truncated)
+	copyDir(t, dir, truncated)
+	if err := os.Remove(logFileName(truncated, replayed[len(replayed)-1])); err != nil {
+		t.Fatalf("Failed to remove WAL segment: %v", err)
+	}
+	_, err = RestoreToPointInTime(t.TempDir()+"/short", &RestoreOptions{BackupDir: backupDir, LogDirs: []string{truncated}, TargetSequence: 210})
+	if !errors.Is(err, ErrWALGap) {
+		t.Errorf("Restoring past the last WAL segment returned %v, expected ErrWALGap", err)
+	}
+	if seq, err := RestoreToPointInTime(t.TempDir()+"/before", &RestoreOptions{BackupDir: backupDir, LogDirs: []string{truncated}, TargetSequence: 150}); err != nil || seq != 150 {
+		t.Errorf("Restoring before the missing segment = %d, %v, expected 150", seq, err)
+	}
+
+	// 不写 WAL 的写入会在归档中留下序列号的空缺
+	unlogged := NewWriteBatch()
+	unlogged.Put([]byte("unlogged"), []byte("v"))
+	if err := lsm.WriteWithOptions(unlogged, &WriteOptions{DisableWAL: true}); !errors.Is(err, ErrDisableWALWithArchive) {
+		t.Errorf("DisableWAL with archiving returned %v, expected ErrDisableWALWithArchive", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 30, L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 200; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v1")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	// 检查点期间继续写入，它们可能包含也可能不包含在检查点中
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			lsm.Put([]byte(fmt.Sprintf("extra%05d", i)), []byte("x"))
+		}
+	}()
+	cpDir := filepath.Join(t.TempDir(), "checkpoint")
+	err = lsm.Checkpoint(cpDir)
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if err := lsm.Checkpoint(cpDir); err == nil {
+		t.Fatal("Expected checkpoint into a non-empty directory to fail")
+	}
+
+	// SSTable 通过硬链接共享，L0CompactionTrigger 足够大，检查之前原数据库不会删除文件
+	linked := 0
+	entries, _ := os.ReadDir(cpDir)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "sstable-") {
+			continue
+		}
+		src, err1 := os.Stat(filepath.Join(dir, entry.Name()))
+		dst, err2 := os.Stat(filepath.Join(cpDir, entry.Name()))
+		if err1 == nil && err2 == nil && os.SameFile(src, dst) {
+			linked++
+		}
+	}
+	if linked == 0 {
+		t.Error("Expected checkpoint tables to be hard links")
+	}
+
+	// 之后对原数据库的修改和合并不影响检查点
+	for i := 0; i < 200; i++ {
+		if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v2")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	cp, err := NewLSMTree(cpDir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	defer cp.Close()
+	for i := 0; i < 200; i++ {
+		if value, ok := cp.Get([]byte(fmt.Sprintf("key%03d", i))); !ok || string(value) != "v1" {
+			t.Fatalf("key%03d = %q, %v in checkpoint, expected v1", i, value, ok)
+		}
+	}
+	if err := cp.Put([]byte("key000"), []byte("cp")); err != nil {
+		t.Fatalf("Failed to write to checkpoint: %v", err)
+	}
+	if value, _ := lsm.Get([]byte("key000")); string(value) != "v2" {
+		t.Errorf("Write to checkpoint leaked into source: key000 = %q", value)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := NewLSMTree(dir, &Options{MemTableSize: 30, L0CompactionTrigger: 100})
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer lsm.Close()
+	put := func(from, to int, value string) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := lsm.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(value)); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+	root := filepath.Join(t.TempDir(), "backups")
+
+	put(0, 100, "v1")
+	first, err := lsm.CreateBackup(root)
+	if err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	if first.ID != 1 || first.Copied != first.Size || first.Size == 0 {
+		t.Fatalf("Unexpected first backup: id %d, copied %d of %d", first.ID, first.Copied, first.Size)
+	}
+	put(50, 100, "v2")
+	second, err := lsm.CreateBackup(root)
+	if err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	// 第一个备份的表都还在，只复制新刷盘的表
+	if second.ID != 2 || second.Copied == 0 || second.Copied >= second.Size || second.Size-second.Copied != first.Size {
+		t.Fatalf("Unexpected incremental backup: copied %d of %d, first was %d", second.Copied, second.Size, first.Size)
+	}
+
+	backups, err := ListBackups(root)
+	if err != nil || len(backups) != 2 || backups[0].ID != 1 || backups[1].ID != 2 {
+		t.Fatalf("ListBackups = %v, %v", backups, err)
+	}
+	for _, id := range []uint64{1, 2} {
+		if err := VerifyBackup(root, id); err != nil {
+			t.Fatalf("Backup %d failed verification: %v", id, err)
+		}
+	}
+
+	check := func(id uint64, want func(i int) string) {
+		t.Helper()
+		dst := filepath.Join(t.TempDir(), "restore")
+		if err := RestoreBackup(root, id, dst); err != nil {
+			t.Fatalf("Failed to restore backup %d: %v", id, err)
+		}
+		restored, err := NewLSMTree(dst, nil)
+		if err != nil {
+			t.Fatalf("Failed to open restored backup %d: %v", id, err)
+		}
+		defer restored.Close()
+		for i := 0; i < 100; i++ {
+			if value, ok := restored.Get([]byte(fmt.Sprintf("key%03d", i))); !ok || string(value) != want(i) {
+				t.Fatalf("Backup %d: key%03d = %q, %v, expected %q", id, i, value, ok, want(i))
+			}
+		}
+	}
+	check(1, func(int) string { return "v1" })
+	check(0, func(i int) string {
+		if i < 50 {
+			return "v1"
+		}
+		return "v2"
+	})
+
+	// 合并之后的备份引用新的表，只保留最新的一个时旧表被清理
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	third, err := lsm.CreateBackup(root)
+	if err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	purged, err := PurgeBackups(root, 1, 0)
+	if err != nil || len(purged) != 2 {
+		t.Fatalf("PurgeBackups = %v, %v, expected two backups purged", purged, err)
+	}
+	shared, _ := os.ReadDir(filepath.Join(root, backupSharedDir))
+	if len(shared) != len(third.Files) {
+		t.Errorf("%d shared files left, backup %d references %d", len(shared), third.ID, len(third.Files))
+	}
+	if err := VerifyBackup(root, third.ID); err != nil {
+		t.Fatalf("Backup %d failed verification after purge: %v", third.ID, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, backupMetaDir, "1")); !os.IsNotExist(err) {
+		t.Errorf("Purged backup 1 still exists")
+	}
+
+	// 损坏共享文件之后校验和恢复都会失败
+	name := filepath.Join(root, backupSharedDir, third.Files[0].Name)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read shared file: %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatalf("Failed to corrupt shared file: %v", err)
+	}
+	if err := VerifyBackup(root, 0); !errors.Is(err, ErrBackupCorrupted) {
+		t.Errorf("VerifyBackup on corrupted backup = %v, expected ErrBackupCorrupted", err)
+	}
+	if err := RestoreBackup(root, 0, filepath.Join(t.TempDir(), "corrupted")); !errors.Is(err, ErrBackupCorrupted) {
+		t.Errorf("RestoreBackup on corrupted backup = %v, expected ErrBackupCorrupted", err)
+	}
+
+	// 按时间清理
+	if purged, err := PurgeBackups(root, 0, time.Nanosecond); err != nil || len(purged) != 1 {
+		t.Errorf("PurgeBackups by age = %v, %v", purged, err)
+	}
+}
+
+// 恢复出来的数据库会产生与原数据库同名的表，备份时不能覆盖已经保存的同名文件
+func TestBackupNameCollision(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "backups")
+	open := func(dir string) *LSMTree {
+		t.Helper()
+		lsm, err := NewLSMTree(dir, &Options{MemTableSize: 1 << 20})
+		if err != nil {
+			t.Fatalf("Failed to open LSM tree: %v", err)
+		}
+		return lsm
+	}
+	put := func(lsm *LSMTree, value string) {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			if err := lsm.Put([]byte(fmt.Sprintf("key%d", i)), []byte(value)); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+		flushForTest(t, lsm)
+	}
+
+	original := open(t.TempDir())
+	defer original.Close()
+	put(original, "v1")
+	if _, err := original.CreateBackup(root); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	restoredDir := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreBackup(root, 1, restoredDir); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+	restored := open(restoredDir)
+	defer restored.Close()
+
+	// 让两个数据库从同一个文件号开始分配，写入不同的数据
+	original.mutex.Lock()
+	restored.mutex.Lock()
+	next := max(original.nextFileNumber, restored.nextFileNumber)
+	original.nextFileNumber, restored.nextFileNumber = next, next
+	restored.mutex.Unlock()
+	original.mutex.Unlock()
+	put(original, "original")
+	put(restored, "restored-value")
+	if _, err := original.CreateBackup(root); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	third, err := restored.CreateBackup(root)
+	if err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	renamed := 0
+	for _, f := range third.Files {
+		if f.Shared != "" {
+			renamed++
+		}
+	}
+	if renamed == 0 {
+		t.Fatalf("Expected a name collision in backup %d: %+v", third.ID, third.Files)
+	}
+
+	for id, want := range map[uint64]string{1: "v1", 2: "original", 3: "restored-value"} {
+		if err := VerifyBackup(root, id); err != nil {
+			t.Fatalf("Backup %d failed verification: %v", id, err)
+		}
+		dst := filepath.Join(t.TempDir(), "restore")
+		if err := RestoreBackup(root, id, dst); err != nil {
+			t.Fatalf("Failed to restore backup %d: %v", id, err)
+		}
+		lsm := open(dst)
+		if value, ok := lsm.Get([]byte("key5")); !ok || string(value) != want {
+			t.Errorf("Backup %d: key5 = %q, %v, expected %q", id, value, ok, want)
+		}
+		lsm.Close()
+	}
+
+	// 清理时按 shared 目录中的名字判断引用
+	if _, err := PurgeBackups(root, 1, 0); err != nil {
+		t.Fatalf("PurgeBackups failed: %v", err)
+	}
+	if err := VerifyBackup(root, third.ID); err != nil {
+		t.Fatalf("Backup %d failed verification after purge: %v", third.ID, err)
+	}
+}
+
+func TestBlobSeparation(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 30, L0CompactionTrigger: 100, BlobValueThreshold: 100}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	want := make(map[string]string)
+	put := func(i int, version string) {
+		t.Helper()
+		key := fmt.Sprintf("key%03d", i)
+		value := key + "/" + version
+		// 偶数键是大值，奇数键留在 SSTable 中
+		if i%2 == 0 {
+			value += strings.Repeat("x", 2000)
+		}
+		if err := lsm.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		want[key] = value
+	}
+	check := func(name string) {
+		t.Helper()
+		for key, value := range want {
+			if got, ok := lsm.Get([]byte(key)); !ok || string(got) != value {
+				t.Fatalf("%s: Get(%s) = %d bytes, %v, expected %d bytes", name, key, len(got), ok, len(value))
+			}
+		}
+		// 正向和反向遍历都能读出 blob 中的值
+		for _, reverse := range []bool{false, true} {
+			it, err := lsm.NewIterator(nil)
+			if err != nil {
+				t.Fatalf("Failed to create iterator: %v", err)
+			}
+			n := 0
+			if reverse {
+				it.Last()
+			} else {
+				it.First()
+			}
+			for ; it.Valid(); n++ {
+				if value := want[string(it.Key())]; string(it.Value()) != value {
+					t.Fatalf("%s: iterator value of %s has %d bytes, expected %d", name, it.Key(), len(it.Value()), len(value))
+				}
+				if reverse {
+					it.Prev()
+				} else {
+					it.Next()
+				}
+			}
+			if err := it.Close(); err != nil {
+				t.Fatalf("%s: iterator failed: %v", name, err)
+			}
+			if n != len(want) {
+				t.Fatalf("%s: iterated %d keys, expected %d", name, n, len(want))
+			}
+		}
+	}
+
+	for i := 0; i < 60; i++ {
+		put(i, "v1")
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	blobs := lsm.BlobFiles()
+	if len(blobs) == 0 {
+		t.Fatal("Expected large values to be written to blob files")
+	}
+	var blobCount int64
+	for _, b := range blobs {
+		blobCount += b.Count
+	}
+	if blobCount != 30 {
+		t.Fatalf("Blob files hold %d records, expected 30", blobCount)
+	}
+	check("after flush")
+
+	// 合并只搬动指针，SSTable 远小于值的总量
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	var tableSize int64
+	lsm.mutex.Lock()
+	for _, files := range lsm.defaultFamily.current.levels {
+		tableSize += totalSize(files)
+	}
+	lsm.mutex.Unlock()
+	if tableSize > 30*2000/4 {
+		t.Errorf("SSTables hold %d bytes, values were not separated", tableSize)
+	}
+	check("after compaction")
+
+	// 第一个 blob 文件保存 key000 到 key028 的大值，覆盖其中大部分之后有效比例低于 BlobGCRatio
+	for i := 0; i < 22; i += 2 {
+		put(i, "v2")
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	first := blobs[0].Number
+	var victim *BlobMeta
+	for _, b := range lsm.BlobFiles() {
+		if b.Number == first {
+			victim = &b
+		}
+	}
+	if victim == nil || victim.GarbageCount == 0 || victim.LiveRatio() >= 0.5 {
+		t.Fatalf("Expected blob %d to be mostly garbage, got %+v", first, victim)
+	}
+	check("after overwrite")
+
+	if err := lsm.GarbageCollectBlobs(); err != nil {
+		t.Fatalf("Blob GC failed: %v", err)
+	}
+	for _, b := range lsm.BlobFiles() {
+		if b.Number == first {
+			t.Fatalf("Blob %d still live after GC: %+v", first, b)
+		}
+		if b.LiveRatio() < 0.5 {
+			t.Errorf("Blob %d has live ratio %.2f after GC", b.Number, b.LiveRatio())
+		}
+	}
+	if _, err := os.Stat(blobFileName(dir, first)); !os.IsNotExist(err) {
+		t.Errorf("Blob file %d was not removed after GC: %v", first, err)
+	}
+	check("after gc")
+
+	// 检查点和备份带上 blob 文件
+	cpDir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := lsm.Checkpoint(cpDir); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	root := filepath.Join(t.TempDir(), "backups")
+	if _, err := lsm.CreateBackup(root); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	restoreDir := filepath.Join(t.TempDir(), "restore")
+	if err := RestoreBackup(root, 0, restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for _, copyDir := range []string{cpDir, restoreDir} {
+		copied, err := NewLSMTree(copyDir, opts)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", copyDir, err)
+		}
+		for key, value := range want {
+			if got, ok := copied.Get([]byte(key)); !ok || string(got) != value {
+				t.Fatalf("%s: Get(%s) = %d bytes, %v, expected %d bytes", copyDir, key, len(got), ok, len(value))
+			}
+		}
+		copied.Close()
+	}
+
+	// blob 文件和垃圾统计在重新打开后保留
+	before := lsm.BlobFiles()
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	lsm, err = NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	if after := lsm.BlobFiles(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Blob files after reopen = %+v, expected %+v", after, before)
+	}
+	check("after reopen")
+}
+
+func TestPutWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 30, L0CompactionTrigger: 100}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	// shadow 的旧版本已经刷盘，过期的新版本不能让它重新可见
+	if err := lsm.Put([]byte("shadow"), []byte("old")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	flushForTest(t, lsm)
+	if err := lsm.Put([]byte("permanent"), []byte("p")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	for key, ttl := range map[string]time.Duration{"short": 200 * time.Millisecond, "shadow": 200 * time.Millisecond, "long": time.Hour} {
+		if err := lsm.PutWithTTL([]byte(key), []byte(key+"-ttl"), ttl); err != nil {
+			t.Fatalf("Failed to put with TTL: %v", err)
+		}
+	}
+	check := func(name string, want map[string]string) {
+		t.Helper()
+		for _, key := range []string{"long", "permanent", "shadow", "short"} {
+			got, ok := lsm.Get([]byte(key))
+			if value, live := want[key]; ok != live || string(got) != value {
+				t.Errorf("%s: Get(%s) = %q, %v, expected %q, %v", name, key, got, ok, value, live)
+			}
+		}
+		for _, reverse := range []bool{false, true} {
+			it, err := lsm.NewIterator(nil)
+			if err != nil {
+				t.Fatalf("Failed to create iterator: %v", err)
+			}
+			got := make(map[string]string)
+			if reverse {
+				it.Last()
+			} else {
+				it.First()
+			}
+			for it.Valid() {
+				got[string(it.Key())] = string(it.Value())
+				if reverse {
+					it.Prev()
+				} else {
+					it.Next()
+				}
+			}
+			if err := it.Close(); err != nil {
+				t.Fatalf("%s: iterator failed: %v", name, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s: iterator (reverse=%v) returned %v, expected %v", name, reverse, got, want)
+			}
+		}
+	}
+	check("before expiry", map[string]string{"long": "long-ttl", "permanent": "p", "shadow": "shadow-ttl", "short": "short-ttl"})
+	// 过期时间随记录写入 SSTable
+	flushForTest(t, lsm)
+	check("after flush", map[string]string{"long": "long-ttl", "permanent": "p", "shadow": "shadow-ttl", "short": "short-ttl"})
+
+	time.Sleep(300 * time.Millisecond)
+	expected := map[string]string{"long": "long-ttl", "permanent": "p"}
+	check("after expiry", expected)
+
+	// 合并删除过期的写入以及被它遮蔽的旧版本
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check("after compaction", expected)
+	for _, f := range allTables(lsm) {
+		it, err := f.NewIterator()
+		if err != nil {
+			t.Fatalf("Failed to open table %d: %v", f.meta.Number, err)
+		}
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if key := string(extractUserKey(it.Key())); key == "short" || key == "shadow" {
+				t.Errorf("Table %d still contains %s after compaction", f.meta.Number, it.Key())
+			}
+		}
+		it.Close()
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	lsm, err = NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	check("after reopen", expected)
+}
+
+func TestMergeOperator(t *testing.T) {
+	// 内置的合并操作
+	for i, tc := range []struct {
+		op       MergeOperator
+		existing []byte
+		operands []string
+		want     string
+	}{
+		{NewStringAppendOperator(","), nil, []string{"a", "b", "c"}, "a,b,c"},
+		{NewStringAppendOperator(","), []byte("x"), []string{"a"}, "x,a"},
+		{MaxOperator, []byte("m"), []string{"a", "z", "c"}, "z"},
+		{MaxOperator, nil, []string{"b", "a"}, "b"},
+	} {
+		var operands [][]byte
+		for _, o := range tc.operands {
+			operands = append(operands, []byte(o))
+		}
+		if got, err := tc.op.FullMerge([]byte("k"), tc.existing, operands); err != nil || string(got) != tc.want {
+			t.Errorf("Case %d: %s FullMerge = %q, %v, expected %q", i, tc.op.Name(), got, err, tc.want)
+		}
+	}
+	if got, ok := NewStringAppendOperator(",").PartialMerge([]byte("k"), []byte("a"), []byte("b")); !ok || string(got) != "a,b" {
+		t.Errorf("StringAppend PartialMerge = %q, %v", got, ok)
+	}
+	if _, err := UInt64AddOperator.FullMerge([]byte("k"), []byte("bad"), nil); err == nil {
+		t.Error("UInt64Add accepted a malformed value")
+	}
+
+	// 没有 MergeOperator 时不能写入操作数
+	plain, err := NewLSMTree(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	if err := plain.Merge([]byte("k"), []byte("v")); !errors.Is(err, errNoMergeOperator) {
+		t.Errorf("Merge without operator returned %v", err)
+	}
+	plain.Close()
+
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 30, L0CompactionTrigger: 100, MergeOperator: UInt64AddOperator}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	u64 := func(n uint64) []byte { return binary.LittleEndian.AppendUint64(nil, n) }
+	put := func(key string, n uint64) {
+		t.Helper()
+		if err := lsm.Put([]byte(key), u64(n)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	merge := func(key string, n uint64) {
+		t.Helper()
+		if err := lsm.Merge([]byte(key), u64(n)); err != nil {
+			t.Fatalf("Failed to merge: %v", err)
+		}
+	}
+	check := func(name string, tree *LSMTree, snapshot *Snapshot, want map[string]uint64) {
+		t.Helper()
+		for _, key := range []string{"a", "counter", "fresh", "gone", "z"} {
+			got, ok := tree.GetWithOptions([]byte(key), &ReadOptions{Snapshot: snapshot})
+			if n, live := want[key]; ok != live || live && !bytes.Equal(got, u64(n)) {
+				t.Errorf("%s: Get(%s) = %v, %v, expected %d, %v", name, key, got, ok, n, live)
+			}
+		}
+		for _, reverse := range []bool{false, true} {
+			it, err := tree.NewIterator(&IterOptions{Snapshot: snapshot})
+			if err != nil {
+				t.Fatalf("Failed to create iterator: %v", err)
+			}
+			got := make(map[string]uint64)
+			if reverse {
+				it.Last()
+			} else {
+				it.First()
+			}
+			for it.Valid() {
+				got[string(it.Key())] = binary.LittleEndian.Uint64(it.Value())
+				if reverse {
+					it.Prev()
+				} else {
+					it.Next()
+				}
+			}
+			if err := it.Close(); err != nil {
+				t.Fatalf("%s: iterator failed: %v", name, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s: iterator (reverse=%v) returned %v, expected %v", name, reverse, got, want)
+			}
+		}
+	}
+
+	// 操作数分布在 MemTable 和多个 SSTable 中，下面可能是普通写入、墓碑或者什么都没有
+	put("a", 1)
+	put("z", 2)
+	put("counter", 10)
+	put("gone", 100)
+	flushForTest(t, lsm)
+	for i := 0; i < 3; i++ {
+		merge("counter", 1)
+	}
+	if err := lsm.Delete([]byte("gone")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	flushForTest(t, lsm)
+	merge("counter", 1)
+	merge("counter", 1)
+	merge("fresh", 7)
+	merge("gone", 3)
+	snapshot := lsm.GetSnapshot()
+	merge("counter", 5)
+	latest := map[string]uint64{"a": 1, "counter": 20, "fresh": 7, "gone": 3, "z": 2}
+	old := map[string]uint64{"a": 1, "counter": 15, "fresh": 7, "gone": 3, "z": 2}
+	check("memtable", lsm, nil, latest)
+	check("snapshot", lsm, snapshot, old)
+
+	// 在合并得到的键上改变遍历方向
+	it, err := lsm.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	var keys []string
+	for it.Seek([]byte("counter")); it.Valid() && len(keys) < 4; {
+		keys = append(keys, string(it.Key()))
+		switch len(keys) {
+		case 1, 3:
+			it.Prev()
+		default:
+			it.Next()
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	if fmt.Sprint(keys) != "[counter a counter a]" {
+		t.Errorf("Changing direction visited %v", keys)
+	}
+
+	// 操作数从 WAL 回放
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	recovered, err := NewLSMTree(crashed, opts)
+	if err != nil {
+		t.Fatalf("Failed to open crashed copy: %v", err)
+	}
+	check("recovered", recovered, nil, latest)
+	recovered.Close()
+
+	// 快照存在时合并不能把快照两侧的操作数合在一起
+	flushForTest(t, lsm)
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check("compacted", lsm, nil, latest)
+	check("compacted snapshot", lsm, snapshot, old)
+
+	// 释放快照后再合并一次，所有操作数都合并成普通写入
+	lsm.ReleaseSnapshot(snapshot)
+	merge("counter", 1)
+	latest["counter"]++
+	flushForTest(t, lsm)
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check("folded", lsm, nil, latest)
+	for _, f := range allTables(lsm) {
+		it, err := f.NewIterator()
+		if err != nil {
+			t.Fatalf("Failed to open table %d: %v", f.meta.Number, err)
+		}
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if _, _, kind := parseInternalKey(it.Key()); kind != kindPut {
+				t.Errorf("Table %d still contains %q with kind %d after compaction", f.meta.Number, it.Key(), kind)
+			}
+		}
+		it.Close()
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	lsm, err = NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	check("reopened", lsm, nil, latest)
+}
+
+func TestColumnFamilies(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{MemTableSize: 30, L0CompactionTrigger: 100}
+	usersOpts := &Options{Comparator: comparator.Reverse(comparator.Bytewise), MemTableSize: 30, L0CompactionTrigger: 100}
+	countersOpts := &Options{MemTableSize: 30, L0CompactionTrigger: 100, MergeOperator: UInt64AddOperator}
+	lsm, err := NewLSMTree(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open LSM tree: %v", err)
+	}
+	defer func() { lsm.Close() }()
+
+	users, err := lsm.CreateColumnFamily("users", usersOpts)
+	if err != nil {
+		t.Fatalf("Failed to create column family: %v", err)
+	}
+	counters, err := lsm.CreateColumnFamily("counters", countersOpts)
+	if err != nil {
+		t.Fatalf("Failed to create column family: %v", err)
+	}
+	if _, err := lsm.CreateColumnFamily("users", nil); !errors.Is(err, ErrColumnFamilyExists) {
+		t.Errorf("Creating a duplicate column family returned %v", err)
+	}
+	if names := lsm.ListColumnFamilies(); fmt.Sprint(names) != "[default users counters]" {
+		t.Errorf("ListColumnFamilies returned %v", names)
+	}
+
+	u64 := func(n uint64) []byte { return binary.LittleEndian.AppendUint64(nil, n) }
+	// 一个批次同时写入三个列族，同一个键在不同列族中互不影响
+	for i := 0; i < 100; i++ {
+		batch := NewWriteBatch()
+		key := []byte(fmt.Sprintf("key%03d", i))
+		batch.Put(key, []byte("default"))
+		batch.PutCF(users, key, []byte("user"))
+		batch.MergeCF(counters, []byte("total"), u64(1))
+		if err := lsm.Write(batch); err != nil {
+			t.Fatalf("Failed to write batch: %v", err)
+		}
+	}
+	// users 没有 MergeOperator，整个批次被拒绝
+	batch := NewWriteBatch()
+	batch.Put([]byte("rejected"), []byte("x"))
+	batch.MergeCF(users, []byte("key000"), []byte("x"))
+	if err := lsm.Write(batch); !errors.Is(err, errNoMergeOperator) {
+		t.Errorf("Merge into a column family without operator returned %v", err)
+	}
+	if err := users.Delete([]byte("key050")); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	check := func(name string, tree *LSMTree) {
+		t.Helper()
+		users, ok := tree.GetColumnFamily("users")
+		if !ok {
+			t.Fatalf("%s: users column family is missing", name)
+		}
+		counters, ok := tree.GetColumnFamily("counters")
+		if !ok {
+			t.Fatalf("%s: counters column family is missing", name)
+		}
+		if v, ok := tree.Get([]byte("key050")); !ok || string(v) != "default" {
+			t.Errorf("%s: default Get(key050) = %q, %v", name, v, ok)
+		}
+		if _, ok := users.Get([]byte("key050")); ok {
+			t.Errorf("%s: deleted key is visible in users", name)
+		}
+		if v, ok := users.Get([]byte("key051")); !ok || string(v) != "user" {
+			t.Errorf("%s: users Get(key051) = %q, %v", name, v, ok)
+		}
+		if _, ok := tree.Get([]byte("rejected")); ok {
+			t.Errorf("%s: rejected batch was applied", name)
+		}
+		if v, ok := counters.Get([]byte("total")); !ok || !bytes.Equal(v, u64(100)) {
+			t.Errorf("%s: counters Get(total) = %v, %v", name, v, ok)
+		}
+		// users 使用逆序比较器
+		it, err := users.NewIterator(nil)
+		if err != nil {
+			t.Fatalf("%s: failed to create iterator: %v", name, err)
+		}
+		var keys []string
+		for it.First(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		if err := it.Close(); err != nil {
+			t.Fatalf("%s: iterator failed: %v", name, err)
+		}
+		if len(keys) != 99 || keys[0] != "key099" || keys[98] != "key000" {
+			t.Errorf("%s: users iterator returned %d keys from %v", name, len(keys), keys[:min(len(keys), 3)])
+		}
+	}
+	check("memtable", lsm)
+
+	// MemTable 按条目数刷盘，各列族的数据写进各自的 SSTable
+	flushForTest(t, lsm)
+	for _, cf := range []*ColumnFamily{lsm.DefaultColumnFamily(), users, counters} {
+		if len(cf.current.levels[0]) == 0 {
+			t.Errorf("%s has no tables after flush", cf.Name())
+		}
+		for _, files := range cf.current.levels {
+			for _, f := range files {
+				if f.meta.Family != cf.id {
+					t.Errorf("Table %d in %s belongs to family %d", f.meta.Number, cf.Name(), f.meta.Family)
+				}
+			}
+		}
+	}
+	if err := users.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	// 加 5 再加 2^64-5，溢出回绕之后总数不变
+	for _, n := range []uint64{5, ^uint64(4)} {
+		if err := counters.Merge([]byte("total"), u64(n)); err != nil {
+			t.Fatalf("Failed to merge: %v", err)
+		}
+	}
+	check("flushed", lsm)
+
+	// 各列族的选项在重新打开时按名字指定，比较器不一致时拒绝打开
+	reopenOpts := &Options{MemTableSize: 30, L0CompactionTrigger: 100,
+		ColumnFamilyOptions: map[string]*Options{"users": usersOpts, "counters": countersOpts}}
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	if _, err := NewLSMTree(crashed, opts); err == nil || !strings.Contains(err.Error(), "comparator mismatch") {
+		t.Errorf("Opening with the wrong comparator for users returned %v", err)
+	}
+	recovered, err := NewLSMTree(crashed, reopenOpts)
+	if err != nil {
+		t.Fatalf("Failed to open crashed copy: %v", err)
+	}
+	check("recovered", recovered)
+	recovered.Close()
+
+	// 删除之后列族不可用，文件在没有引用之后被删除，重新打开后也不存在
+	if err := lsm.DropColumnFamily(DefaultColumnFamilyName); err == nil {
+		t.Errorf("Dropping the default column family succeeded")
+	}
+	files := users.current.levels
+	if err := lsm.DropColumnFamily("users"); err != nil {
+		t.Fatalf("Failed to drop column family: %v", err)
+	}
+	if err := lsm.DropColumnFamily("users"); !errors.Is(err, ErrColumnFamilyNotFound) {
+		t.Errorf("Dropping a missing column family returned %v", err)
+	}
+	if err := users.Put([]byte("key"), []byte("value")); !errors.Is(err, errColumnFamilyDropped) {
+		t.Errorf("Put into a dropped column family returned %v", err)
+	}
+	if _, ok := users.Get([]byte("key051")); ok {
+		t.Errorf("Get from a dropped column family succeeded")
+	}
+	if _, err := users.NewIterator(nil); !errors.Is(err, errColumnFamilyDropped) {
+		t.Errorf("NewIterator on a dropped column family returned %v", err)
+	}
+	for _, level := range files {
+		for _, f := range level {
+			if _, err := os.Stat(tableFileName(dir, f.meta.Number)); !os.IsNotExist(err) {
+				t.Errorf("Table %d of the dropped column family still exists: %v", f.meta.Number, err)
+			}
+		}
+	}
+	if names := lsm.ListColumnFamilies(); fmt.Sprint(names) != "[default counters]" {
+		t.Errorf("ListColumnFamilies after drop returned %v", names)
+	}
+
+	lsm.Close()
+	lsm, err = NewLSMTree(dir, reopenOpts)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	if names := lsm.ListColumnFamilies(); fmt.Sprint(names) != "[default counters]" {
+		t.Errorf("ListColumnFamilies after reopen returned %v", names)
+	}
+	counters, _ = lsm.GetColumnFamily("counters")
+	if v, ok := counters.Get([]byte("total")); !ok || !bytes.Equal(v, u64(100)) {
+		t.Errorf("counters Get(total) after reopen = %v, %v", v, ok)
+	}
+	// 同名的新列族是空的
+	users, err = lsm.CreateColumnFamily("users", usersOpts)
+	if err != nil {
+		t.Fatalf("Failed to recreate column family: %v", err)
+	}
+	if _, ok := users.Get([]byte("key051")); ok {
+		t.Errorf("Recreated column family contains data of the dropped one")
+	}
+
+	// 检查点包含所有列族
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err := users.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := lsm.Checkpoint(checkpoint); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	copied, err := NewLSMTree(checkpoint, reopenOpts)
+	if err != nil {
+		t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	defer copied.Close()
+	if names := copied.ListColumnFamilies(); fmt.Sprint(names) != "[default counters users]" {
+		t.Errorf("ListColumnFamilies in checkpoint returned %v", names)
+	}
+	if cf, ok := copied.GetColumnFamily("users"); !ok {
+		t.Errorf("Checkpoint is missing the users column family")
+	} else if v, ok := cf.Get([]byte("key")); !ok || string(v) != "value" {
+		t.Errorf("users Get(key) in checkpoint = %q, %v", v, ok)
+	}
+}
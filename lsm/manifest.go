@@ -0,0 +1,378 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"LSMTree/wal"
+)
+
+// FileMeta 描述 MANIFEST 中记录的一个 SSTable 文件，Smallest 和 Largest 是内部键，
+// 以 base64 编码保存
+type FileMeta struct {
+	Number   uint64 `json:"number"`
+	Level    int    `json:"level"`
+	Smallest []byte `json:"smallest"`
+	Largest  []byte `json:"largest"`
+	Size     int64  `json:"size"`
+	Entries  int64  `json:"entries"`
+	// Blobs 是文件中 kindBlob 记录引用的 blob 文件
+	Blobs []uint64 `json:"blobs,omitempty"`
+	// Family 是文件所属的列族，默认列族为 0
+	Family uint32 `json:"family,omitempty"`
+}
+
+// versionEdit 是 MANIFEST 中的一条记录，每次刷盘或合并追加一条。
+// AddFiles 按从旧到新的顺序追加到文件列表末尾，L0 的先后顺序由此保留。
+// 编号小于 LogNumber 的 WAL 段已经全部刷盘，不再需要回放。
+// Comparator 只出现在 MANIFEST 开头的快照中。
+// BlobGarbage 累加到对应的 blob 文件上，全部成为垃圾的 blob 文件从状态中移除。
+// CreateFamilies 和 DropFamilies 记录列族的创建和删除，删除列族时它的文件一并移除
+type versionEdit struct {
+	Comparator     string             `json:"comparator,omitempty"`
+	AddFiles       []FileMeta         `json:"add_files,omitempty"`
+	DeleteFiles    []uint64           `json:"delete_files,omitempty"`
+	AddBlobs       []BlobMeta         `json:"add_blobs,omitempty"`
+	BlobGarbage    []blobGarbage      `json:"blob_garbage,omitempty"`
+	NextFileNumber uint64             `json:"next_file_number,omitempty"`
+	LogNumber      uint64             `json:"log_number,omitempty"`
+	LastSequence   uint64             `json:"last_sequence,omitempty"`
+	CreateFamilies []ColumnFamilyMeta `json:"create_families,omitempty"`
+	DropFamilies   []uint32           `json:"drop_families,omitempty"`
+	NextFamilyID   uint32             `json:"next_family_id,omitempty"`
+}
+
+// versionState 是回放 MANIFEST 得到的文件集合，files 从旧到新排列。
+// comparator 是默认列族的比较器，families 不包括默认列族
+type versionState struct {
+	comparator     string
+	families       []ColumnFamilyMeta
+	nextFamilyID   uint32
+	files          []FileMeta
+	blobs          []BlobMeta
+	nextFileNumber uint64
+	logNumber      uint64
+	lastSequence   uint64
+}
+
+func (v *versionState) apply(edit *versionEdit) {
+	if edit.Comparator != "" {
+		v.comparator = edit.Comparator
+	}
+	for _, f := range edit.CreateFamilies {
+		v.families = append(v.families, f)
+		v.nextFamilyID = max(v.nextFamilyID, f.ID+1)
+	}
+	v.nextFamilyID = max(v.nextFamilyID, edit.NextFamilyID)
+	if len(edit.DropFamilies) > 0 {
+		dropped := make(map[uint32]bool, len(edit.DropFamilies))
+		for _, id := range edit.DropFamilies {
+			dropped[id] = true
+		}
+		families := v.families[:0]
+		for _, f := range v.families {
+			if !dropped[f.ID] {
+				families = append(families, f)
+			}
+		}
+		v.families = families
+		files := v.files[:0]
+		for _, f := range v.files {
+			if !dropped[f.Family] {
+				files = append(files, f)
+			}
+		}
+		v.files = files
+	}
+	if len(edit.DeleteFiles) > 0 {
+		deleted := make(map[uint64]bool, len(edit.DeleteFiles))
+		for _, number := range edit.DeleteFiles {
+			deleted[number] = true
+		}
+		kept := v.files[:0]
+		for _, f := range v.files {
+			if !deleted[f.Number] {
+				kept = append(kept, f)
+			}
+		}
+		v.files = kept
+	}
+	v.files = append(v.files, edit.AddFiles...)
+	v.blobs = append(v.blobs, edit.AddBlobs...)
+	if len(edit.BlobGarbage) > 0 {
+		garbage := make(map[uint64]blobGarbage, len(edit.BlobGarbage))
+		for _, g := range edit.BlobGarbage {
+			garbage[g.Number] = g
+		}
+		kept := v.blobs[:0]
+		for _, b := range v.blobs {
+			if g, ok := garbage[b.Number]; ok {
+				b.GarbageCount += g.Count
+				b.GarbageSize += g.Size
+			}
+			if !b.obsolete() {
+				kept = append(kept, b)
+			}
+		}
+		v.blobs = kept
+	}
+	if edit.NextFileNumber > v.nextFileNumber {
+		v.nextFileNumber = edit.NextFileNumber
+	}
+	if edit.LogNumber > v.logNumber {
+		v.logNumber = edit.LogNumber
+	}
+	if edit.LastSequence > v.lastSequence {
+		v.lastSequence = edit.LastSequence
+	}
+}
+
+type manifest struct {
+	dir    string
+	number uint64
+	file   *os.File
+}
+
+const currentFileName = "CURRENT"
+
+func manifestFileName(dir string, number uint64) string {
+	return fmt.Sprintf("%s/MANIFEST-%06d", dir, number)
+}
+
+func tableFileName(dir string, number uint64) string {
+	return fmt.Sprintf("%s/sstable-%d", dir, number)
+}
+
+// legacyLogName 是最早的版本使用的唯一一个 WAL 文件，每行一条 JSON 记录
+const legacyLogName = "wal.log"
+
+func logFileName(dir string, number uint64) string {
+	return fmt.Sprintf("%s/%06d.log", dir, number)
+}
+
+// loadManifest 回放 CURRENT 指向的 MANIFEST，返回状态和 MANIFEST 文件名，
+// CURRENT 不存在时返回空状态
+func loadManifest(dir string) (*versionState, string, error) {
+	state := &versionState{}
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, "", nil
+		}
+		return nil, "", err
+	}
+	name := strings.TrimSpace(string(current))
+	number, ok := parseManifestName(name)
+	if !ok {
+		return nil, "", fmt.Errorf("invalid CURRENT file: %q", name)
+	}
+
+	records, err := wal.ReadRecords(filepath.Join(dir, name))
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", name, err)
+	}
+	for _, record := range records {
+		var edit versionEdit
+		if err := json.Unmarshal(record, &edit); err != nil {
+			return nil, "", fmt.Errorf("decode %s: %w", name, err)
+		}
+		state.apply(&edit)
+	}
+	if number >= state.nextFileNumber {
+		state.nextFileNumber = number + 1
+	}
+	return state, name, nil
+}
+
+// createManifest 写入一个包含当前完整状态的新 MANIFEST，并原子地切换 CURRENT
+func createManifest(dir string, number uint64, state *versionState) (*manifest, error) {
+	filename := manifestFileName(dir, number)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{dir: dir, number: number, file: file}
+
+	snapshot := &versionEdit{
+		Comparator:     state.comparator,
+		CreateFamilies: state.families,
+		NextFamilyID:   state.nextFamilyID,
+		AddFiles:       state.files,
+		AddBlobs:       state.blobs,
+		NextFileNumber: state.nextFileNumber,
+		LogNumber:      state.logNumber,
+		LastSequence:   state.lastSequence,
+	}
+	if err := m.logEdit(snapshot); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := setCurrent(dir, filepath.Base(filename)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func setCurrent(dir, name string) error {
+	tmp := filepath.Join(dir, currentFileName+".tmp")
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentFileName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// logEdit 追加一条记录并落盘，返回后这次变更才算生效
+func (m *manifest) logEdit(edit *versionEdit) error {
+	data, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	if _, err := m.file.Write(wal.EncodeRecord(data)); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *manifest) Close() error {
+	return m.file.Close()
+}
+
+func parseManifestName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "MANIFEST-") {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, "MANIFEST-"), 10, 64)
+	return number, err == nil
+}
+
+func parseLogName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+	return number, err == nil
+}
+
+// liveLogs 返回编号不小于 logNumber 的 WAL 段，按编号从小到大排列。
+// 旧版本使用的 wal.log 排在最前面
+func liveLogs(dir string, logNumber uint64) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []uint64
+	var logs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if entry.Name() == legacyLogName {
+			logs = append(logs, filepath.Join(dir, entry.Name()))
+		} else if number, ok := parseLogName(entry.Name()); ok && number >= logNumber {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for _, number := range numbers {
+		logs = append(logs, logFileName(dir, number))
+	}
+	return logs, nil
+}
+
+// parseTableName 识别 SSTable 及其布隆过滤器文件，兼容旧版合并产生的 sstable_N.sst
+func parseTableName(name string) (uint64, bool) {
+	name = strings.TrimSuffix(name, ".bloom")
+	switch {
+	case strings.HasPrefix(name, "sstable-"):
+		name = strings.TrimPrefix(name, "sstable-")
+	case strings.HasPrefix(name, "sstable_") && strings.HasSuffix(name, ".sst"):
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "sstable_"), ".sst")
+	default:
+		return 0, false
+	}
+	number, err := strconv.ParseUint(name, 10, 64)
+	return number, err == nil
+}
+
+// moveAsideUnreferenced 把 MANIFEST 没有引用的 SSTable、blob 文件和旧 MANIFEST 移到 lost 目录，
+// 避免之后分配的文件号覆盖它们
+func moveAsideUnreferenced(dir string, state *versionState, currentManifest string) error {
+	live := make(map[uint64]bool, len(state.files))
+	for _, f := range state.files {
+		live[f.Number] = true
+	}
+	liveBlobs := make(map[uint64]bool, len(state.blobs))
+	for _, b := range state.blobs {
+		liveBlobs[b.Number] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	lostDir := filepath.Join(dir, "lost")
+	moved := false
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if number, ok := parseTableName(name); ok {
+			base := filepath.Base(tableFileName(dir, number))
+			if live[number] && (name == base || name == base+".bloom") {
+				continue
+			}
+		} else if number, ok := parseBlobName(name); ok {
+			if liveBlobs[number] {
+				continue
+			}
+		} else if _, ok := parseManifestName(name); ok {
+			if name == currentManifest {
+				continue
+			}
+		} else {
+			continue
+		}
+
+		if !moved {
+			if err := os.MkdirAll(lostDir, 0755); err != nil {
+				return err
+			}
+			moved = true
+		}
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(lostDir, name)); err != nil {
+			return err
+		}
+	}
+	if moved {
+		return syncDir(dir)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"LSMTree/skiplist"
+)
+
+// MergeOperator 定义 merge 操作数如何作用到旧值上。LSMTree.Merge 只写入操作数，
+// Get、迭代器和合并遇到操作数时才读出下面的版本并调用 FullMerge，读-改-写不需要先读
+type MergeOperator interface {
+	// FullMerge 把 operands（从旧到新）依次应用到 existing 上，existing 为 nil 表示键不存在或已被删除
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge 把两个相邻的操作数合并成一个，left 比 right 旧。不能合并时返回 false，
+	// 合并时两个操作数都原样保留
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+	// Name 出现在合并失败的错误信息中
+	Name() string
+}
+
+var errNoMergeOperator = errors.New("merge requires Options.MergeOperator")
+
+// Merge 向默认列族写入一个 merge 操作数，由 Options.MergeOperator 在读取和合并时与旧值合并
+func (lsm *LSMTree) Merge(key, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.Merge(key, operand)
+	return lsm.Write(batch)
+}
+
+// fullMerge 调用列族的 FullMerge，operands 从旧到新排列
+func (cf *ColumnFamily) fullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	op := cf.opts.MergeOperator
+	if op == nil {
+		return nil, errNoMergeOperator
+	}
+	value, err := op.FullMerge(key, existing, operands)
+	if err != nil {
+		return nil, fmt.Errorf("merge operator %s: merge %q: %w", op.Name(), key, err)
+	}
+	return value, nil
+}
+
+// mergeBase 返回操作数下面那个版本的值，作为 FullMerge 的 existing。墓碑和已经过期的写入返回 nil
+func (cf *ColumnFamily) mergeBase(userKey []byte, kind keyKind, value []byte, now int64) ([]byte, error) {
+	switch kind {
+	case kindPut:
+		return value, nil
+	case kindPutTTL:
+		expiresAt, value := parseTTLValue(value)
+		if expiresAt <= now {
+			return nil, nil
+		}
+		return value, nil
+	case kindBlob:
+		return cf.lsm.blobFiles.read(userKey, value)
+	}
+	return nil, nil
+}
+
+// mergeForward 从 iter 的当前位置（userKey 最新的可见版本，是一个操作数）开始向后收集操作数，
+// 直到遇到其他写入、墓碑或者下一个用户键，返回合并的结果。iter 停在第一个没有用到的记录上
+func (cf *ColumnFamily) mergeForward(iter *mergingIterator, userKey []byte, now int64) ([]byte, error) {
+	var operands [][]byte
+	var existing []byte
+	for ; iter.Valid(); iter.Next() {
+		key, _, kind := parseInternalKey(iter.Key())
+		if cf.opts.Comparator.Compare(key, userKey) != 0 {
+			break
+		}
+		if kind == kindMerge {
+			operands = append(operands, append([]byte(nil), iter.Value()...))
+			continue
+		}
+		var err error
+		if existing, err = cf.mergeBase(userKey, kind, iter.Value(), now); err != nil {
+			return nil, err
+		}
+		break
+	}
+	// 收集时从新到旧，FullMerge 需要从旧到新
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return cf.fullMerge(userKey, existing, operands)
+}
+
+// getMerged 在 lookup 找到的最新版本是操作数时，用归并迭代器按从新到旧的顺序读出 key 的各个版本并合并
+func (cf *ColumnFamily) getMerged(lists []*skiplist.SkipList, v *version, key []byte, seq uint64) ([]byte, error) {
+	iter, err := cf.newInternalIterator(lists, v)
+	if err != nil {
+		return nil, err
+	}
+	iter.Seek(makeInternalKey(nil, key, seq, kindSeek))
+	value, err := cf.mergeForward(iter, key, time.Now().UnixNano())
+	for _, child := range iter.children {
+		if closeErr := child.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return value, err
+}
+
+// mergeOperand 是合并时暂存的一个操作数，seq 是它（或者被它合并掉的操作数中最新的那个）的序列号
+type mergeOperand struct {
+	seq   uint64
+	value []byte
+}
+
+// partialMerge 从旧到新两两尝试 PartialMerge，返回从新到旧排列的操作数，
+// operands 从新到旧排列。没有 MergeOperator 时原样返回
+func (cf *ColumnFamily) partialMerge(key []byte, operands []mergeOperand) []mergeOperand {
+	op := cf.opts.MergeOperator
+	if op == nil || len(operands) < 2 {
+		return operands
+	}
+	result := []mergeOperand{operands[len(operands)-1]}
+	for i := len(operands) - 2; i >= 0; i-- {
+		last := &result[len(result)-1]
+		if value, ok := op.PartialMerge(key, last.value, operands[i].value); ok {
+			last.seq, last.value = operands[i].seq, value
+		} else {
+			result = append(result, operands[i])
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+type uint64AddOperator struct{}
+
+func (uint64AddOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum uint64
+	if existing != nil {
+		n, err := decodeUint64Operand(existing)
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := decodeUint64Operand(operand)
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return binary.LittleEndian.AppendUint64(nil, sum), nil
+}
+
+func (uint64AddOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	a, err := decodeUint64Operand(left)
+	if err != nil {
+		return nil, false
+	}
+	b, err := decodeUint64Operand(right)
+	if err != nil {
+		return nil, false
+	}
+	return binary.LittleEndian.AppendUint64(nil, a+b), true
+}
+
+func (uint64AddOperator) Name() string {
+	return "lsmtree.UInt64Add"
+}
+
+func decodeUint64Operand(value []byte) (uint64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("uint64 operand has %d bytes, expected 8", len(value))
+	}
+	return binary.LittleEndian.Uint64(value), nil
+}
+
+// UInt64AddOperator 把值看作 8 字节小端的 uint64，操作数累加到旧值上，溢出时回绕
+var UInt64AddOperator MergeOperator = uint64AddOperator{}
+
+type stringAppendOperator struct {
+	delimiter []byte
+}
+
+func (s stringAppendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var result []byte
+	if existing != nil {
+		result = append(result, existing...)
+	}
+	for i, operand := range operands {
+		if existing != nil || i > 0 {
+			result = append(result, s.delimiter...)
+		}
+		result = append(result, operand...)
+	}
+	return result, nil
+}
+
+func (s stringAppendOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	result := append(append(append([]byte(nil), left...), s.delimiter...), right...)
+	return result, true
+}
+
+func (s stringAppendOperator) Name() string {
+	return "lsmtree.StringAppend"
+}
+
+// NewStringAppendOperator 把操作数依次追加到旧值之后，相邻两段之间插入 delimiter
+func NewStringAppendOperator(delimiter string) MergeOperator {
+	return stringAppendOperator{delimiter: []byte(delimiter)}
+}
+
+type maxOperator struct{}
+
+func (maxOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	result := existing
+	for _, operand := range operands {
+		if result == nil || bytes.Compare(operand, result) > 0 {
+			result = operand
+		}
+	}
+	return append([]byte(nil), result...), nil
+}
+
+func (maxOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	if bytes.Compare(left, right) >= 0 {
+		return left, true
+	}
+	return right, true
+}
+
+func (maxOperator) Name() string {
+	return "lsmtree.Max"
+}
+
+// MaxOperator 保留旧值和所有操作数中按字节序最大的一个
+var MaxOperator MergeOperator = maxOperator{}
@@ -0,0 +1,156 @@
+package lsm
+
+import (
+	"time"
+
+	"LSMTree/cache"
+	"LSMTree/comparator"
+	"LSMTree/sstable"
+	"LSMTree/wal"
+)
+
+// Options 控制 MemTable 大小和分层合并的参数
+type Options struct {
+	// 键的排序规则，默认按字节序。已有数据的目录不能更换比较器
+	Comparator comparator.Comparator
+	// MergeOperator 把 LSMTree.Merge 写入的操作数合并到旧值上，为空时不能写入操作数
+	MergeOperator MergeOperator
+	// MemTable 中的条目数达到该值时触发刷盘
+	MemTableSize int
+	// 等待刷盘的冻结 MemTable 数达到该值时写入阻塞
+	MaxImmutableMemTables int
+	// 层数，包括 L0
+	NumLevels int
+	// L0 文件数达到该值时触发 L0 -> L1 合并
+	L0CompactionTrigger int
+	// L1 的目标大小（字节），之后每层乘以 LevelSizeMultiplier
+	BaseLevelSize       int64
+	LevelSizeMultiplier float64
+	// 合并输出文件的目标大小（字节）
+	TargetFileSize int64
+	// 所有 SSTable 共享的 block 缓存容量（字节）和淘汰策略
+	BlockCacheSize   int64
+	BlockCachePolicy cache.Policy
+	// 把 index 和 filter 固定在缓存中，不参与淘汰
+	PinIndexAndFilterBlocks bool
+	// 表缓存中最多同时打开的 SSTable 数
+	MaxOpenFiles int
+	// Compression 是各层 data block 的压缩方式，第 i 项用于 Li，层数超出列表长度时使用最后一项，
+	// 为空时不压缩。例如 L0 不压缩、最底层使用最高压缩级别：
+	//
+	//	[]sstable.Compression{{}, {Codec: sstable.FlateCompression, Level: flate.BestSpeed}, ...,
+	//		{Codec: sstable.ZlibCompression, Level: flate.BestCompression}}
+	Compression []sstable.Compression
+	// data block 中每隔多少条记录设置一个前缀压缩的重启点，默认 16
+	BlockRestartInterval int
+	// SyncMode 决定 WAL 何时落盘，默认每次写入都落盘。SyncInterval 和 SyncBytes
+	// 是对应模式的参数，默认 100ms 和 1MB。WriteOptions.Sync 可以要求单次写入落盘
+	SyncMode     wal.SyncMode
+	SyncInterval time.Duration
+	SyncBytes    int64
+	// 当前 WAL 段超过 MaxWALSegmentSize 字节时切换到新的段，默认 64MB
+	MaxWALSegmentSize int64
+	// WALTTL 或 WALSizeLimit 大于 0 时，不再需要的 WAL 段移到 archive 目录而不是删除，
+	// 超过 WALTTL（按最后修改时间）的段和超出 WALSizeLimit 的最旧的段会被清理；
+	// 只设置其中一个时另一个不限制
+	WALTTL       time.Duration
+	WALSizeLimit int64
+	// BlobValueThreshold 大于 0 时，刷盘和合并把不小于该长度的值写进单独的 blob 文件，
+	// SSTable 中只保存指向它的指针，合并时不再重写这些值。带过期时间的值不分离
+	BlobValueThreshold int
+	// 有效数据比例低于 BlobGCRatio 的 blob 文件在合并时把剩余的值搬到新文件，默认 0.5
+	BlobGCRatio float64
+	// ColumnFamilyOptions 是打开数据库时各列族按名字使用的选项，其中只有按列族生效的参数有意义，
+	// 见 LSMTree.CreateColumnFamily。没有列出的列族和默认列族使用这里的选项
+	ColumnFamilyOptions map[string]*Options
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Comparator:            comparator.Bytewise,
+		MemTableSize:          4096,
+		MaxImmutableMemTables: 2,
+		NumLevels:             7,
+		L0CompactionTrigger:   4,
+		BaseLevelSize:         10 << 20,
+		LevelSizeMultiplier:   10,
+		TargetFileSize:        2 << 20,
+		BlockCacheSize:        8 << 20,
+		BlockCachePolicy:      cache.LRU,
+		MaxOpenFiles:          500,
+		MaxWALSegmentSize:     64 << 20,
+		BlobGCRatio:           0.5,
+	}
+}
+
+func (o *Options) walOptions() *wal.Options {
+	return &wal.Options{SyncMode: o.SyncMode, SyncInterval: o.SyncInterval, SyncBytes: o.SyncBytes}
+}
+
+// compressionForLevel 返回写入 level 层文件时使用的压缩方式
+func (o *Options) compressionForLevel(level int) sstable.Compression {
+	if len(o.Compression) == 0 {
+		return sstable.Compression{}
+	}
+	return o.Compression[min(level, len(o.Compression)-1)]
+}
+
+// maxBytesForLevel 返回 L1 及以下各层的目标大小
+func (o *Options) maxBytesForLevel(level int) float64 {
+	size := float64(o.BaseLevelSize)
+	for l := 1; l < level; l++ {
+		size *= o.LevelSizeMultiplier
+	}
+	return size
+}
+
+// familyOptions 返回打开数据库时列族 name 使用的选项
+func (o *Options) familyOptions(name string) *Options {
+	if opts := o.ColumnFamilyOptions[name]; opts != nil && name != DefaultColumnFamilyName {
+		return opts.sanitize()
+	}
+	return o
+}
+
+// sanitize 用默认值补全未设置的字段
+func (o *Options) sanitize() *Options {
+	opts := *o
+	def := DefaultOptions()
+	if opts.Comparator == nil {
+		opts.Comparator = def.Comparator
+	}
+	if opts.MemTableSize <= 0 {
+		opts.MemTableSize = def.MemTableSize
+	}
+	if opts.MaxImmutableMemTables <= 0 {
+		opts.MaxImmutableMemTables = def.MaxImmutableMemTables
+	}
+	if opts.NumLevels < 2 {
+		opts.NumLevels = def.NumLevels
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = def.L0CompactionTrigger
+	}
+	if opts.BaseLevelSize <= 0 {
+		opts.BaseLevelSize = def.BaseLevelSize
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = def.LevelSizeMultiplier
+	}
+	if opts.TargetFileSize <= 0 {
+		opts.TargetFileSize = def.TargetFileSize
+	}
+	if opts.BlockCacheSize <= 0 {
+		opts.BlockCacheSize = def.BlockCacheSize
+	}
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = def.MaxOpenFiles
+	}
+	if opts.MaxWALSegmentSize <= 0 {
+		opts.MaxWALSegmentSize = def.MaxWALSegmentSize
+	}
+	if opts.BlobGCRatio <= 0 {
+		opts.BlobGCRatio = def.BlobGCRatio
+	}
+	return &opts
+}
@@ -0,0 +1,340 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"LSMTree/wal"
+)
+
+// backupInfoFileName 记录基础备份包含的最后一个序列号和备份时间
+const backupInfoFileName = "BACKUP"
+
+// BackupInfo 描述一个基础备份：序列号不超过 Sequence 的写入都已经包含在其中的 SSTable 里
+type BackupInfo struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Files    int       `json:"files"`
+}
+
+// ErrWALGap 表示提供的 WAL 段缺少基础备份之后紧接着的记录，无法恢复到目标位置
+var ErrWALGap = errors.New("archived WAL does not continue from the base backup")
+
+// ErrDisableWALWithArchive 表示开启了 WAL 归档时使用 WriteOptions.DisableWAL。
+// 不写 WAL 的写入同样消耗序列号，归档中留下的空缺会让按时间点恢复无法判断是否缺少了段
+var ErrDisableWALWithArchive = errors.New("DisableWAL cannot be used while WAL segments are archived")
+
+// CreateBaseBackup 把当前 MemTable 刷盘，然后把此刻的 SSTable 集合复制到 dir 中，
+// 并写入只描述这些文件的 MANIFEST。dir 必须不存在或为空。
+// 之后的写入需要从归档的 WAL 中回放，因此按时间点恢复要求开启 WALTTL 或 WALSizeLimit，
+// 此时不能使用 WriteOptions.DisableWAL
+func (lsm *LSMTree) CreateBaseBackup(dir string) (*BackupInfo, error) {
+	if err := ensureEmptyDir(dir); err != nil {
+		return nil, err
+	}
+	versions, state, err := lsm.flushAndRefVersions()
+	if err != nil {
+		return nil, err
+	}
+	defer lsm.unrefVersions(versions)
+	info := &BackupInfo{Sequence: state.lastSequence, Time: time.Now()}
+
+	for _, b := range state.blobs {
+		if err := copyFile(blobFileName(lsm.baseDir, b.Number), blobFileName(dir, b.Number)); err != nil {
+			return nil, err
+		}
+		state.nextFileNumber = max(state.nextFileNumber, b.Number+1)
+	}
+	for _, v := range versions {
+		for _, files := range v.levels {
+			for _, f := range files {
+				if err := copyTableFile(lsm.baseDir, dir, f.meta.Number); err != nil {
+					return nil, err
+				}
+				state.files = append(state.files, f.meta)
+				state.nextFileNumber = max(state.nextFileNumber, f.meta.Number+1)
+			}
+		}
+	}
+	if err := writeManifestSnapshot(dir, state); err != nil {
+		return nil, err
+	}
+	info.Files = len(state.files)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupInfoFileName), data, 0644); err != nil {
+		return nil, err
+	}
+	return info, syncDir(dir)
+}
+
+// flushAndRefVersions 排到写入队列队首，冻结 MemTable 并等待所有冻结的 MemTable 刷盘，
+// 返回此时各列族的版本引用，以及不包含 SSTable 的 MANIFEST 状态。
+// 返回的版本恰好包含序列号不超过 state.lastSequence 的全部写入
+func (lsm *LSMTree) flushAndRefVersions() ([]*version, *versionState, error) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+
+	w := &writer{cond: sync.NewCond(&lsm.mutex)}
+	lsm.waitForTurn(w)
+	err := lsm.freezeMemTable()
+	for err == nil && lsm.bgErr == nil && len(lsm.imm) > 0 {
+		lsm.flushCond.Wait()
+	}
+	if err == nil {
+		err = lsm.bgErr
+	}
+	var versions []*version
+	var state *versionState
+	if err == nil {
+		versions = lsm.refVersions()
+		state = lsm.snapshotState()
+	}
+	lsm.finishWriters([]*writer{w}, err)
+	return versions, state, err
+}
+
+// writeManifestSnapshot 在 dir 中写入只包含 state 的 MANIFEST 和 CURRENT
+func writeManifestSnapshot(dir string, state *versionState) error {
+	number := state.nextFileNumber
+	state.nextFileNumber++
+	m, err := createManifest(dir, number, state)
+	if err != nil {
+		return err
+	}
+	return m.Close()
+}
+
+// RestoreOptions 描述一次按时间点恢复。TargetSequence 和 TargetTime 都为零值时回放全部 WAL
+type RestoreOptions struct {
+	// BackupDir 是 CreateBaseBackup 写出的基础备份
+	BackupDir string
+	// LogDirs 是依次查找 WAL 段的目录，通常是原数据库的 archive 目录和数据库目录本身。
+	// 同一编号的段出现在多个目录中时使用先找到的
+	LogDirs []string
+	// TargetSequence 不为 0 时只回放最后一个序列号不超过它的批次
+	TargetSequence uint64
+	// TargetTime 不为零值时只回放写入时间不晚于它的批次
+	TargetTime time.Time
+	// Options 用于打开恢复出的数据库，比较器必须与原数据库相同
+	Options *Options
+}
+
+// RestoreToPointInTime 把基础备份复制到 dstDir，再按顺序回放备份之后的 WAL 批次，
+// 直到第一个超出目标的批次为止，批次要么整体回放要么整体跳过。
+// 回放的批次写成 dstDir 中的一个 WAL 段，由 NewLSMTree 打开时刷成 L0 文件，
+// 返回恢复出的数据库包含的最后一个序列号。dstDir 必须不存在或为空。
+// 序列号不连续，或者 WAL 在 TargetSequence 之前就已经用完时返回 ErrWALGap。
+// 基础备份之后创建的列族不在备份的 MANIFEST 中，它们的写入回放时被跳过
+func RestoreToPointInTime(dstDir string, opts *RestoreOptions) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(opts.BackupDir, backupInfoFileName))
+	if err != nil {
+		return 0, fmt.Errorf("read backup info: %w", err)
+	}
+	var info BackupInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return 0, fmt.Errorf("decode backup info: %w", err)
+	}
+	if opts.TargetSequence != 0 && opts.TargetSequence < info.Sequence {
+		return 0, fmt.Errorf("target sequence %d is older than the base backup (%d)", opts.TargetSequence, info.Sequence)
+	}
+	if !opts.TargetTime.IsZero() && opts.TargetTime.Before(info.Time) {
+		return 0, fmt.Errorf("target time %v is older than the base backup (%v)", opts.TargetTime, info.Time)
+	}
+
+	if err := ensureEmptyDir(dstDir); err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(opts.BackupDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == backupInfoFileName {
+			continue
+		}
+		if err := copyFile(filepath.Join(opts.BackupDir, entry.Name()), filepath.Join(dstDir, entry.Name())); err != nil {
+			return 0, err
+		}
+	}
+	state, _, err := loadManifest(dstDir)
+	if err != nil {
+		return 0, err
+	}
+
+	segments, err := collectLogs(opts.LogDirs)
+	if err != nil {
+		return 0, err
+	}
+	out, err := wal.NewWALWithOptions(logFileName(dstDir, state.nextFileNumber), &wal.Options{SyncMode: wal.SyncNever})
+	if err != nil {
+		return 0, err
+	}
+	last, err := replayLogs(out, segments, &info, opts)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// 打开一次，把回放的 WAL 刷成 L0 文件并写入新的 MANIFEST
+	restored, err := NewLSMTree(dstDir, opts.Options)
+	if err != nil {
+		return 0, err
+	}
+	return last, restored.Close()
+}
+
+// replayLogs 把基础备份之后、目标之前的批次写入 out，返回最后一个写入的序列号
+func replayLogs(out *wal.WAL, segments []uint64, info *BackupInfo, opts *RestoreOptions) (uint64, error) {
+	last := info.Sequence
+	for _, segment := range segments {
+		batches, err := readLogSegment(opts.LogDirs, segment)
+		if err != nil {
+			return 0, err
+		}
+		for _, batch := range batches {
+			// 没有序列号的旧记录早于任何基础备份
+			if batch.Seq == 0 {
+				continue
+			}
+			end := batch.Seq + uint64(len(batch.Entries)) - 1
+			if end <= last {
+				continue
+			}
+			// 每个序列号都写在 WAL 中，序列号不连续说明缺少了段，即使下一个批次已经超出目标，
+			// 缺少的写入也可能在目标之前
+			if batch.Seq != last+1 {
+				return 0, fmt.Errorf("%w: replayed up to %d, next record starts at %d", ErrWALGap, last, batch.Seq)
+			}
+			if opts.TargetSequence != 0 && end > opts.TargetSequence ||
+				!opts.TargetTime.IsZero() && batch.Time.After(opts.TargetTime) {
+				return last, nil
+			}
+			if err := out.AppendBatch(batch); err != nil {
+				return 0, err
+			}
+			last = end
+		}
+	}
+	// 段在目标之前就已经用完，恢复出的数据库会缺少目标之前的写入
+	if opts.TargetSequence != 0 && last < opts.TargetSequence {
+		return 0, fmt.Errorf("%w: replayed up to %d, target is %d", ErrWALGap, last, opts.TargetSequence)
+	}
+	return last, nil
+}
+
+// collectLogs 返回 dirs 中所有 WAL 段的编号，从小到大排列。
+// 原数据库仍在运行时段会从数据目录移到排在前面的 archive 目录，
+// 因此从后往前列举目录，保证列举过程中移动的段至少被看到一次
+func collectLogs(dirs []string) ([]uint64, error) {
+	found := make(map[uint64]bool)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if number, ok := parseLogName(entry.Name()); ok && !entry.IsDir() {
+				found[number] = true
+			}
+		}
+	}
+	numbers := make([]uint64, 0, len(found))
+	for number := range found {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// readLogSegment 按 dirs 的顺序查找并读取编号为 number 的段，同一编号出现在多个目录中时使用先找到的。
+// 读完之后段已经不在原处时说明它在读取期间被移走，重新查找一次
+func readLogSegment(dirs []string, number uint64) ([]wal.Batch, error) {
+	for {
+		moved := false
+		for _, dir := range dirs {
+			name := logFileName(dir, number)
+			if _, err := os.Stat(name); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			batches, err := wal.ReadBatches(name)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %w", name, err)
+			}
+			if _, err := os.Stat(name); err == nil {
+				return batches, nil
+			}
+			moved = true
+			break
+		}
+		// 段在列举之后被清理
+		if !moved {
+			return nil, nil
+		}
+	}
+}
+
+func ensureEmptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+	return nil
+}
+
+// copyTableFile 复制一个 SSTable，旧版本留下的 .bloom 文件一并复制
+func copyTableFile(srcDir, dstDir string, number uint64) error {
+	if err := copyFile(tableFileName(srcDir, number), tableFileName(dstDir, number)); err != nil {
+		return err
+	}
+	err := copyFile(tableFileName(srcDir, number)+".bloom", tableFileName(dstDir, number)+".bloom")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyFile 复制文件并落盘
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
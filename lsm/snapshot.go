@@ -0,0 +1,51 @@
+package lsm
+
+import "sort"
+
+// Snapshot 固定创建时刻的数据视图，通过 ReadOptions 或 IterOptions 使用。
+// 合并会保留快照可见的所有版本，用完后需要调用 ReleaseSnapshot
+type Snapshot struct {
+	seq uint64
+}
+
+// ReadOptions 控制 GetWithOptions 的行为，Snapshot 为 nil 时读取最新数据
+type ReadOptions struct {
+	Snapshot *Snapshot
+}
+
+func (lsm *LSMTree) GetSnapshot() *Snapshot {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	s := &Snapshot{seq: lsm.lastSequence}
+	// 序列号单调递增，追加后列表仍然有序
+	lsm.snapshots = append(lsm.snapshots, s)
+	return s
+}
+
+func (lsm *LSMTree) ReleaseSnapshot(s *Snapshot) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	for i, snapshot := range lsm.snapshots {
+		if snapshot == s {
+			lsm.snapshots = append(lsm.snapshots[:i], lsm.snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshotSequences 返回存活快照的序列号，从小到大排列，调用方需持有 mutex
+func (lsm *LSMTree) snapshotSequences() []uint64 {
+	seqs := make([]uint64, len(lsm.snapshots))
+	for i, s := range lsm.snapshots {
+		seqs[i] = s.seq
+	}
+	return seqs
+}
+
+// snapshotStripe 返回 seq 所在的快照区间：第一个序列号不小于 seq 的快照的下标，
+// 没有这样的快照时返回 len(snapshots)。同一区间内只有最新的版本对读者可见
+func snapshotStripe(snapshots []uint64, seq uint64) int {
+	return sort.Search(len(snapshots), func(i int) bool {
+		return snapshots[i] >= seq
+	})
+}
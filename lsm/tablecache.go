@@ -0,0 +1,144 @@
+package lsm
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"LSMTree/sstable"
+)
+
+// tableCache 缓存打开的 SSTable，也就是文件句柄加上解析好的 index 和 filter，
+// 最多保留 capacity 个，按 LRU 淘汰。被淘汰的表等所有读者释放之后才关闭
+type tableCache struct {
+	dir      string
+	opts     *sstable.Options
+	capacity int
+	mutex    sync.Mutex
+	tables   map[uint64]*list.Element
+	lru      *list.List
+}
+
+// cachedTable 的 refs 包括缓存自己持有的一个引用
+type cachedTable struct {
+	number uint64
+	sst    *sstable.SSTable
+	refs   int
+}
+
+func newTableCache(dir string, opts *sstable.Options, capacity int) *tableCache {
+	return &tableCache{
+		dir:      dir,
+		opts:     opts,
+		capacity: capacity,
+		tables:   make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get 返回编号为 number 的表并增加引用，用完后需要调用 release。
+// 打开文件时不持有锁，并发打开同一个文件时只保留先放进缓存的那个
+func (c *tableCache) get(number uint64) (*cachedTable, error) {
+	c.mutex.Lock()
+	if elem, ok := c.tables[number]; ok {
+		c.lru.MoveToFront(elem)
+		t := elem.Value.(*cachedTable)
+		t.refs++
+		c.mutex.Unlock()
+		return t, nil
+	}
+	c.mutex.Unlock()
+
+	// 以文件号作为 BlockCache 中的 ID，文件被淘汰后重新打开仍能命中之前缓存的 block
+	opts := *c.opts
+	opts.CacheID = number
+	sst, err := sstable.OpenSSTable(tableFileName(c.dir, number), &opts)
+	if err != nil {
+		return nil, fmt.Errorf("open table %d: %w", number, err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.tables[number]; ok {
+		sst.Close()
+		c.lru.MoveToFront(elem)
+		t := elem.Value.(*cachedTable)
+		t.refs++
+		return t, nil
+	}
+	t := c.insert(number, sst)
+	t.refs++
+	return t, nil
+}
+
+// add 把刚写完的表放进缓存，避免第一次读取时重新解析
+func (c *tableCache) add(number uint64, sst *sstable.SSTable) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.tables[number]; ok {
+		c.remove(elem)
+	}
+	c.insert(number, sst)
+}
+
+func (c *tableCache) insert(number uint64, sst *sstable.SSTable) *cachedTable {
+	t := &cachedTable{number: number, sst: sst, refs: 1}
+	c.tables[number] = c.lru.PushFront(t)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return t
+}
+
+func (c *tableCache) release(t *cachedTable) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unref(t)
+}
+
+// evict 在文件被合并删除后移出缓存
+func (c *tableCache) evict(number uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.tables[number]; ok {
+		c.remove(elem)
+	}
+}
+
+// close 移出所有表，调用方需保证没有正在进行的读取
+func (c *tableCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *tableCache) remove(elem *list.Element) {
+	t := c.lru.Remove(elem).(*cachedTable)
+	delete(c.tables, t.number)
+	c.unref(t)
+}
+
+func (c *tableCache) unref(t *cachedTable) {
+	t.refs--
+	if t.refs == 0 {
+		t.sst.Close()
+	}
+}
+
+// tableIterator 在迭代器关闭时释放表的引用
+type tableIterator struct {
+	*sstable.Iterator
+	cache *tableCache
+	table *cachedTable
+}
+
+func (it *tableIterator) Close() error {
+	err := it.Iterator.Close()
+	if it.table != nil {
+		it.cache.release(it.table)
+		it.table = nil
+	}
+	return err
+}
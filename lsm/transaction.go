@@ -0,0 +1,234 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConflict 表示事务读过或写过的键在事务开始之后被其他写入修改，提交失败，
+// 调用方可以重新开始一个事务再试
+var ErrConflict = errors.New("transaction conflict")
+
+var errTransactionDone = fmt.Errorf("transaction already committed or rolled back")
+
+var errNoSavepoint = fmt.Errorf("no savepoint to roll back to")
+
+// TransactionOptions 控制 BeginTransactionWithOptions 开启的事务，nil 表示乐观事务
+type TransactionOptions struct {
+	// Pessimistic 为真时读写前先给键加锁，提交时不再校验
+	Pessimistic bool
+	// LockTimeout 是悲观事务等待一个锁的最长时间，默认 1 秒
+	LockTimeout time.Duration
+}
+
+const defaultLockTimeout = time.Second
+
+// Transaction 缓存事务中的写入，提交时作为一个 WriteBatch 原子地写入。
+//
+// 乐观事务的读取看到事务开始时的快照和自己的写入，提交时在写锁内检查所有读过和写过的键
+// 是否在事务开始后被修改过，有冲突返回 ErrConflict。
+//
+// 悲观事务读取前加共享锁，GetForUpdate、Put、Delete 前加排他锁，锁一直持有到提交或回滚，
+// 读取看到最新提交的数据。加锁会形成死锁时事务被回滚并返回 *DeadlockError。
+//
+// Transaction 不能在多个 goroutine 中并发使用
+type Transaction struct {
+	lsm      *LSMTree
+	id       uint64
+	snapshot *Snapshot
+	batch    *WriteBatch
+	// writes 记录每个键在事务中最后一次写入，供事务内的读取使用
+	writes map[string]txnWrite
+	// tracked 是乐观事务提交时需要校验的键，悲观事务中是已经加锁的键
+	tracked     map[string]struct{}
+	pessimistic bool
+	lockTimeout time.Duration
+	// savepoints 记录每个保存点时批次中的记录数
+	savepoints []int
+	done       bool
+}
+
+type txnWrite struct {
+	value   []byte
+	deleted bool
+}
+
+var nextTransactionID atomic.Uint64
+
+func (lsm *LSMTree) BeginTransaction() *Transaction {
+	return lsm.BeginTransactionWithOptions(nil)
+}
+
+func (lsm *LSMTree) BeginTransactionWithOptions(opts *TransactionOptions) *Transaction {
+	txn := &Transaction{
+		lsm:     lsm,
+		id:      nextTransactionID.Add(1),
+		batch:   NewWriteBatch(),
+		writes:  make(map[string]txnWrite),
+		tracked: make(map[string]struct{}),
+	}
+	if opts != nil && opts.Pessimistic {
+		txn.pessimistic = true
+		txn.lockTimeout = opts.LockTimeout
+		if txn.lockTimeout <= 0 {
+			txn.lockTimeout = defaultLockTimeout
+		}
+	} else {
+		txn.snapshot = lsm.GetSnapshot()
+	}
+	return txn
+}
+
+// Get 优先返回事务自己的写入。乐观事务读取事务开始时的快照并把 key 加入校验集合，
+// 悲观事务先加共享锁再读取最新数据
+func (txn *Transaction) Get(key []byte) ([]byte, bool, error) {
+	return txn.get(key, lockShared)
+}
+
+// GetForUpdate 与 Get 相同，但悲观事务会加排他锁，避免读-改-写之间被其他事务修改
+func (txn *Transaction) GetForUpdate(key []byte) ([]byte, bool, error) {
+	return txn.get(key, lockExclusive)
+}
+
+func (txn *Transaction) get(key []byte, mode lockMode) ([]byte, bool, error) {
+	if txn.done {
+		return nil, false, errTransactionDone
+	}
+	if err := txn.track(key, mode); err != nil {
+		return nil, false, err
+	}
+	if w, ok := txn.writes[string(key)]; ok {
+		if w.deleted {
+			return nil, false, nil
+		}
+		return append([]byte(nil), w.value...), true, nil
+	}
+	var opts *ReadOptions
+	if txn.snapshot != nil {
+		opts = &ReadOptions{Snapshot: txn.snapshot}
+	}
+	value, ok := txn.lsm.GetWithOptions(key, opts)
+	return value, ok, nil
+}
+
+func (txn *Transaction) Put(key, value []byte) error {
+	if txn.done {
+		return errTransactionDone
+	}
+	if err := txn.track(key, lockExclusive); err != nil {
+		return err
+	}
+	txn.batch.Put(key, value)
+	txn.writes[string(key)] = txnWrite{value: append([]byte(nil), value...)}
+	return nil
+}
+
+func (txn *Transaction) Delete(key []byte) error {
+	if txn.done {
+		return errTransactionDone
+	}
+	if err := txn.track(key, lockExclusive); err != nil {
+		return err
+	}
+	txn.batch.Delete(key)
+	txn.writes[string(key)] = txnWrite{deleted: true}
+	return nil
+}
+
+// track 把 key 加入校验集合，悲观事务在这里加锁。发生死锁时回滚整个事务
+func (txn *Transaction) track(key []byte, mode lockMode) error {
+	if txn.pessimistic {
+		err := txn.lsm.locks.lock(txn.id, string(key), mode, txn.lockTimeout)
+		var deadlock *DeadlockError
+		if errors.As(err, &deadlock) {
+			txn.Rollback()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	txn.tracked[string(key)] = struct{}{}
+	return nil
+}
+
+// SetSavepoint 记录当前的写入位置，之后可以用 RollbackToSavepoint 撤销这之后的写入
+func (txn *Transaction) SetSavepoint() error {
+	if txn.done {
+		return errTransactionDone
+	}
+	txn.savepoints = append(txn.savepoints, txn.batch.Count())
+	return nil
+}
+
+// RollbackToSavepoint 撤销最近一个保存点之后的写入并弹出该保存点。
+// 已经获取的锁和校验集合保持不变
+func (txn *Transaction) RollbackToSavepoint() error {
+	if txn.done {
+		return errTransactionDone
+	}
+	if len(txn.savepoints) == 0 {
+		return errNoSavepoint
+	}
+	n := txn.savepoints[len(txn.savepoints)-1]
+	txn.savepoints = txn.savepoints[:len(txn.savepoints)-1]
+	txn.batch.entries = txn.batch.entries[:n]
+	txn.writes = make(map[string]txnWrite, n)
+	for _, e := range txn.batch.entries {
+		txn.writes[string(e.Key)] = txnWrite{value: e.Value, deleted: e.Deleted}
+	}
+	return nil
+}
+
+// Commit 提交事务。乐观事务发生冲突时返回 ErrConflict，事务中的写入全部丢弃。
+// 无论成功与否，事务之后都不能再使用
+func (txn *Transaction) Commit() error {
+	if txn.done {
+		return errTransactionDone
+	}
+	defer txn.finish()
+	if txn.pessimistic {
+		return txn.lsm.Write(txn.batch)
+	}
+	return txn.lsm.write(txn.batch, nil, txn.validate)
+}
+
+// Rollback 丢弃事务中的写入
+func (txn *Transaction) Rollback() error {
+	if txn.done {
+		return errTransactionDone
+	}
+	txn.finish()
+	return nil
+}
+
+// finish 释放事务持有的快照或锁
+func (txn *Transaction) finish() {
+	txn.done = true
+	if txn.snapshot != nil {
+		txn.lsm.ReleaseSnapshot(txn.snapshot)
+	}
+	if txn.pessimistic {
+		txn.lsm.locks.unlockAll(txn.id, txn.tracked)
+	}
+}
+
+// validate 检查校验集合中每个键的最新版本，序列号大于快照说明事务开始后有其他写入。
+// 调用方持有 mutex，事务持有的快照保证合并不会丢弃这些更新的版本。事务只读写默认列族
+func (txn *Transaction) validate() error {
+	cf := txn.lsm.defaultFamily
+	for key := range txn.tracked {
+		ikey, _, ok, err := cf.lookup(cf.memTables(), cf.current, []byte(key), maxSequence)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, seq, _ := parseInternalKey(ikey); seq > txn.snapshot.seq {
+			return fmt.Errorf("%w: key %q was modified", ErrConflict, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package lsm
+
+import (
+	"log"
+	"os"
+)
+
+// version 是某一时刻各层文件的不可变快照。读操作持有引用期间，
+// 其中的文件即使已被合并掉也不会从磁盘删除
+type version struct {
+	levels [][]*tableFile
+	refs   int
+}
+
+func newVersion(numLevels int) *version {
+	return &version{levels: make([][]*tableFile, numLevels)}
+}
+
+// clone 复制外层切片，修改某一层时需要为该层分配新切片
+func (v *version) clone() *version {
+	levels := make([][]*tableFile, len(v.levels))
+	copy(levels, v.levels)
+	return &version{levels: levels}
+}
+
+// installVersion 替换列族的当前版本，调用方需持有 mutex
+func (lsm *LSMTree) installVersion(cf *ColumnFamily, v *version) {
+	old := cf.current
+	v.refs++
+	lsm.liveVersions[v] = struct{}{}
+	cf.current = v
+	if old != nil {
+		lsm.unrefVersionLocked(old)
+	}
+}
+
+// refVersion 获取当前版本的引用，调用方需持有 mutex
+func (cf *ColumnFamily) refVersion() *version {
+	cf.current.refs++
+	return cf.current
+}
+
+// refVersions 获取所有列族当前版本的引用，按列族编号排列，调用方需持有 mutex
+func (lsm *LSMTree) refVersions() []*version {
+	families := lsm.sortedFamilies()
+	versions := make([]*version, len(families))
+	for i, cf := range families {
+		versions[i] = cf.refVersion()
+	}
+	return versions
+}
+
+func (lsm *LSMTree) unrefVersion(v *version) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	lsm.unrefVersionLocked(v)
+}
+
+func (lsm *LSMTree) unrefVersions(versions []*version) {
+	lsm.mutex.Lock()
+	defer lsm.mutex.Unlock()
+	for _, v := range versions {
+		lsm.unrefVersionLocked(v)
+	}
+}
+
+func (lsm *LSMTree) unrefVersionLocked(v *version) {
+	v.refs--
+	if v.refs > 0 {
+		return
+	}
+	delete(lsm.liveVersions, v)
+	lsm.deleteObsoleteFiles()
+}
+
+// deleteObsoleteFiles 删除不再被任何存活版本引用的文件，调用方需持有 mutex
+func (lsm *LSMTree) deleteObsoleteFiles() {
+	if len(lsm.obsoleteFiles) == 0 && len(lsm.obsoleteBlobs) == 0 {
+		return
+	}
+	live := make(map[uint64]bool)
+	liveBlobs := make(map[uint64]bool)
+	for v := range lsm.liveVersions {
+		for _, files := range v.levels {
+			for _, f := range files {
+				live[f.meta.Number] = true
+				for _, number := range f.meta.Blobs {
+					liveBlobs[number] = true
+				}
+			}
+		}
+	}
+	for number, f := range lsm.obsoleteFiles {
+		if live[number] {
+			continue
+		}
+		// 先从表缓存中移出，关闭文件句柄后再删除文件
+		f.tables.evict(number)
+		path := tableFileName(lsm.baseDir, number)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", path, err)
+		}
+		delete(lsm.obsoleteFiles, number)
+	}
+	for number := range lsm.obsoleteBlobs {
+		if liveBlobs[number] {
+			continue
+		}
+		lsm.blobFiles.evict(number)
+		path := blobFileName(lsm.baseDir, number)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", path, err)
+		}
+		delete(lsm.obsoleteBlobs, number)
+	}
+}
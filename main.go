@@ -1,36 +1,42 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"LSMTree/lsm"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-// 定义API请求和响应结构体
-type PutRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
-type GetResponse struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-	Found bool   `json:"found"`
-}
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestore(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	filepath := "./data"
 	if _, err := os.Stat(filepath); os.IsNotExist(err) {
 		if err := os.MkdirAll(filepath, 0777); err != nil {
 			panic(err)
 		}
 	}
-	lsmTree, err := lsm.NewLSMTree("./data", 11)
+	opts := lsm.DefaultOptions()
+	opts.MemTableSize = 11
+	// 保留一周的 WAL 归档，配合基础备份按时间点恢复
+	opts.WALTTL = 7 * 24 * time.Hour
+	lsmTree, err := lsm.NewLSMTree("./data", opts)
 	if err != nil {
 		panic(err)
 	}
@@ -46,34 +52,398 @@ func main() {
 	// 中间件
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(middleware.CORS()) // 允许跨域请求
+	// 允许跨域请求，管理接口除外
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		Skipper: func(c echo.Context) bool {
+			return strings.HasPrefix(c.Request().URL.Path, "/admin/")
+		},
+	}))
 
 	// 静态文件服务 (用于前端HTML/CSS/JS)
 	e.Static("/", "public") // 假设前端文件在 `public` 目录下
 
-	// API 路由
-	e.POST("/put", func(c echo.Context) error {
-		req := new(PutRequest)
+	// 列族管理：GET /cf 列出所有列族，POST /cf 创建（{"name":...}），DELETE /cf/:cf 删除
+	e.GET("/cf", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string][]string{"column_families": lsmTree.ListColumnFamilies()})
+	})
+	e.POST("/cf", func(c echo.Context) error {
+		req := new(ColumnFamilyRequest)
+		if err := c.Bind(req); err != nil || req.Name == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+		}
+		if _, err := lsmTree.CreateColumnFamily(req.Name, nil); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, lsm.ErrColumnFamilyExists) {
+				status = http.StatusConflict
+			}
+			return c.JSON(status, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+	})
+	e.DELETE("/cf/:cf", func(c echo.Context) error {
+		name := c.Param("cf")
+		if name == lsm.DefaultColumnFamilyName {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "cannot drop the default column family"})
+		}
+		if err := lsmTree.DropColumnFamily(name); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, lsm.ErrColumnFamilyNotFound) {
+				status = http.StatusNotFound
+			}
+			return c.JSON(status, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+	})
+
+	// API 路由，同时注册在根路径和 /cf/:cf 下，前者作用于默认列族
+	for _, g := range []*echo.Group{e.Group(""), e.Group("/cf/:cf")} {
+		g.POST("/put", func(c echo.Context) error {
+			cf, ok := columnFamily(lsmTree, c)
+			if !ok {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "column family not found"})
+			}
+			req := new(PutRequest)
+			if err := c.Bind(req); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			}
+			if req.TTLSeconds < 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "ttl_seconds must not be negative"})
+			}
+			var err error
+			if req.TTLSeconds > 0 {
+				err = cf.PutWithTTL([]byte(req.Key), []byte(req.Value), time.Duration(req.TTLSeconds)*time.Second)
+			} else {
+				err = cf.Put([]byte(req.Key), []byte(req.Value))
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			}
+			return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+		})
+
+		g.GET("/get/:key", func(c echo.Context) error {
+			cf, ok := columnFamily(lsmTree, c)
+			if !ok {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "column family not found"})
+			}
+			key := c.Param("key")
+			value, ok := cf.Get([]byte(key))
+			return c.JSON(http.StatusOK, GetResponse{Key: key, Value: string(value), Found: ok})
+		})
+
+		// 以 NDJSON 流式返回 [start, end) 内的键值对
+		g.GET("/scan", func(c echo.Context) error {
+			cf, ok := columnFamily(lsmTree, c)
+			if !ok {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "column family not found"})
+			}
+			limit := 100
+			if l := c.QueryParam("limit"); l != "" {
+				n, err := strconv.Atoi(l)
+				if err != nil || n <= 0 {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+				}
+				limit = n
+			}
+			opts := &lsm.IterOptions{}
+			if start := c.QueryParam("start"); start != "" {
+				opts.LowerBound = []byte(start)
+			}
+			if end := c.QueryParam("end"); end != "" {
+				opts.UpperBound = []byte(end)
+			}
+			iter, err := cf.NewIterator(opts)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			}
+			defer iter.Close()
+
+			c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+			c.Response().WriteHeader(http.StatusOK)
+			encoder := json.NewEncoder(c.Response())
+			count := 0
+			for iter.First(); iter.Valid(); iter.Next() {
+				if count == limit {
+					return encoder.Encode(ScanCursor{Next: string(iter.Key())})
+				}
+				if err := encoder.Encode(ScanEntry{Key: string(iter.Key()), Value: string(iter.Value())}); err != nil {
+					return err
+				}
+				count++
+				if count%16 == 0 {
+					c.Response().Flush()
+				}
+			}
+			return nil
+		})
+
+		g.DELETE("/key/:key", func(c echo.Context) error {
+			cf, ok := columnFamily(lsmTree, c)
+			if !ok {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "column family not found"})
+			}
+			key := c.Param("key")
+			if err := cf.Delete([]byte(key)); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			}
+			return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+		})
+
+		g.POST("/compact", func(c echo.Context) error {
+			cf, ok := columnFamily(lsmTree, c)
+			if !ok {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "column family not found"})
+			}
+			if err := cf.Compact(); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			}
+			return c.JSON(http.StatusOK, map[string]string{"message": "compaction started"})
+		})
+	}
+
+	// 一组 put/delete 原子地生效，每个操作可以用 cf 指定列族，不同列族的写入也一起生效
+	e.POST("/batch", func(c echo.Context) error {
+		req := new(BatchRequest)
 		if err := c.Bind(req); err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 		}
-		if err := lsmTree.Put(req.Key, req.Value); err != nil {
+		batch := lsm.NewWriteBatch()
+		for i, op := range req.Ops {
+			cf := lsmTree.DefaultColumnFamily()
+			if op.CF != "" {
+				var ok bool
+				if cf, ok = lsmTree.GetColumnFamily(op.CF); !ok {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("op %d: column family %q not found", i, op.CF)})
+				}
+			}
+			switch op.Op {
+			case "put":
+				batch.PutCF(cf, []byte(op.Key), []byte(op.Value))
+			case "delete":
+				batch.DeleteCF(cf, []byte(op.Key))
+			default:
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("op %d: unknown op %q", i, op.Op)})
+			}
+		}
+		if err := lsmTree.Write(batch); err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
 		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
 	})
 
-	e.GET("/get/:key", func(c echo.Context) error {
+	// 事务：POST /txn 开始事务（body 可选，{"pessimistic":true} 开启悲观事务），
+	// 之后的读写都带上返回的 id。冲突、锁超时和死锁返回 409，客户端可以重新开始事务
+	txns := newTxnRegistry(lsmTree)
+	e.POST("/txn", func(c echo.Context) error {
+		req := new(TxnRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		opts := &lsm.TransactionOptions{
+			Pessimistic: req.Pessimistic,
+			LockTimeout: time.Duration(req.LockTimeoutMs) * time.Millisecond,
+		}
+		return c.JSON(http.StatusOK, TxnResponse{ID: txns.begin(opts)})
+	})
+
+	e.GET("/txn/:id/get/:key", func(c echo.Context) error {
+		t, ok := txns.get(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "transaction not found"})
+		}
+		t.Lock()
+		defer t.Unlock()
 		key := c.Param("key")
-		value, ok := lsmTree.Get(key)
-		return c.JSON(http.StatusOK, GetResponse{Key: key, Value: value, Found: ok})
+		value, found, err := t.txn.Get([]byte(key))
+		if err != nil {
+			return c.JSON(txnErrorStatus(err), map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, GetResponse{Key: key, Value: string(value), Found: found})
+	})
+
+	e.POST("/txn/:id/put", func(c echo.Context) error {
+		t, ok := txns.get(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "transaction not found"})
+		}
+		t.Lock()
+		defer t.Unlock()
+		req := new(PutRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if req.TTLSeconds != 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "ttl_seconds is not supported in transactions"})
+		}
+		if err := t.txn.Put([]byte(req.Key), []byte(req.Value)); err != nil {
+			return c.JSON(txnErrorStatus(err), map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+	})
+
+	e.DELETE("/txn/:id/key/:key", func(c echo.Context) error {
+		t, ok := txns.get(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "transaction not found"})
+		}
+		t.Lock()
+		defer t.Unlock()
+		if err := t.txn.Delete([]byte(c.Param("key"))); err != nil {
+			return c.JSON(txnErrorStatus(err), map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
 	})
 
-	e.POST("/compact", func(c echo.Context) error {
-		if err := lsmTree.Compact(); err != nil {
+	e.POST("/txn/:id/commit", func(c echo.Context) error {
+		t, ok := txns.remove(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "transaction not found"})
+		}
+		t.Lock()
+		defer t.Unlock()
+		if err := t.txn.Commit(); err != nil {
+			return c.JSON(txnErrorStatus(err), map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "committed"})
+	})
+
+	e.POST("/txn/:id/rollback", func(c echo.Context) error {
+		t, ok := txns.remove(c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "transaction not found"})
+		}
+		t.Lock()
+		defer t.Unlock()
+		if err := t.txn.Rollback(); err != nil {
+			return c.JSON(txnErrorStatus(err), map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "rolled back"})
+	})
+
+	// 管理接口读写服务器上的目录：不开启跨域，拒绝来自其他站点的请求，
+	// 请求中的目录都是 backupRoot 下的相对路径
+	backupRoot := "./backups"
+	if root := os.Getenv("LSMTREE_BACKUP_ROOT"); root != "" {
+		backupRoot = root
+	}
+	admin := e.Group("/admin", sameOrigin)
+
+	// 基础备份：刷盘后把当前的 SSTable 集合复制到 dir，之后用 restore 子命令按时间点恢复
+	admin.POST("/base-backup", func(c echo.Context) error {
+		req := new(BackupRequest)
+		if err := c.Bind(req); err != nil || req.Dir == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, req.Dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		info, err := lsmTree.CreateBaseBackup(dir)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, info)
+	})
+
+	// 检查点：硬链接当前的 SSTable 并复制未刷盘的 WAL，生成的目录可以直接作为数据库打开
+	admin.POST("/checkpoint", func(c echo.Context) error {
+		req := new(BackupRequest)
+		if err := c.Bind(req); err != nil || req.Dir == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, req.Dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := lsmTree.Checkpoint(dir); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+	})
+
+	// 增量备份：每个备份只复制备份目录中还没有的 SSTable
+	admin.POST("/backups", func(c echo.Context) error {
+		req := new(BackupEngineRequest)
+		if err := c.Bind(req); err != nil || req.Dir == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, req.Dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		backup, err := lsmTree.CreateBackup(dir)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, backup)
+	})
+	admin.GET("/backups", func(c echo.Context) error {
+		if c.QueryParam("dir") == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, c.QueryParam("dir"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		backups, err := lsm.ListBackups(dir)
+		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		}
-		return c.JSON(http.StatusOK, map[string]string{"message": "compaction started"})
+		return c.JSON(http.StatusOK, backups)
+	})
+	admin.POST("/backups/verify", func(c echo.Context) error {
+		req := new(BackupEngineRequest)
+		if err := c.Bind(req); err != nil || req.Dir == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, req.Dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := lsm.VerifyBackup(dir, req.ID); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, lsm.ErrBackupCorrupted) {
+				status = http.StatusConflict
+			}
+			return c.JSON(status, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "ok"})
+	})
+	admin.POST("/backups/restore", func(c echo.Context) error {
+		req := new(BackupEngineRequest)
+		if err := c.Bind(req); err != nil || req.Dir == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		if req.Target == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "target is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, req.Dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		target, err := resolveBackupPath(backupRoot, req.Target)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := lsm.RestoreBackup(dir, req.ID, target); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "success"})
+	})
+	admin.POST("/backups/purge", func(c echo.Context) error {
+		req := new(BackupEngineRequest)
+		if err := c.Bind(req); err != nil || req.Dir == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "dir is required"})
+		}
+		dir, err := resolveBackupPath(backupRoot, req.Dir)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		purged, err := lsm.PurgeBackups(dir, req.Keep, time.Duration(req.MaxAgeSeconds)*time.Second)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string][]uint64{"purged": purged})
 	})
 
 	fmt.Println("LSM-Tree server starting on :8080")
@@ -88,7 +458,7 @@ func main() {
 			defer wg.Done()
 			key := fmt.Sprintf("key%d", i)
 			value := fmt.Sprintf("value%d", i)
-			if err := lsmTree.Put(key, value); err != nil {
+			if err := lsmTree.Put([]byte(key), []byte(value)); err != nil {
 				fmt.Printf("Put error for %s: %v\n", key, err)
 			}
 		}(i)
@@ -98,10 +468,43 @@ func main() {
 
 	for i := 0; i < 15; i++ {
 		key := fmt.Sprintf("key%d", i)
-		if value, ok := lsmTree.Get(key); ok {
+		if value, ok := lsmTree.Get([]byte(key)); ok {
 			fmt.Printf("%s: %s\n", key, value)
 		} else {
 			fmt.Printf("%s not found\n", key)
 		}
 	}
 }
+
+// columnFamily 返回路径参数 cf 指定的列族，没有该参数时返回默认列族
+func columnFamily(tree *lsm.LSMTree, c echo.Context) (*lsm.ColumnFamily, bool) {
+	name := c.Param("cf")
+	if name == "" {
+		return tree.DefaultColumnFamily(), true
+	}
+	return tree.GetColumnFamily(name)
+}
+
+// resolveBackupPath 把管理接口请求中的目录解析为 root 下的路径，拒绝绝对路径和包含 .. 的路径
+func resolveBackupPath(root, path string) (string, error) {
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, "\\") {
+		return "", fmt.Errorf("%q must be relative to the backup root", path)
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return "", fmt.Errorf("%q must not contain ..", path)
+		}
+	}
+	return filepath.Join(root, path), nil
+}
+
+// sameOrigin 拒绝浏览器从其他站点发来的请求，没有 Origin 头的请求（如 curl）不受影响
+func sameOrigin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		origin := c.Request().Header.Get(echo.HeaderOrigin)
+		if origin != "" && origin != c.Scheme()+"://"+c.Request().Host {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "cross-origin requests are not allowed"})
+		}
+		return next(c)
+	}
+}
@@ -66,6 +66,35 @@ async function getData() {
     }
 }
 
+async function deleteData() {
+    const key = document.getElementById('deleteKey').value;
+    const statusElement = document.getElementById('deleteStatus');
+
+    if (!key) {
+        statusElement.textContent = 'Please enter a key.';
+        statusElement.className = 'error';
+        return;
+    }
+
+    try {
+        const response = await fetch(`${API_BASE_URL}/key/${encodeURIComponent(key)}`, {
+            method: 'DELETE',
+        });
+        const data = await response.json();
+        if (response.ok) {
+            statusElement.textContent = `Delete successful: ${data.message}`;
+            statusElement.className = 'success';
+            document.getElementById('deleteKey').value = '';
+        } else {
+            statusElement.textContent = `Error: ${data.error}`;
+            statusElement.className = 'error';
+        }
+    } catch (error) {
+        statusElement.textContent = `Network error: ${error.message}`;
+        statusElement.className = 'error';
+    }
+}
+
 async function compactData() {
     const statusElement = document.getElementById('compactStatus');
     try {
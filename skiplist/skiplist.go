@@ -3,38 +3,48 @@ package skiplist
 import (
 	"math/rand/v2"
 	"sync"
-	"time"
+
+	"LSMTree/comparator"
 )
 
 type SkipNode struct {
-	key       string
-	value     string
-	forward   []*SkipNode
-	timestamp int64
+	key     []byte
+	value   []byte
+	forward []*SkipNode
+}
+
+type Entry struct {
+	Key   []byte
+	Value []byte
 }
 
 type SkipList struct {
 	level    int
 	head     *SkipNode
 	maxLevel int
+	cmp      comparator.Comparator
 	mutex    sync.RWMutex
 	size     int
 }
 
-func NewSkipNode(key, value string, level int) *SkipNode {
+func NewSkipNode(key, value []byte, level int) *SkipNode {
 	return &SkipNode{
-		key:       key,
-		value:     value,
-		forward:   make([]*SkipNode, level+1),
-		timestamp: time.Now().UnixNano(),
+		key:     key,
+		value:   value,
+		forward: make([]*SkipNode, level+1),
 	}
 }
 
-func NewSkipList(maxLevel int) *SkipList {
+// NewSkipList 创建按 cmp 排序的跳表，cmp 为 nil 时按字节序
+func NewSkipList(maxLevel int, cmp comparator.Comparator) *SkipList {
+	if cmp == nil {
+		cmp = comparator.Bytewise
+	}
 	return &SkipList{
 		level:    1,
-		head:     NewSkipNode("", "", maxLevel),
+		head:     NewSkipNode(nil, nil, maxLevel),
 		maxLevel: maxLevel,
+		cmp:      cmp,
 	}
 }
 
@@ -46,26 +56,40 @@ func (sl *SkipList) randomLevel() int {
 	return level
 }
 
-func (sl *SkipList) Put(key, value string) {
+// Put 复制 key 和 value，调用方之后可以继续复用它们
+func (sl *SkipList) Put(key, value []byte) {
 	sl.mutex.Lock()
 	defer sl.mutex.Unlock()
 
 	// fmt.Printf("Putting %s: %s\n", key, value)
+	sl.insert(key, value)
+}
+
+// Write 在一次加锁中插入多条记录，并发的读操作要么看到全部，要么一条也看不到
+func (sl *SkipList) Write(entries []Entry) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	for _, entry := range entries {
+		sl.insert(entry.Key, entry.Value)
+	}
+}
 
+func (sl *SkipList) insert(key, value []byte) {
+	value = append([]byte(nil), value...)
 	update := make([]*SkipNode, sl.maxLevel+1)
 	current := sl.head
 
 	for i := sl.level; i >= 0; i-- {
-		for current.forward[i] != nil && current.forward[i].key < key {
+		for current.forward[i] != nil && sl.cmp.Compare(current.forward[i].key, key) < 0 {
 			current = current.forward[i]
 		}
 		update[i] = current
 	}
 
 	current = current.forward[0]
-	if current != nil && current.key == key {
+	if current != nil && sl.cmp.Compare(current.key, key) == 0 {
 		current.value = value
-		current.timestamp = time.Now().UnixNano()
 		return
 	}
 
@@ -77,7 +101,7 @@ func (sl *SkipList) Put(key, value string) {
 		sl.level = level
 	}
 
-	newNode := NewSkipNode(key, value, level)
+	newNode := NewSkipNode(append([]byte(nil), key...), value, level)
 	for i := 0; i <= level; i++ {
 		newNode.forward[i] = update[i].forward[i]
 		update[i].forward[i] = newNode
@@ -85,39 +109,97 @@ func (sl *SkipList) Put(key, value string) {
 	sl.size++
 }
 
-func (sl *SkipList) Get(key string) (string, bool) {
+func (sl *SkipList) Size() int {
 	sl.mutex.RLock()
 	defer sl.mutex.RUnlock()
+	return sl.size
+}
 
+// findLessThan 返回键小于 key 的最后一个节点，不存在时返回 head
+func (sl *SkipList) findLessThan(key []byte) *SkipNode {
 	current := sl.head
 	for i := sl.level; i >= 0; i-- {
-		for current.forward[i] != nil && current.forward[i].key < key {
+		for current.forward[i] != nil && sl.cmp.Compare(current.forward[i].key, key) < 0 {
 			current = current.forward[i]
 		}
 	}
-	current = current.forward[0]
+	return current
+}
 
-	if current != nil && current.key == key {
-		// fmt.Printf("Found %s: %s\n", key, current.value)
-		return current.value, true
+func (sl *SkipList) findLast() *SkipNode {
+	current := sl.head
+	for i := sl.level; i >= 0; i-- {
+		for current.forward[i] != nil {
+			current = current.forward[i]
+		}
 	}
-	// fmt.Printf("Not found %s\n", key)
-	return "", false
+	return current
 }
 
-func (sl *SkipList) Size() int {
-	sl.mutex.RLock()
-	defer sl.mutex.RUnlock()
-	return sl.size
+// Iterator 按键有序遍历跳表，每次移动都单独加读锁，
+// 因此可以与写入并发进行
+type Iterator struct {
+	list *SkipList
+	node *SkipNode
 }
 
-func (sl *SkipList) ToMap() map[string]string {
-	sl.mutex.RLock()
-	defer sl.mutex.RUnlock()
+func (sl *SkipList) NewIterator() *Iterator {
+	return &Iterator{list: sl}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *Iterator) Key() []byte {
+	return it.node.key
+}
+
+func (it *Iterator) Value() []byte {
+	it.list.mutex.RLock()
+	defer it.list.mutex.RUnlock()
+	return it.node.value
+}
 
-	result := make(map[string]string)
-	for current := sl.head.forward[0]; current != nil; current = current.forward[0] {
-		result[current.key] = current.value
+func (it *Iterator) SeekToFirst() {
+	it.list.mutex.RLock()
+	defer it.list.mutex.RUnlock()
+	it.node = it.list.head.forward[0]
+}
+
+func (it *Iterator) SeekToLast() {
+	it.list.mutex.RLock()
+	defer it.list.mutex.RUnlock()
+	it.node = it.list.findLast()
+	if it.node == it.list.head {
+		it.node = nil
 	}
-	return result
+}
+
+// Seek 定位到第一个键大于等于 key 的节点
+func (it *Iterator) Seek(key []byte) {
+	it.list.mutex.RLock()
+	defer it.list.mutex.RUnlock()
+	it.node = it.list.findLessThan(key).forward[0]
+}
+
+func (it *Iterator) Next() {
+	it.list.mutex.RLock()
+	defer it.list.mutex.RUnlock()
+	it.node = it.node.forward[0]
+}
+
+// Prev 跳表只有前向指针，需要重新查找前驱节点
+func (it *Iterator) Prev() {
+	it.list.mutex.RLock()
+	defer it.list.mutex.RUnlock()
+	it.node = it.list.findLessThan(it.node.key)
+	if it.node == it.list.head {
+		it.node = nil
+	}
+}
+
+func (it *Iterator) Close() error {
+	it.node = nil
+	return nil
 }
@@ -0,0 +1,250 @@
+package sstable
+
+import (
+	"encoding/binary"
+
+	"LSMTree/comparator"
+)
+
+// data block 布局：
+//
+//	| entry 0 | ... | entry n | restart 0 (uint32) | ... | restart k (uint32) | numRestarts (uint32) |
+//
+// 每条记录：shared | unshared | valueLen（均为 uvarint）| kind | key[shared:] | value，
+// 键只保存与上一条记录不同的后缀。每隔 restartInterval 条记录设置一个重启点，
+// 重启点处的记录保存完整的键（shared 为 0），restart 数组记录这些记录的偏移，
+// 查找时先在重启点上二分，再从重启点开始顺序解码
+const defaultRestartInterval = 16
+
+type blockBuilder struct {
+	restartInterval int
+	buf             []byte
+	restarts        []uint32
+	counter         int
+	lastKey         []byte
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{restartInterval: restartInterval, restarts: []uint32{0}}
+}
+
+func (b *blockBuilder) add(entry Entry) {
+	shared := 0
+	if b.counter < b.restartInterval {
+		n := min(len(b.lastKey), len(entry.Key))
+		for shared < n && b.lastKey[shared] == entry.Key[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(entry.Key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(entry.Value)))
+	if entry.Deleted {
+		b.buf = append(b.buf, kindDelete)
+	} else {
+		b.buf = append(b.buf, kindPut)
+	}
+	b.buf = append(b.buf, entry.Key[shared:]...)
+	b.buf = append(b.buf, entry.Value...)
+	b.lastKey = append(b.lastKey[:0], entry.Key...)
+	b.counter++
+}
+
+// finish 追加 restart 数组并返回完整的 block，在 reset 之前有效
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	return binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = append(b.restarts[:0], 0)
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.buf) == 0
+}
+
+// estimatedSize 返回 finish 之后 block 的大小
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// block 是解压后的 data block，放进 BlockCache 后被多个迭代器共享，不能修改
+type block struct {
+	data []byte
+	// restartOffset 是 restart 数组的起始位置，也是记录区域的结尾
+	restartOffset int
+	numRestarts   int
+}
+
+func newBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, ErrCorrupted
+	}
+	n := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if n == 0 || uint64(n) > uint64(len(data)-4)/4 {
+		return nil, ErrCorrupted
+	}
+	return &block{data: data, restartOffset: len(data) - 4 - 4*int(n), numRestarts: int(n)}, nil
+}
+
+func (b *block) restartPoint(i int) int {
+	return int(binary.LittleEndian.Uint32(b.data[b.restartOffset+4*i:]))
+}
+
+func (b *block) iterator(cmp comparator.Comparator) *blockIter {
+	return &blockIter{block: b, cmp: cmp, current: b.restartOffset, restartIndex: b.numRestarts}
+}
+
+// blockIter 在一个 block 内移动。key 每次解码都重新分配，移动之后旧的 key 仍然有效；
+// value 直接引用 block 的数据
+type blockIter struct {
+	*block
+	cmp comparator.Comparator
+	// current 是当前记录的偏移，等于 restartOffset 时迭代器无效；next 是下一条记录的偏移
+	current      int
+	next         int
+	restartIndex int
+	key          []byte
+	value        []byte
+	deleted      bool
+	err          error
+}
+
+func (it *blockIter) valid() bool {
+	return it.err == nil && it.current < it.restartOffset
+}
+
+func (it *blockIter) invalidate() {
+	it.current = it.restartOffset
+	it.restartIndex = it.numRestarts
+}
+
+func (it *blockIter) seekToRestartPoint(i int) {
+	it.key = nil
+	it.restartIndex = i
+	it.next = it.restartPoint(i)
+}
+
+// parseNext 解码 next 处的记录，到达记录区域结尾或数据损坏时迭代器变为无效
+func (it *blockIter) parseNext() bool {
+	it.current = it.next
+	if it.current >= it.restartOffset {
+		it.invalidate()
+		return false
+	}
+	shared, unshared, valueLen, kind, n := decodeEntryHeader(it.data[it.current:it.restartOffset])
+	rest := it.restartOffset - it.current - n
+	if n <= 0 || shared > uint64(len(it.key)) || unshared > uint64(rest) || valueLen > uint64(rest)-unshared ||
+		(kind != kindPut && kind != kindDelete) {
+		it.err = ErrCorrupted
+		it.invalidate()
+		return false
+	}
+	p := it.current + n
+	key := make([]byte, shared+unshared)
+	copy(key, it.key[:shared])
+	copy(key[shared:], it.data[p:p+int(unshared)])
+	p += int(unshared)
+	it.key = key
+	it.value = it.data[p : p+int(valueLen) : p+int(valueLen)]
+	it.deleted = kind == kindDelete
+	it.next = p + int(valueLen)
+	for it.restartIndex+1 < it.numRestarts && it.restartPoint(it.restartIndex+1) < it.current {
+		it.restartIndex++
+	}
+	return true
+}
+
+func (it *blockIter) seekToFirst() {
+	it.seekToRestartPoint(0)
+	it.parseNext()
+}
+
+func (it *blockIter) seekToLast() {
+	it.seekToRestartPoint(it.numRestarts - 1)
+	for it.parseNext() && it.next < it.restartOffset {
+	}
+}
+
+// seek 定位到第一个键大于等于 target 的记录：先二分找到最后一个键小于 target 的重启点，
+// 再从那里顺序查找
+func (it *blockIter) seek(target []byte) {
+	left, right := 0, it.numRestarts-1
+	for left < right {
+		mid := (left + right + 1) / 2
+		key, ok := it.restartKey(mid)
+		if !ok {
+			it.err = ErrCorrupted
+			it.invalidate()
+			return
+		}
+		if it.cmp.Compare(key, target) < 0 {
+			left = mid
+		} else {
+			right = mid - 1
+		}
+	}
+	it.seekToRestartPoint(left)
+	for it.parseNext() {
+		if it.cmp.Compare(it.key, target) >= 0 {
+			return
+		}
+	}
+}
+
+// restartKey 返回第 i 个重启点处的完整键，不会移动迭代器
+func (it *blockIter) restartKey(i int) ([]byte, bool) {
+	offset := it.restartPoint(i)
+	if offset >= it.restartOffset {
+		return nil, false
+	}
+	shared, unshared, _, _, n := decodeEntryHeader(it.data[offset:it.restartOffset])
+	if n <= 0 || shared != 0 || unshared > uint64(it.restartOffset-offset-n) {
+		return nil, false
+	}
+	return it.data[offset+n : offset+n+int(unshared)], true
+}
+
+// prev 回到当前记录之前的重启点，再顺序解码到前一条记录
+func (it *blockIter) prev() {
+	original := it.current
+	for it.restartPoint(it.restartIndex) >= original {
+		if it.restartIndex == 0 {
+			it.invalidate()
+			return
+		}
+		it.restartIndex--
+	}
+	it.seekToRestartPoint(it.restartIndex)
+	for it.parseNext() && it.next < original {
+	}
+}
+
+func decodeEntryHeader(data []byte) (shared, unshared, valueLen uint64, kind byte, n int) {
+	var m int
+	if shared, m = binary.Uvarint(data); m <= 0 {
+		return 0, 0, 0, 0, -1
+	}
+	n += m
+	if unshared, m = binary.Uvarint(data[n:]); m <= 0 {
+		return 0, 0, 0, 0, -1
+	}
+	n += m
+	if valueLen, m = binary.Uvarint(data[n:]); m <= 0 {
+		return 0, 0, 0, 0, -1
+	}
+	n += m
+	if n >= len(data) {
+		return 0, 0, 0, 0, -1
+	}
+	return shared, unshared, valueLen, data[n], n + 1
+}
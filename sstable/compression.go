@@ -0,0 +1,126 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Codec 是 block trailer 中记录的压缩算法
+type Codec byte
+
+const (
+	NoCompression Codec = iota
+	// FlateCompression 是不带头部的 DEFLATE 流
+	FlateCompression
+	ZlibCompression
+	GzipCompression
+)
+
+func (c Codec) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	case ZlibCompression:
+		return "zlib"
+	case GzipCompression:
+		return "gzip"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// Compression 描述 data block 的压缩方式。Level 使用 compress/flate 的压缩级别，
+// 0 表示 flate.DefaultCompression
+type Compression struct {
+	Codec Codec
+	Level int
+}
+
+func (c Compression) level() int {
+	if c.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return c.Level
+}
+
+// resetWriter 是三种压缩算法的 Writer 的公共接口，Reset 之后可以复用
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compressor 在同一个 Writer 的多个 block 之间复用压缩器
+type compressor struct {
+	compression Compression
+	buf         bytes.Buffer
+	w           resetWriter
+}
+
+func newCompressor(c Compression) (*compressor, error) {
+	comp := &compressor{compression: c}
+	var err error
+	switch c.Codec {
+	case NoCompression:
+	case FlateCompression:
+		comp.w, err = flate.NewWriter(&comp.buf, c.level())
+	case ZlibCompression:
+		comp.w, err = zlib.NewWriterLevel(&comp.buf, c.level())
+	case GzipCompression:
+		comp.w, err = gzip.NewWriterLevel(&comp.buf, c.level())
+	default:
+		err = fmt.Errorf("sstable: unknown codec %d", c.Codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return comp, nil
+}
+
+// compress 返回压缩后的数据和实际使用的算法。压缩后省下的空间不足 1/8 时保存原始数据
+func (c *compressor) compress(data []byte) ([]byte, Codec, error) {
+	if c.w == nil {
+		return data, NoCompression, nil
+	}
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, 0, err
+	}
+	if c.buf.Len() >= len(data)-len(data)/8 {
+		return data, NoCompression, nil
+	}
+	return c.buf.Bytes(), c.compression.Codec, nil
+}
+
+func decompress(codec Codec, data []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch codec {
+	case NoCompression:
+		return data, nil
+	case FlateCompression:
+		r = flate.NewReader(bytes.NewReader(data))
+	case ZlibCompression:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case GzipCompression:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrCorrupted, codec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return raw, nil
+}
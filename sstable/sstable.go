@@ -1,187 +1,816 @@
 package sstable
 
 import (
+	"bufio"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"hash/crc32"
 	"os"
 	"sort"
 	"sync"
 
 	"github.com/bits-and-blooms/bloom/v3"
+
+	"LSMTree/cache"
+	"LSMTree/comparator"
+)
+
+// 文件布局：
+//
+//	| data block 0 | ... | data block n | filter block | properties block | index block | footer |
+//
+// 每个 block 后面跟 5 字节的 trailer：1 字节压缩算法加上覆盖 block 内容和算法字节的 crc32c 校验。
+// data block 对键做前缀压缩（格式见 block.go），写满 blockSize（压缩前）后切分，
+// 按 Options.Compression 压缩，其余 block 不压缩；
+// index block 为每个 data block 记录一条 (最后一个键, offset, size)，是稀疏索引；
+// filter block 保存布隆过滤器，properties block 保存统计信息。
+// footer 固定 56 字节：filter/properties/index 三个 block 的 (offset, size) 加上魔数
+const (
+	blockSize   = 4096
+	trailerSize = 5
+	footerSize  = 56
+	tableMagic  = uint64(0x4c534d5354424c33) // "LSMSTBL3"
+
+	defaultBloomCapacity = 10000
 )
 
-//easyjson:json
+const (
+	kindPut    byte = 0
+	kindDelete byte = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupted = errors.New("sstable: corrupted block")
+
 type Entry struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key     []byte
+	Value   []byte
+	Deleted bool
+}
+
+// Properties 记录在 properties block 中，键以 base64 编码保存。
+// DataSize 是 data block 在文件中（压缩后）的大小，UncompressedDataSize 是压缩前的大小
+type Properties struct {
+	NumEntries           int64  `json:"num_entries"`
+	NumDeletions         int64  `json:"num_deletions"`
+	NumDataBlocks        int64  `json:"num_data_blocks"`
+	RawKeySize           int64  `json:"raw_key_size"`
+	RawValueSize         int64  `json:"raw_value_size"`
+	DataSize             int64  `json:"data_size"`
+	UncompressedDataSize int64  `json:"uncompressed_data_size"`
+	Compression          string `json:"compression"`
+	SmallestKey          []byte `json:"smallest_key"`
+	LargestKey           []byte `json:"largest_key"`
+	Comparator           string `json:"comparator"`
+}
+
+// Options 控制表文件的排序规则、布隆过滤器和缓存，nil 或零值字段使用默认值
+type Options struct {
+	// Comparator 决定键的顺序，默认按字节序
+	Comparator comparator.Comparator
+	// FilterKey 返回键中加入布隆过滤器的部分，默认使用整个键
+	FilterKey func(key []byte) []byte
+	// BlockCache 缓存解码后的 data block，为 nil 时每次都从文件读取
+	BlockCache *cache.Cache
+	// PinIndexAndFilter 为真时 index 和 filter 作为固定条目放进 BlockCache，
+	// 在表关闭前不会被淘汰；为假时它们和 data block 一样按需加载、可以被淘汰。
+	// 没有 BlockCache 时 index 和 filter 总是常驻内存
+	PinIndexAndFilter bool
+	// CacheID 是文件在 BlockCache 中的 ID，应当是文件号这样稳定、不会重复使用的值，
+	// 文件被关闭后重新打开时仍能命中之前缓存的 block。为 0 时每次打开分配一个新的 ID
+	CacheID uint64
+	// Compression 是写入 data block 时使用的压缩方式，读取时按 block trailer 中的算法解压
+	Compression Compression
+	// BlockRestartInterval 是 data block 中重启点之间的记录数，默认 16。
+	// 越大前缀压缩越充分，但查找时在重启点之后需要顺序解码的记录越多
+	BlockRestartInterval int
+}
+
+func (o *Options) sanitize() *Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = comparator.Bytewise
+	}
+	if opts.FilterKey == nil {
+		opts.FilterKey = func(key []byte) []byte { return key }
+	}
+	if opts.BlockRestartInterval <= 0 {
+		opts.BlockRestartInterval = defaultRestartInterval
+	}
+	return &opts
+}
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+type indexEntry struct {
+	lastKey []byte
+	handle  blockHandle
 }
 
+// SSTable 在打开期间持有文件句柄，所有读取都通过 ReadAt 进行，
+// 并发的读操作之间不共享文件偏移，不需要加锁
 type SSTable struct {
 	filepath string
-	index    map[string]int64
+	file     *os.File
+	opts     *Options
 	mutex    sync.RWMutex
-	bloom    *bloom.BloomFilter
+	props    Properties
+	// index 和 bloom 常驻内存时不为 nil，否则通过 BlockCache 按 handle 加载
+	index        []indexEntry
+	bloom        *bloom.BloomFilter
+	indexHandle  blockHandle
+	filterHandle blockHandle
+	// cacheID 区分不同文件在 BlockCache 中的 block
+	cacheID uint64
+	// pinID 是这次打开固定 index 和 filter 使用的 ID，同一文件的多个实例互不影响
+	pinID uint64
 }
 
+// NewSSTable 以字节序打开已有的表文件，文件不存在或无法解析时返回一个空表
 func NewSSTable(filepath string) *SSTable {
-	sst := &SSTable{
-		filepath: filepath,
-		index:    make(map[string]int64),
-	}
-
-	// 检查是否存在布隆过滤器文件
-	bloomFile := filepath + ".bloom"
-	if _, err := os.Stat(bloomFile); err == nil {
-		file, err := os.Open(bloomFile)
-		if err == nil {
-			defer file.Close()
-
-			// 读取元数据 (m, k)
-			var m, k uint32
-			if err := binary.Read(file, binary.LittleEndian, &m); err != nil {
-				fmt.Printf("Failed to read m from %s: %v\n", bloomFile, err)
-				return &SSTable{filepath: filepath, index: make(map[string]int64), bloom: bloom.NewWithEstimates(10000, 0.01)}
-			}
-			if err := binary.Read(file, binary.LittleEndian, &k); err != nil {
-				fmt.Printf("Failed to read k from %s: %v\n", bloomFile, err)
-				return &SSTable{filepath: filepath, index: make(map[string]int64), bloom: bloom.NewWithEstimates(10000, 0.01)}
-			}
-
-			// 读取整个文件剩余内容
-			data, err := io.ReadAll(file)
-			if err != nil {
-				fmt.Printf("Failed to read bloom data from %s: %v\n", bloomFile, err)
-				return &SSTable{filepath: filepath, index: make(map[string]int64), bloom: bloom.NewWithEstimates(10000, 0.01)}
-			}
-			fmt.Printf("Read data length: %d, expected m/8: %d\n", len(data), m/8)
-
-			// 创建一个新的布隆过滤器并加载数据
-			bf := bloom.NewWithEstimates(uint(m), 0.01)
-			if err := bf.UnmarshalBinary(data); err != nil {
-				fmt.Printf("Failed to unmarshal bloom filter from %s: %v\n", bloomFile, err)
-				return &SSTable{filepath: filepath, index: make(map[string]int64), bloom: bloom.NewWithEstimates(10000, 0.01)}
-			}
-			sst.bloom = bf
-			return sst
+	sst, err := OpenSSTable(filepath, nil)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Failed to open sstable %s: %v\n", filepath, err)
 		}
+		return &SSTable{filepath: filepath, opts: (*Options)(nil).sanitize(), bloom: bloom.NewWithEstimates(defaultBloomCapacity, 0.01)}
 	}
-
-	// 如果文件不存在或加载失败，创建新的布隆过滤器
-	sst.bloom = bloom.NewWithEstimates(10000, 0.01)
 	return sst
 }
 
-func (s *SSTable) Write(data map[string]string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// OpenSSTable 读取 footer，只把索引、过滤器和属性加载到内存，文件保持打开直到 Close。
+// 与写入时使用的比较器不一致会返回错误
+func OpenSSTable(filepath string, opts *Options) (*SSTable, error) {
+	opts = opts.sanitize()
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	sst, err := openTable(file, filepath, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sst, nil
+}
 
-	// 写入 SSTable 文件
-	file, err := os.Create(s.filepath)
+func openTable(file *os.File, filepath string, opts *Options) (*SSTable, error) {
+	info, err := file.Stat()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if info.Size() < footerSize {
+		return nil, fmt.Errorf("sstable: file too short: %d bytes", info.Size())
 	}
-	defer file.Close()
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[48:]) != tableMagic {
+		return nil, fmt.Errorf("sstable: bad magic number")
+	}
+	filterHandle := decodeHandle(footer[0:16])
+	propsHandle := decodeHandle(footer[16:32])
+	indexHandle := decodeHandle(footer[32:48])
 
-	keys := make([]string, 0, len(data))
-	for k := range data {
-		keys = append(keys, k)
+	sst := &SSTable{filepath: filepath, file: file, opts: opts, indexHandle: indexHandle, filterHandle: filterHandle}
+
+	index, err := loadIndex(file, indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := loadFilter(file, filterHandle)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(keys)
 
-	offset := int64(0)
-	for _, key := range keys {
-		entry := Entry{Key: key, Value: data[key]}
-		jsonData, err := entry.MarshalJSON()
-		if err != nil {
-			return err
-		}
-		if _, err := file.Write(append(jsonData, '\n')); err != nil {
-			return err
+	propsData, err := readBlock(file, propsHandle)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(propsData, &sst.props); err != nil {
+		return nil, err
+	}
+	if name := opts.Comparator.Name(); sst.props.Comparator != "" && sst.props.Comparator != name {
+		return nil, fmt.Errorf("sstable: written with comparator %s, opened with %s", sst.props.Comparator, name)
+	}
+	sst.setupCache(index, filter)
+	return sst, nil
+}
+
+// setupCache 决定 index 和 filter 是常驻、固定在 BlockCache 中还是按需加载
+func (s *SSTable) setupCache(index []indexEntry, filter *bloom.BloomFilter) {
+	c := s.opts.BlockCache
+	if c == nil {
+		s.index, s.bloom = index, filter
+		return
+	}
+	s.cacheID = s.opts.CacheID
+	if s.cacheID == 0 {
+		s.cacheID = c.NewID()
+	}
+	if s.opts.PinIndexAndFilter {
+		// 固定的 index 和 filter 归这次打开所有，Close 时移除
+		s.index, s.bloom = index, filter
+		s.pinID = c.NewID()
+		c.SetPinned(cache.Key{ID: s.pinID, Offset: s.indexHandle.offset}, index, int64(s.indexHandle.size))
+		c.SetPinned(cache.Key{ID: s.pinID, Offset: s.filterHandle.offset}, filter, int64(s.filterHandle.size))
+	} else {
+		c.Set(cache.Key{ID: s.cacheID, Offset: s.indexHandle.offset}, index, int64(s.indexHandle.size))
+		c.Set(cache.Key{ID: s.cacheID, Offset: s.filterHandle.offset}, filter, int64(s.filterHandle.size))
+	}
+}
+
+// Close 关闭文件并从 BlockCache 中移除固定的 index 和 filter，之后不能再读取这个表
+func (s *SSTable) Close() error {
+	if c := s.opts.BlockCache; c != nil && s.opts.PinIndexAndFilter {
+		c.Erase(cache.Key{ID: s.pinID, Offset: s.indexHandle.offset})
+		c.Erase(cache.Key{ID: s.pinID, Offset: s.filterHandle.offset})
+	}
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func loadIndex(file *os.File, handle blockHandle) ([]indexEntry, error) {
+	data, err := readBlock(file, handle)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(data)
+}
+
+func loadFilter(file *os.File, handle blockHandle) (*bloom.BloomFilter, error) {
+	data, err := readBlock(file, handle)
+	if err != nil {
+		return nil, err
+	}
+	filter := &bloom.BloomFilter{}
+	if err := filter.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// getIndex 返回常驻的索引，或者从 BlockCache 中取出，未命中时从文件重新加载
+func (s *SSTable) getIndex() ([]indexEntry, error) {
+	if s.index != nil || s.opts.BlockCache == nil {
+		return s.index, nil
+	}
+	key := cache.Key{ID: s.cacheID, Offset: s.indexHandle.offset}
+	if value, ok := s.opts.BlockCache.Get(key); ok {
+		return value.([]indexEntry), nil
+	}
+	index, err := loadIndex(s.file, s.indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	s.opts.BlockCache.Set(key, index, int64(s.indexHandle.size))
+	return index, nil
+}
+
+func (s *SSTable) getFilter() (*bloom.BloomFilter, error) {
+	if s.bloom != nil || s.opts.BlockCache == nil {
+		return s.bloom, nil
+	}
+	key := cache.Key{ID: s.cacheID, Offset: s.filterHandle.offset}
+	if value, ok := s.opts.BlockCache.Get(key); ok {
+		return value.(*bloom.BloomFilter), nil
+	}
+	filter, err := loadFilter(s.file, s.filterHandle)
+	if err != nil {
+		return nil, err
+	}
+	s.opts.BlockCache.Set(key, filter, int64(s.filterHandle.size))
+	return filter, nil
+}
+
+// readDataBlock 读取一个解压后的 data block，经过 BlockCache 时返回的 block 是共享的，不能修改
+func (s *SSTable) readDataBlock(handle blockHandle) (*block, error) {
+	c := s.opts.BlockCache
+	key := cache.Key{ID: s.cacheID, Offset: handle.offset}
+	if c != nil {
+		if value, ok := c.Get(key); ok {
+			return value.(*block), nil
 		}
-		s.index[key] = offset
-		s.bloom.AddString(key)
-		offset += int64(len(jsonData) + 1)
 	}
-	if err := file.Sync(); err != nil {
-		return err
+	data, err := readBlock(s.file, handle)
+	if err != nil {
+		return nil, err
 	}
+	b, err := newBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w at offset %d", err, handle.offset)
+	}
+	if c != nil {
+		// 按解压后的大小计入缓存用量
+		c.Set(key, b, int64(len(data)))
+	}
+	return b, nil
+}
+
+func (s *SSTable) Write(data map[string]string) error {
+	entries := make([]Entry, 0, len(data))
+	for k, v := range data {
+		entries = append(entries, Entry{Key: []byte(k), Value: []byte(v)})
+	}
+	return s.WriteEntries(entries)
+}
 
-	// 保存布隆过滤器到磁盘
-	bloomFile := s.filepath + ".bloom"
-	bloomOut, err := os.Create(bloomFile)
+// Writer 以流式方式写出一个 SSTable，内存中只保留当前 data block、索引和键集合，
+// 调用方需要按比较器的升序调用 Add
+type Writer struct {
+	file    *os.File
+	w       *bufio.Writer
+	path    string
+	opts    *Options
+	comp    *compressor
+	offset  uint64
+	block   *blockBuilder
+	lastKey []byte
+	index   []indexEntry
+	keys    [][]byte
+	props   Properties
+}
+
+func NewWriter(filepath string, opts *Options) (*Writer, error) {
+	opts = opts.sanitize()
+	comp, err := newCompressor(opts.Compression)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	file, err := os.Create(filepath)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		file:  file,
+		w:     bufio.NewWriter(file),
+		path:  filepath,
+		opts:  opts,
+		comp:  comp,
+		block: newBlockBuilder(opts.BlockRestartInterval),
 	}
-	defer bloomOut.Close()
+	w.props.Comparator = opts.Comparator.Name()
+	w.props.Compression = opts.Compression.Codec.String()
+	return w, nil
+}
+
+// Add 追加一条记录，entry 中的切片会被复制
+func (w *Writer) Add(entry Entry) error {
+	w.block.add(entry)
+	key := append([]byte(nil), entry.Key...)
+	w.lastKey = key
+	w.keys = append(w.keys, key)
 
-	// 保存元数据 (m, k)
-	m := s.bloom.Cap()
-	k := s.bloom.K()
-	if err := binary.Write(bloomOut, binary.LittleEndian, uint32(m)); err != nil {
+	if w.props.NumEntries == 0 {
+		w.props.SmallestKey = key
+	}
+	w.props.LargestKey = key
+	w.props.NumEntries++
+	if entry.Deleted {
+		w.props.NumDeletions++
+	}
+	w.props.RawKeySize += int64(len(entry.Key))
+	w.props.RawValueSize += int64(len(entry.Value))
+
+	if w.block.estimatedSize() >= blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// EstimatedSize 返回已经写出的字节数加上当前未满的 block
+func (w *Writer) EstimatedSize() int64 {
+	if w.block.empty() {
+		return int64(w.offset)
+	}
+	return int64(w.offset) + int64(w.block.estimatedSize())
+}
+
+func (w *Writer) flushBlock() error {
+	raw := w.block.finish()
+	data, codec, err := w.comp.compress(raw)
+	if err != nil {
 		return err
 	}
-	if err := binary.Write(bloomOut, binary.LittleEndian, uint32(k)); err != nil {
+	handle, err := w.writeBlock(data, codec)
+	if err != nil {
 		return err
 	}
+	w.props.UncompressedDataSize += int64(len(raw))
+	w.index = append(w.index, indexEntry{lastKey: w.lastKey, handle: handle})
+	w.props.NumDataBlocks++
+	w.block.reset()
+	return nil
+}
+
+func (w *Writer) writeBlock(data []byte, codec Codec) (blockHandle, error) {
+	handle := blockHandle{offset: w.offset, size: uint64(len(data))}
+	trailer := make([]byte, trailerSize)
+	trailer[0] = byte(codec)
+	crc := crc32.Update(crc32.Checksum(data, crcTable), crcTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], crc)
+	if _, err := w.w.Write(data); err != nil {
+		return handle, err
+	}
+	if _, err := w.w.Write(trailer); err != nil {
+		return handle, err
+	}
+	w.offset += uint64(len(data) + trailerSize)
+	return handle, nil
+}
+
+// Finish 写出 filter、properties、index 和 footer 并落盘，返回可直接读取的 SSTable
+func (w *Writer) Finish() (*SSTable, error) {
+	defer w.file.Close()
+
+	if !w.block.empty() {
+		if err := w.flushBlock(); err != nil {
+			return nil, err
+		}
+	}
+	w.props.DataSize = int64(w.offset)
+
+	filter := bloom.NewWithEstimates(uint(max(len(w.keys), defaultBloomCapacity)), 0.01)
+	for _, key := range w.keys {
+		filter.Add(w.opts.FilterKey(key))
+	}
+	filterData, err := filter.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	filterHandle, err := w.writeBlock(filterData, NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	propsData, err := json.Marshal(w.props)
+	if err != nil {
+		return nil, err
+	}
+	propsHandle, err := w.writeBlock(propsData, NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	indexHandle, err := w.writeBlock(encodeIndex(w.index), NoCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, footerSize)
+	encodeHandle(footer[0:16], filterHandle)
+	encodeHandle(footer[16:32], propsHandle)
+	encodeHandle(footer[32:48], indexHandle)
+	binary.LittleEndian.PutUint64(footer[48:], tableMagic)
+	if _, err := w.w.Write(footer); err != nil {
+		return nil, err
+	}
+	if err := w.w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(w.path)
+	if err != nil {
+		return nil, err
+	}
+	sst := &SSTable{filepath: w.path, file: file, opts: w.opts, props: w.props, indexHandle: indexHandle, filterHandle: filterHandle}
+	sst.setupCache(w.index, filter)
+	return sst, nil
+}
+
+// Abort 放弃写入并删除未完成的文件
+func (w *Writer) Abort() error {
+	w.file.Close()
+	return os.Remove(w.path)
+}
+
+// WriteEntries 写入包含墓碑在内的记录
+func (s *SSTable) WriteEntries(entries []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	// 获取位数组并保存
-	dataBytes, err := s.bloom.MarshalBinary()
+	cmp := s.opts.Comparator
+	sort.Slice(entries, func(i, j int) bool {
+		return cmp.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+
+	// 写入 SSTable 文件。原地重写后内容不同，不能沿用旧的 CacheID
+	opts := *s.opts
+	opts.CacheID = 0
+	w, err := NewWriter(s.filepath, &opts)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Marshaled data length: %d, m/8: %d\n", len(dataBytes), m/8)
-	if n, err := bloomOut.Write(dataBytes); err != nil || n != len(dataBytes) {
-		return fmt.Errorf("failed to write bloom data: %v, wrote %d bytes, expected %d", err, n, len(dataBytes))
+	for _, entry := range entries {
+		if err := w.Add(entry); err != nil {
+			w.Abort()
+			return err
+		}
 	}
-	return bloomOut.Sync()
+	written, err := w.Finish()
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = written.file
+	s.index = written.index
+	s.bloom = written.bloom
+	s.props = written.props
+	s.indexHandle = written.indexHandle
+	s.filterHandle = written.filterHandle
+	s.cacheID = written.cacheID
+	s.pinID = written.pinID
+	return nil
+}
+
+// Get 返回值、是否为墓碑以及是否找到
+func (s *SSTable) Get(key []byte) ([]byte, bool, bool) {
+	entry, ok, err := s.Lookup(key)
+	if err != nil || !ok || s.opts.Comparator.Compare(entry.Key, key) != 0 {
+		return nil, false, false
+	}
+	return entry.Value, entry.Deleted, true
 }
 
-func (s *SSTable) Get(key string) (string, bool) {
+// Lookup 返回第一个大于等于 key 的记录。布隆过滤器判断 FilterKey(key) 不存在时
+// 直接返回 false，因此调用方需要自己检查返回的键是否是想要的
+func (s *SSTable) Lookup(key []byte) (Entry, bool, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	// 先检查布隆过滤器
-	if !s.bloom.TestString(key) {
-		return "", false
+	filter, err := s.getFilter()
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if !filter.Test(s.opts.FilterKey(key)) {
+		return Entry{}, false, nil
 	}
 
-	offset, exists := s.index[key]
-	if !exists {
-		return "", false
+	// 稀疏索引中第一个最后键 >= key 的 block 才可能包含 key
+	index, err := s.getIndex()
+	if err != nil {
+		return Entry{}, false, err
+	}
+	i := findBlock(s.opts.Comparator, index, key)
+	if i == len(index) {
+		return Entry{}, false, nil
 	}
 
-	file, err := os.Open(s.filepath)
+	b, err := s.readDataBlock(index[i].handle)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	it := b.iterator(s.opts.Comparator)
+	it.seek(key)
+	if it.err != nil {
+		return Entry{}, false, fmt.Errorf("%w at offset %d", it.err, index[i].handle.offset)
+	}
+	if it.valid() {
+		return Entry{Key: it.key, Value: it.value, Deleted: it.deleted}, true, nil
+	}
+	return Entry{}, false, nil
+}
+
+func findBlock(cmp comparator.Comparator, index []indexEntry, key []byte) int {
+	return sort.Search(len(index), func(i int) bool {
+		return cmp.Compare(index[i].lastKey, key) >= 0
+	})
+}
+
+// Entries 按键有序读出文件中的全部记录
+func (s *SSTable) Entries() ([]Entry, error) {
+	it, err := s.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		entries = append(entries, Entry{Key: it.Key(), Value: it.Value(), Deleted: it.Deleted()})
+	}
+	return entries, it.Close()
+}
+
+func (s *SSTable) Properties() Properties {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.props
+}
+
+func (lsm *SSTable) GetFilePath() string {
+	return lsm.filepath
+}
+
+// readBlock 读取一个 block，校验后按 trailer 中的算法解压
+func readBlock(file *os.File, handle blockHandle) ([]byte, error) {
+	buf := make([]byte, handle.size+trailerSize)
+	if _, err := file.ReadAt(buf, int64(handle.offset)); err != nil {
+		return nil, err
+	}
+	data := buf[:handle.size+1]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(buf[handle.size+1:]) {
+		return nil, fmt.Errorf("%w at offset %d", ErrCorrupted, handle.offset)
+	}
+	raw, err := decompress(Codec(buf[handle.size]), buf[:handle.size])
 	if err != nil {
-		return "", false
+		return nil, fmt.Errorf("%w at offset %d", err, handle.offset)
+	}
+	return raw, nil
+}
+
+func encodeHandle(buf []byte, handle blockHandle) {
+	binary.LittleEndian.PutUint64(buf[0:8], handle.offset)
+	binary.LittleEndian.PutUint64(buf[8:16], handle.size)
+}
+
+func decodeHandle(buf []byte) blockHandle {
+	return blockHandle{
+		offset: binary.LittleEndian.Uint64(buf[0:8]),
+		size:   binary.LittleEndian.Uint64(buf[8:16]),
+	}
+}
+
+// index block 中每条记录：keyLen | lastKey | offset | size
+func encodeIndex(index []indexEntry) []byte {
+	var buf []byte
+	for _, e := range index {
+		buf = binary.AppendUvarint(buf, uint64(len(e.lastKey)))
+		buf = append(buf, e.lastKey...)
+		buf = binary.AppendUvarint(buf, e.handle.offset)
+		buf = binary.AppendUvarint(buf, e.handle.size)
+	}
+	return buf
+}
+
+func decodeIndex(data []byte) ([]indexEntry, error) {
+	var index []indexEntry
+	for len(data) > 0 {
+		key, rest, ok := readBytes(data)
+		if !ok {
+			return nil, ErrCorrupted
+		}
+		offset, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, ErrCorrupted
+		}
+		rest = rest[n:]
+		size, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, ErrCorrupted
+		}
+		index = append(index, indexEntry{lastKey: key, handle: blockHandle{offset: offset, size: size}})
+		data = rest[n:]
 	}
-	defer file.Close()
+	return index, nil
+}
 
-	if _, err := file.Seek(offset, 0); err != nil {
-		return "", false
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || uint64(len(buf)-size) < n {
+		return nil, nil, false
 	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], true
+}
+
+// Iterator 按键有序遍历 SSTable 中的记录（包括墓碑），每次只解码一个 data block。
+// Key 和 Value 返回的切片在迭代器移动之后仍然有效，但不能修改
+type Iterator struct {
+	table *SSTable
+	cmp   comparator.Comparator
+	index []indexEntry
+	block int
+	iter  *blockIter
+	err   error
+}
+
+func (s *SSTable) NewIterator() (*Iterator, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
-	buffer := make([]byte, 1024)
-	n, err := file.Read(buffer)
+	index, err := s.getIndex()
 	if err != nil {
-		return "", false
+		return nil, err
 	}
+	return &Iterator{table: s, cmp: s.opts.Comparator, index: index, block: len(index)}, nil
+}
 
-	end := 0
-	for i := 0; i < n; i++ {
-		if buffer[i] == '\n' {
-			end = i
-			break
+// loadBlock 加载第 i 个 data block，越界时迭代器变为无效
+func (it *Iterator) loadBlock(i int) bool {
+	it.block = i
+	it.iter = nil
+	if i < 0 || i >= len(it.index) || it.err != nil {
+		return false
+	}
+	b, err := it.table.readDataBlock(it.index[i].handle)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.iter = b.iterator(it.cmp)
+	return true
+}
+
+// checkBlock 记录 block 内解码遇到的错误
+func (it *Iterator) checkBlock() {
+	if it.iter != nil && it.iter.err != nil && it.err == nil {
+		it.err = fmt.Errorf("%w at offset %d", it.iter.err, it.index[it.block].handle.offset)
+	}
+}
+
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.iter != nil && it.iter.valid()
+}
+
+func (it *Iterator) Key() []byte {
+	return it.iter.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.iter.value
+}
+
+func (it *Iterator) Deleted() bool {
+	return it.iter.deleted
+}
+
+func (it *Iterator) SeekToFirst() {
+	if it.loadBlock(0) {
+		it.iter.seekToFirst()
+	}
+	it.skipForward()
+}
+
+func (it *Iterator) SeekToLast() {
+	if it.loadBlock(len(it.index) - 1) {
+		it.iter.seekToLast()
+	}
+	it.skipBackward()
+}
+
+// Seek 定位到第一个键大于等于 key 的记录
+func (it *Iterator) Seek(key []byte) {
+	if it.loadBlock(findBlock(it.cmp, it.index, key)) {
+		it.iter.seek(key)
+	}
+	it.skipForward()
+}
+
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	it.iter.parseNext()
+	it.skipForward()
+}
+
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	it.iter.prev()
+	it.skipBackward()
+}
+
+// skipForward 在当前 block 读完后移动到下一个 block 的开头
+func (it *Iterator) skipForward() {
+	for it.checkBlock(); it.iter != nil && !it.iter.valid() && it.err == nil; it.checkBlock() {
+		if !it.loadBlock(it.block + 1) {
+			return
 		}
+		it.iter.seekToFirst()
 	}
+}
 
-	var entry Entry
-	if err := entry.UnmarshalJSON(buffer[:end]); err != nil {
-		return "", false
+// skipBackward 在当前 block 读完后移动到上一个 block 的结尾
+func (it *Iterator) skipBackward() {
+	for it.checkBlock(); it.iter != nil && !it.iter.valid() && it.err == nil; it.checkBlock() {
+		if !it.loadBlock(it.block - 1) {
+			return
+		}
+		it.iter.seekToLast()
 	}
-	return entry.Value, true
 }
 
-func (lsm *SSTable) GetFilePath() string {
-	return lsm.filepath
+// Close 返回遍历过程中遇到的错误，文件句柄属于 SSTable，不在这里关闭
+func (it *Iterator) Close() error {
+	it.iter = nil
+	return it.err
 }
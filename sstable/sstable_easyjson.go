@@ -1,151 +0,0 @@
-// Code generated by easyjson for marshaling/unmarshaling. DO NOT EDIT.
-
-package sstable
-
-import (
-	json "encoding/json"
-	easyjson "github.com/mailru/easyjson"
-	jlexer "github.com/mailru/easyjson/jlexer"
-	jwriter "github.com/mailru/easyjson/jwriter"
-)
-
-// suppress unused package warning
-var (
-	_ *json.RawMessage
-	_ *jlexer.Lexer
-	_ *jwriter.Writer
-	_ easyjson.Marshaler
-)
-
-func easyjsonB9ef6d18DecodeSrcLsmTreeSstable(in *jlexer.Lexer, out *SSTable) {
-	isTopLevel := in.IsStart()
-	if in.IsNull() {
-		if isTopLevel {
-			in.Consumed()
-		}
-		in.Skip()
-		return
-	}
-	in.Delim('{')
-	for !in.IsDelim('}') {
-		key := in.UnsafeFieldName(false)
-		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
-		switch key {
-		default:
-			in.SkipRecursive()
-		}
-		in.WantComma()
-	}
-	in.Delim('}')
-	if isTopLevel {
-		in.Consumed()
-	}
-}
-func easyjsonB9ef6d18EncodeSrcLsmTreeSstable(out *jwriter.Writer, in SSTable) {
-	out.RawByte('{')
-	first := true
-	_ = first
-	out.RawByte('}')
-}
-
-// MarshalJSON supports json.Marshaler interface
-func (v SSTable) MarshalJSON() ([]byte, error) {
-	w := jwriter.Writer{}
-	easyjsonB9ef6d18EncodeSrcLsmTreeSstable(&w, v)
-	return w.Buffer.BuildBytes(), w.Error
-}
-
-// MarshalEasyJSON supports easyjson.Marshaler interface
-func (v SSTable) MarshalEasyJSON(w *jwriter.Writer) {
-	easyjsonB9ef6d18EncodeSrcLsmTreeSstable(w, v)
-}
-
-// UnmarshalJSON supports json.Unmarshaler interface
-func (v *SSTable) UnmarshalJSON(data []byte) error {
-	r := jlexer.Lexer{Data: data}
-	easyjsonB9ef6d18DecodeSrcLsmTreeSstable(&r, v)
-	return r.Error()
-}
-
-// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
-func (v *SSTable) UnmarshalEasyJSON(l *jlexer.Lexer) {
-	easyjsonB9ef6d18DecodeSrcLsmTreeSstable(l, v)
-}
-func easyjsonB9ef6d18DecodeSrcLsmTreeSstable1(in *jlexer.Lexer, out *Entry) {
-	isTopLevel := in.IsStart()
-	if in.IsNull() {
-		if isTopLevel {
-			in.Consumed()
-		}
-		in.Skip()
-		return
-	}
-	in.Delim('{')
-	for !in.IsDelim('}') {
-		key := in.UnsafeFieldName(false)
-		in.WantColon()
-		if in.IsNull() {
-			in.Skip()
-			in.WantComma()
-			continue
-		}
-		switch key {
-		case "key":
-			out.Key = string(in.String())
-		case "value":
-			out.Value = string(in.String())
-		default:
-			in.SkipRecursive()
-		}
-		in.WantComma()
-	}
-	in.Delim('}')
-	if isTopLevel {
-		in.Consumed()
-	}
-}
-func easyjsonB9ef6d18EncodeSrcLsmTreeSstable1(out *jwriter.Writer, in Entry) {
-	out.RawByte('{')
-	first := true
-	_ = first
-	{
-		const prefix string = ",\"key\":"
-		out.RawString(prefix[1:])
-		out.String(string(in.Key))
-	}
-	{
-		const prefix string = ",\"value\":"
-		out.RawString(prefix)
-		out.String(string(in.Value))
-	}
-	out.RawByte('}')
-}
-
-// MarshalJSON supports json.Marshaler interface
-func (v Entry) MarshalJSON() ([]byte, error) {
-	w := jwriter.Writer{}
-	easyjsonB9ef6d18EncodeSrcLsmTreeSstable1(&w, v)
-	return w.Buffer.BuildBytes(), w.Error
-}
-
-// MarshalEasyJSON supports easyjson.Marshaler interface
-func (v Entry) MarshalEasyJSON(w *jwriter.Writer) {
-	easyjsonB9ef6d18EncodeSrcLsmTreeSstable1(w, v)
-}
-
-// UnmarshalJSON supports json.Unmarshaler interface
-func (v *Entry) UnmarshalJSON(data []byte) error {
-	r := jlexer.Lexer{Data: data}
-	easyjsonB9ef6d18DecodeSrcLsmTreeSstable1(&r, v)
-	return r.Error()
-}
-
-// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
-func (v *Entry) UnmarshalEasyJSON(l *jlexer.Lexer) {
-	easyjsonB9ef6d18DecodeSrcLsmTreeSstable1(l, v)
-}
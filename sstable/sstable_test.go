@@ -1,10 +1,16 @@
 package sstable
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+
+	"LSMTree/cache"
 )
 
 func TestBloomFilterPersistence(t *testing.T) {
@@ -182,6 +188,341 @@ func TestBloomFilterFalsePositiveRate(t *testing.T) {
 	}
 }
 
+func TestBlockFormat(t *testing.T) {
+	filepath := t.TempDir() + "/test_sstable.sst"
+
+	// 足够多的记录以产生多个 data block，其中包含墓碑和超过 1KB 的值
+	var entries []Entry
+	for i := 0; i < 2000; i++ {
+		entry := Entry{Key: []byte(fmt.Sprintf("key%05d", i)), Value: []byte(fmt.Sprintf("value%d", i))}
+		if i%7 == 0 {
+			entry.Value = nil
+			entry.Deleted = true
+		}
+		if i == 100 {
+			entry.Value = []byte(strings.Repeat("x", 5000))
+		}
+		entries = append(entries, entry)
+	}
+	expected := append([]Entry(nil), entries...)
+
+	sst := NewSSTable(filepath)
+	if err := sst.WriteEntries(entries); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	// 重新打开后只加载索引和过滤器
+	sst2, err := OpenSSTable(filepath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	props := sst2.Properties()
+	if props.NumEntries != int64(len(expected)) || props.NumDataBlocks < 2 {
+		t.Fatalf("Unexpected properties: %+v", props)
+	}
+	if !bytes.Equal(props.SmallestKey, expected[0].Key) || !bytes.Equal(props.LargestKey, expected[len(expected)-1].Key) {
+		t.Errorf("Unexpected key range: %q - %q", props.SmallestKey, props.LargestKey)
+	}
+
+	for _, e := range expected {
+		value, deleted, ok := sst2.Get(e.Key)
+		if !ok || !bytes.Equal(value, e.Value) || deleted != e.Deleted {
+			t.Fatalf("Get(%q) = value of length %d, deleted %v, found %v", e.Key, len(value), deleted, ok)
+		}
+	}
+	if _, _, ok := sst2.Get([]byte("key99999")); ok {
+		t.Error("Found non-existent key 'key99999'")
+	}
+
+	it, err := sst2.NewIterator()
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !bytes.Equal(it.Key(), expected[i].Key) || !bytes.Equal(it.Value(), expected[i].Value) || it.Deleted() != expected[i].Deleted {
+			t.Fatalf("Iterator entry %d mismatch: %q", i, it.Key())
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("Iterated %d entries, expected %d", i, len(expected))
+	}
+	i = len(expected) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if !bytes.Equal(it.Key(), expected[i].Key) {
+			t.Fatalf("Reverse iterator entry %d mismatch: %q", i, it.Key())
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("Reverse iteration stopped at %d", i)
+	}
+	it.Seek([]byte("key01000a"))
+	if !it.Valid() || string(it.Key()) != "key01001" {
+		t.Errorf("Seek landed on wrong key")
+	}
+	if err := it.Close(); err != nil {
+		t.Errorf("Iterator error: %v", err)
+	}
+
+	// 破坏第一个 data block，校验应当失败
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	data[10] ^= 0xff
+	if err := os.WriteFile(filepath, data, 0644); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+	if _, _, ok := sst2.Get(expected[1].Key); ok {
+		t.Error("Get returned data from a corrupted block")
+	}
+	it, err = sst2.NewIterator()
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+	}
+	if err := it.Close(); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	filepath := t.TempDir() + "/test_sstable.sst"
+	var entries []Entry
+	for i := 0; i < 2000; i++ {
+		entries = append(entries, Entry{Key: []byte(fmt.Sprintf("key%05d", i)), Value: []byte(fmt.Sprintf("value%d", i))})
+	}
+	sst := NewSSTable(filepath)
+	if err := sst.WriteEntries(entries); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	for _, pin := range []bool{false, true} {
+		c := cache.New(1<<20, cache.LRU)
+		opts := &Options{BlockCache: c, PinIndexAndFilter: pin, CacheID: 7}
+		sst, err := OpenSSTable(filepath, opts)
+		if err != nil {
+			t.Fatalf("Failed to open SSTable: %v", err)
+		}
+		for round := 0; round < 2; round++ {
+			for _, e := range entries {
+				if value, _, ok := sst.Get(e.Key); !ok || !bytes.Equal(value, e.Value) {
+					t.Fatalf("Get(%q) = %q, %v", e.Key, value, ok)
+				}
+			}
+		}
+		// 第一轮每个 data block 只会未命中一次，之后全部命中
+		stats := c.Stats()
+		blocks := uint64(sst.Properties().NumDataBlocks)
+		if stats.Misses != blocks {
+			t.Errorf("pin=%v: %d misses, expected %d", pin, stats.Misses, blocks)
+		}
+		if stats.Usage <= 0 || stats.Usage > stats.Capacity {
+			t.Errorf("pin=%v: usage %d, capacity %d", pin, stats.Usage, stats.Capacity)
+		}
+
+		// 用同一个 CacheID 重新打开，之前缓存的 data block 仍然命中
+		sst.Close()
+		sst, err = OpenSSTable(filepath, opts)
+		if err != nil {
+			t.Fatalf("Failed to reopen SSTable: %v", err)
+		}
+		for _, e := range entries {
+			if value, _, ok := sst.Get(e.Key); !ok || !bytes.Equal(value, e.Value) {
+				t.Fatalf("Get(%q) after reopen = %q, %v", e.Key, value, ok)
+			}
+		}
+		if misses := c.Stats().Misses; misses != blocks {
+			t.Errorf("pin=%v: %d misses after reopen, expected %d", pin, misses, blocks)
+		}
+		sst.Close()
+
+		// 容量很小时 data block 被淘汰，固定的 index 和 filter 保留
+		small := cache.New(1, cache.CLOCK)
+		sst, err = OpenSSTable(filepath, &Options{BlockCache: small, PinIndexAndFilter: pin})
+		if err != nil {
+			t.Fatalf("Failed to open SSTable: %v", err)
+		}
+		for _, e := range entries[:100] {
+			if value, _, ok := sst.Get(e.Key); !ok || !bytes.Equal(value, e.Value) {
+				t.Fatalf("Get(%q) with a tiny cache = %q, %v", e.Key, value, ok)
+			}
+		}
+		if usage := small.Stats().Usage; pin != (usage > 0) {
+			t.Errorf("pin=%v: usage %d of a tiny cache", pin, usage)
+		}
+		sst.Close()
+		if usage := small.Stats().Usage; usage != 0 {
+			t.Errorf("pin=%v: usage %d after Close", pin, usage)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var entries []Entry
+	for i := 0; i < 1000; i++ {
+		value := fmt.Sprintf(`{"id":%d,"name":"user-%d","tags":["alpha","beta","gamma"],"active":true}`, i, i)
+		entries = append(entries, Entry{Key: []byte(fmt.Sprintf("key%05d", i)), Value: []byte(value)})
+	}
+
+	for _, codec := range []Codec{NoCompression, FlateCompression, ZlibCompression, GzipCompression} {
+		filepath := t.TempDir() + "/test_sstable.sst"
+		w, err := NewWriter(filepath, &Options{Compression: Compression{Codec: codec, Level: 9}})
+		if err != nil {
+			t.Fatalf("%v: failed to create writer: %v", codec, err)
+		}
+		for _, e := range entries {
+			if err := w.Add(e); err != nil {
+				t.Fatalf("%v: failed to add: %v", codec, err)
+			}
+		}
+		if _, err := w.Finish(); err != nil {
+			t.Fatalf("%v: failed to finish: %v", codec, err)
+		}
+
+		sst, err := OpenSSTable(filepath, &Options{BlockCache: cache.New(1<<20, cache.LRU)})
+		if err != nil {
+			t.Fatalf("%v: failed to open: %v", codec, err)
+		}
+		props := sst.Properties()
+		if props.Compression != codec.String() {
+			t.Errorf("%v: Compression property = %q", codec, props.Compression)
+		}
+		if codec == NoCompression && props.DataSize != props.UncompressedDataSize+props.NumDataBlocks*trailerSize {
+			t.Errorf("%v: data size %d, uncompressed %d", codec, props.DataSize, props.UncompressedDataSize)
+		}
+		if codec != NoCompression && props.DataSize*2 > props.UncompressedDataSize {
+			t.Errorf("%v: data size %d is not much smaller than uncompressed %d", codec, props.DataSize, props.UncompressedDataSize)
+		}
+		for round := 0; round < 2; round++ {
+			for _, e := range entries {
+				if value, _, ok := sst.Get(e.Key); !ok || !bytes.Equal(value, e.Value) {
+					t.Fatalf("%v: Get(%q) = %q, %v", codec, e.Key, value, ok)
+				}
+			}
+		}
+		sst.Close()
+	}
+
+	if _, err := NewWriter(t.TempDir()+"/bad.sst", &Options{Compression: Compression{Codec: 42}}); err == nil {
+		t.Errorf("NewWriter accepted an unknown codec")
+	}
+}
+
+func TestPrefixCompression(t *testing.T) {
+	var entries []Entry
+	for i := 0; i < 3000; i++ {
+		entry := Entry{Key: []byte(fmt.Sprintf("tenant/%04d/orders/%08d", i/100, i)), Value: []byte(strconv.Itoa(i))}
+		if i%11 == 0 {
+			entry.Value = nil
+			entry.Deleted = true
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, interval := range []int{1, 2, 16, 1000} {
+		filepath := t.TempDir() + "/test_sstable.sst"
+		w, err := NewWriter(filepath, &Options{BlockRestartInterval: interval})
+		if err != nil {
+			t.Fatalf("interval %d: failed to create writer: %v", interval, err)
+		}
+		for _, e := range entries {
+			if err := w.Add(e); err != nil {
+				t.Fatalf("interval %d: failed to add: %v", interval, err)
+			}
+		}
+		sst, err := w.Finish()
+		if err != nil {
+			t.Fatalf("interval %d: failed to finish: %v", interval, err)
+		}
+		props := sst.Properties()
+		if interval > 1 && props.UncompressedDataSize >= props.RawKeySize {
+			t.Errorf("interval %d: data size %d, raw key size %d", interval, props.UncompressedDataSize, props.RawKeySize)
+		}
+
+		for _, e := range entries {
+			value, deleted, ok := sst.Get(e.Key)
+			if !ok || !bytes.Equal(value, e.Value) || deleted != e.Deleted {
+				t.Fatalf("interval %d: Get(%q) = %q, %v, %v", interval, e.Key, value, deleted, ok)
+			}
+		}
+		for _, key := range []string{"tenant/0000/orders", "tenant/0005/orders/00000550a", "tenant/0029/orders/00002999a", "tenant/0030"} {
+			if _, _, ok := sst.Get([]byte(key)); ok {
+				t.Errorf("interval %d: found non-existent key %q", interval, key)
+			}
+		}
+
+		it, err := sst.NewIterator()
+		if err != nil {
+			t.Fatalf("interval %d: failed to create iterator: %v", interval, err)
+		}
+		i := len(entries) - 1
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			if !bytes.Equal(it.Key(), entries[i].Key) || !bytes.Equal(it.Value(), entries[i].Value) {
+				t.Fatalf("interval %d: reverse entry %d = %q", interval, i, it.Key())
+			}
+			i--
+		}
+		if i != -1 {
+			t.Fatalf("interval %d: reverse iteration stopped at %d", interval, i)
+		}
+		for _, j := range []int{0, 1, 15, 16, 17, 999, 2999} {
+			// 定位到一个不存在的键，应当落在它后面的第一条记录上
+			target := []byte("tenant/")
+			if j > 0 {
+				target = append(append([]byte(nil), entries[j-1].Key...), 0)
+			}
+			it.Seek(target)
+			if !it.Valid() || !bytes.Equal(it.Key(), entries[j].Key) {
+				t.Fatalf("interval %d: Seek before entry %d landed on %q", interval, j, it.Key())
+			}
+			it.Prev()
+			if j == 0 && it.Valid() || j > 0 && (!it.Valid() || !bytes.Equal(it.Key(), entries[j-1].Key)) {
+				t.Fatalf("interval %d: Prev from entry %d landed on %q", interval, j, it.Key())
+			}
+		}
+		it.Seek([]byte("tenant/9999"))
+		if it.Valid() {
+			t.Errorf("interval %d: Seek past the last key is valid", interval)
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("interval %d: iterator error: %v", interval, err)
+		}
+		sst.Close()
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	for _, interval := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("restart-%d", interval), func(b *testing.B) {
+			filepath := b.TempDir() + "/bench.sst"
+			w, err := NewWriter(filepath, &Options{BlockRestartInterval: interval, BlockCache: cache.New(64<<20, cache.LRU)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			const n = 100000
+			for i := 0; i < n; i++ {
+				w.Add(Entry{Key: []byte(fmt.Sprintf("tenant/%04d/orders/%08d", i/1000, i)), Value: []byte("v")})
+			}
+			sst, err := w.Finish()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sst.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := i * 7919 % n
+				if _, _, ok := sst.Get([]byte(fmt.Sprintf("tenant/%04d/orders/%08d", j/1000, j))); !ok {
+					b.Fatalf("key %d not found", j)
+				}
+			}
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	// 运行测试
 	code := m.Run()
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"LSMTree/lsm"
+)
+
+// 超过这个时间没有请求的事务会被回滚，避免客户端断开后快照一直占用
+const txnIdleTimeout = 5 * time.Minute
+
+// txnRegistry 保存 HTTP 客户端开启的事务。同一个事务的请求可能并发到达，
+// 每个事务带一把锁，处理请求时持有
+type txnRegistry struct {
+	tree   *lsm.LSMTree
+	mutex  sync.Mutex
+	nextID uint64
+	txns   map[string]*txnEntry
+}
+
+type txnEntry struct {
+	sync.Mutex
+	txn      *lsm.Transaction
+	lastUsed time.Time
+}
+
+func newTxnRegistry(tree *lsm.LSMTree) *txnRegistry {
+	r := &txnRegistry{tree: tree, txns: make(map[string]*txnEntry)}
+	go r.expireLoop()
+	return r
+}
+
+func (r *txnRegistry) begin(opts *lsm.TransactionOptions) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nextID++
+	id := strconv.FormatUint(r.nextID, 10)
+	r.txns[id] = &txnEntry{txn: r.tree.BeginTransactionWithOptions(opts), lastUsed: time.Now()}
+	return id
+}
+
+func (r *txnRegistry) get(id string) (*txnEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.txns[id]
+	if ok {
+		t.lastUsed = time.Now()
+	}
+	return t, ok
+}
+
+// remove 在提交或回滚前把事务移出注册表，之后的请求返回 404
+func (r *txnRegistry) remove(id string) (*txnEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t, ok := r.txns[id]
+	delete(r.txns, id)
+	return t, ok
+}
+
+func (r *txnRegistry) expireLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*txnEntry
+		r.mutex.Lock()
+		for id, t := range r.txns {
+			if time.Since(t.lastUsed) > txnIdleTimeout {
+				expired = append(expired, t)
+				delete(r.txns, id)
+			}
+		}
+		r.mutex.Unlock()
+		for _, t := range expired {
+			t.Lock()
+			t.txn.Rollback()
+			t.Unlock()
+		}
+	}
+}
+
+// txnErrorStatus 把可以通过重试解决的事务错误映射为 409
+func txnErrorStatus(err error) int {
+	var deadlock *lsm.DeadlockError
+	if errors.Is(err, lsm.ErrConflict) || errors.Is(err, lsm.ErrLockTimeout) || errors.As(err, &deadlock) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
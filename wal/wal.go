@@ -1,76 +1,608 @@
 package wal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-//easyjson:json
+// 每条记录的格式：
+//
+//	| header crc32c (4) | length (4) | type (1) | crc32c (4) | payload (length) |
+//
+// header crc 覆盖 length 和 type，crc 覆盖 payload，length 为 payload 长度，均为小端序。
+// length 有单独的校验，损坏的 length 不会被误认为写到一半的尾部
+const headerSize = 13
+
+const (
+	recordEntry byte = 1
+	recordData  byte = 2
+	// recordBatch 的 payload 为 seq (8) | count (uvarint) | count 条记录，
+	// 第 i 条记录的序列号为 seq+i，整批要么全部回放要么全部丢弃
+	recordBatch byte = 3
+	// recordTimedBatch 在 recordBatch 的 payload 前加上写入时间 (8)，单位纳秒，
+	// 按时间点恢复时据此决定回放到哪里
+	recordTimedBatch byte = 4
+)
+
+const (
+	kindPut    byte = 0
+	kindDelete byte = 1
+	// kindPutTTL 在 key 之前多一个过期时间 (8)，单位纳秒
+	kindPutTTL byte = 2
+	kindMerge  byte = 3
+	// kindFamilyFlag 置位时 kind 之后紧跟列族编号 (uvarint)，没有置位的记录属于默认列族 0
+	kindFamilyFlag byte = 0x80
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Entry 是日志中的一条记录，Seq 只对批量写入的记录有意义，单条写入的记录为 0。
+// ExpiresAt 不为 0 时是写入的过期时间（Unix 纳秒）；Merge 为真时 Value 是 merge 操作数。
+// Family 是记录所属的列族
 type Entry struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       []byte
+	Value     []byte
+	Deleted   bool
+	Merge     bool
+	Seq       uint64
+	ExpiresAt int64
+	Family    uint32
+}
+
+// CorruptionError 表示日志中间（而不是尾部）的记录损坏
+type CorruptionError struct {
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("wal: corrupted record at offset %d: %s", e.Offset, e.Reason)
 }
 
+// SyncMode 决定写入之后什么时候调用 fsync
+type SyncMode int
+
+const (
+	// SyncEveryWrite 在每次写入返回前落盘，并发的写入共享一次 fsync
+	SyncEveryWrite SyncMode = iota
+	// SyncInterval 由后台每隔 Options.SyncInterval 落盘一次
+	SyncInterval
+	// SyncBytes 在未落盘的数据达到 Options.SyncBytes 时落盘
+	SyncBytes
+	// SyncNever 从不主动 fsync，由操作系统决定何时写回
+	SyncNever
+)
+
+// Options 控制 WAL 的落盘策略，nil 表示 SyncEveryWrite。
+// 除 SyncEveryWrite 外，进程崩溃不会丢数据，但机器掉电可能丢失最近尚未落盘的写入
+type Options struct {
+	SyncMode SyncMode
+	// SyncInterval 是 SyncInterval 模式的落盘间隔，默认 100ms
+	SyncInterval time.Duration
+	// SyncBytes 是 SyncBytes 模式下触发落盘的未同步字节数，默认 1MB
+	SyncBytes int64
+}
+
+const (
+	defaultSyncInterval = 100 * time.Millisecond
+	defaultSyncBytes    = 1 << 20
+)
+
+// WAL 的写入在 mutex 内追加到文件，fsync 在 mutex 外进行：同一时刻只有一个写入者
+// 持有 syncMutex 执行 fsync，它会把开始时已经追加的所有记录一起落盘，
+// 在它之后排队的写入者发现自己的记录已经落盘时直接返回，这就是组提交
 type WAL struct {
-	file  *os.File
-	mutex sync.Mutex
+	file      *os.File
+	opts      Options
+	mutex     sync.Mutex
+	syncMutex sync.Mutex
+	// base 是打开时文件已有的字节数，written 是之后追加的字节数，synced 是其中已经落盘的部分
+	base    int64
+	written int64
+	synced  atomic.Int64
+	// err 不为空时文件尾部可能留有写了一半的记录，之后的写入都返回该错误
+	err       error
+	closeChan chan struct{}
+	wg        sync.WaitGroup
+	// closeOnce 保证重复调用 Close 只关闭一次，之后返回第一次的结果
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func NewWAL(filename string) (*WAL, error) {
-	if file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+	return NewWALWithOptions(filename, nil)
+}
+
+func NewWALWithOptions(filename string, opts *Options) (*WAL, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
 		return nil, err
-	} else {
-		return &WAL{file: file}, nil
 	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &WAL{file: file, base: info.Size(), closeChan: make(chan struct{})}
+	if opts != nil {
+		w.opts = *opts
+	}
+	if w.opts.SyncInterval <= 0 {
+		w.opts.SyncInterval = defaultSyncInterval
+	}
+	if w.opts.SyncBytes <= 0 {
+		w.opts.SyncBytes = defaultSyncBytes
+	}
+	if w.opts.SyncMode == SyncInterval {
+		w.wg.Add(1)
+		go w.syncWorker()
+	}
+	return w, nil
 }
 
-func (w *WAL) Write(key, value string) error {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
+func (w *WAL) Write(key, value []byte) error {
+	return w.append(Entry{Key: key, Value: value})
+}
+
+// Delete 记录一条墓碑
+func (w *WAL) Delete(key []byte) error {
+	return w.append(Entry{Key: key, Deleted: true})
+}
+
+// Batch 是一次批量写入，Time 是写入时间，旧格式的记录没有时间
+type Batch struct {
+	Seq     uint64
+	Time    time.Time
+	Entries []Entry
+}
 
-	entry := Entry{
-		Key:   key,
-		Value: value,
+// WriteBatch 把多条记录编码为一条日志记录写入，seq 是第一条记录的序列号
+func (w *WAL) WriteBatch(seq uint64, entries []Entry) error {
+	return w.AppendBatch(Batch{Seq: seq, Time: time.Now(), Entries: entries})
+}
+
+// AppendBatch 与 WriteBatch 相同，但保留 batch 中原来的写入时间
+func (w *WAL) AppendBatch(batch Batch) error {
+	payload := binary.LittleEndian.AppendUint64(nil, uint64(batch.Time.UnixNano()))
+	payload = binary.LittleEndian.AppendUint64(payload, batch.Seq)
+	payload = binary.AppendUvarint(payload, uint64(len(batch.Entries)))
+	for _, entry := range batch.Entries {
+		payload = appendEntry(payload, entry)
 	}
+	return w.write(recordTimedBatch, payload)
+}
+
+func (w *WAL) append(entry Entry) error {
+	return w.write(recordEntry, appendEntry(nil, entry))
+}
 
-	data, err := entry.MarshalJSON()
+func (w *WAL) write(typ byte, payload []byte) error {
+	w.mutex.Lock()
+	if w.err != nil {
+		err := w.err
+		w.mutex.Unlock()
+		return err
+	}
+	// 整条记录一次写入，崩溃时最多留下一个不完整的尾部
+	n, err := w.file.Write(encodeRecord(typ, payload))
 	if err != nil {
+		// 写入失败时截掉写了一半的记录，之后的记录才能接在完整的记录后面；
+		// 截断也失败时不再追加，否则恢复时会在日志中间遇到损坏的记录
+		if n > 0 {
+			if truncErr := w.file.Truncate(w.base + w.written); truncErr != nil {
+				w.err = fmt.Errorf("wal: failed to discard partial record after write error %v: %w", err, truncErr)
+			}
+		}
+		w.mutex.Unlock()
 		return err
 	}
+	w.written += int64(n)
+	end := w.written
+	w.mutex.Unlock()
+
+	switch w.opts.SyncMode {
+	case SyncEveryWrite:
+		return w.syncTo(end)
+	case SyncBytes:
+		if end-w.synced.Load() >= w.opts.SyncBytes {
+			return w.syncTo(end)
+		}
+	}
+	return nil
+}
+
+// Size 返回本次打开之后追加的字节数
+func (w *WAL) Size() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.written
+}
+
+// Sync 把目前为止追加的所有记录落盘，与 SyncMode 无关
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	end := w.written
+	w.mutex.Unlock()
+	return w.syncTo(end)
+}
 
-	if _, err := w.file.Write(append(data, '\n')); err != nil {
+// syncTo 保证前 end 个字节已经落盘。fsync 覆盖开始时已经追加的全部数据，
+// 等待 syncMutex 期间别人的 fsync 可能已经包含了这部分
+func (w *WAL) syncTo(end int64) error {
+	w.syncMutex.Lock()
+	defer w.syncMutex.Unlock()
+	if w.synced.Load() >= end {
+		return nil
+	}
+	w.mutex.Lock()
+	written := w.written
+	w.mutex.Unlock()
+	if err := w.file.Sync(); err != nil {
 		return err
 	}
-	return w.file.Sync()
+	w.synced.Store(written)
+	return nil
 }
 
+// syncWorker 在 SyncInterval 模式下定期落盘
+func (w *WAL) syncWorker() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Printf("Failed to sync WAL: %v", err)
+			}
+		case <-w.closeChan:
+			return
+		}
+	}
+}
+
+// Close 关闭前把尚未落盘的记录落盘，SyncNever 模式除外，可以重复调用
 func (w *WAL) Close() error {
+	w.closeOnce.Do(func() {
+		w.closeErr = w.close()
+	})
+	return w.closeErr
+}
+
+func (w *WAL) close() error {
+	close(w.closeChan)
+	w.wg.Wait()
+	var err error
+	if w.opts.SyncMode != SyncNever {
+		err = w.Sync()
+	}
+	w.syncMutex.Lock()
+	defer w.syncMutex.Unlock()
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
-	return w.file.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func encodeRecord(typ byte, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	buf[8] = typ
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:9], crcTable))
+	binary.LittleEndian.PutUint32(buf[9:13], crc32.Checksum(payload, crcTable))
+	copy(buf[headerSize:], payload)
+	return buf
 }
 
-func RecoverWAL(filename string) (map[string]string, error) {
-	file, err := os.Open(filename)
+func appendEntry(buf []byte, entry Entry) []byte {
+	kind := kindPut
+	switch {
+	case entry.Deleted:
+		kind = kindDelete
+	case entry.Merge:
+		kind = kindMerge
+	case entry.ExpiresAt != 0:
+		kind = kindPutTTL
+	}
+	if entry.Family != 0 {
+		buf = append(buf, kind|kindFamilyFlag)
+		buf = binary.AppendUvarint(buf, uint64(entry.Family))
+	} else {
+		buf = append(buf, kind)
+	}
+	if kind == kindPutTTL {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.ExpiresAt))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Key)))
+	buf = append(buf, entry.Key...)
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Value)))
+	buf = append(buf, entry.Value...)
+	return buf
+}
+
+var errBadEntry = errors.New("malformed entry")
+
+// decodeEntry 解码 payload 开头的一条记录，返回剩余部分
+func decodeEntry(payload []byte) (Entry, []byte, error) {
+	if len(payload) < 1 {
+		return Entry{}, nil, errBadEntry
+	}
+	var entry Entry
+	kind, rest := payload[0], payload[1:]
+	if kind&kindFamilyFlag != 0 {
+		family, n := binary.Uvarint(rest)
+		if n <= 0 || family > math.MaxUint32 {
+			return Entry{}, nil, errBadEntry
+		}
+		entry.Family = uint32(family)
+		kind, rest = kind&^kindFamilyFlag, rest[n:]
+	}
+	switch kind {
+	case kindPut:
+	case kindDelete:
+		entry.Deleted = true
+	case kindMerge:
+		entry.Merge = true
+	case kindPutTTL:
+		if len(rest) < 8 {
+			return Entry{}, nil, errBadEntry
+		}
+		entry.ExpiresAt = int64(binary.LittleEndian.Uint64(rest))
+		rest = rest[8:]
+	default:
+		return Entry{}, nil, errBadEntry
+	}
+	key, rest, ok := readBytes(rest)
+	if !ok {
+		return Entry{}, nil, errBadEntry
+	}
+	value, rest, ok := readBytes(rest)
+	if !ok {
+		return Entry{}, nil, errBadEntry
+	}
+	entry.Key = key
+	entry.Value = value
+	return entry, rest, nil
+}
+
+func decodeTimedBatch(payload []byte) (time.Time, []Entry, error) {
+	if len(payload) < 8 {
+		return time.Time{}, nil, errBadEntry
+	}
+	entries, err := decodeBatch(payload[8:])
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(payload))), entries, nil
+}
+
+func decodeBatch(payload []byte) ([]Entry, error) {
+	if len(payload) < 8 {
+		return nil, errBadEntry
+	}
+	seq := binary.LittleEndian.Uint64(payload)
+	count, n := binary.Uvarint(payload[8:])
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, errBadEntry
+	}
+	rest := payload[8+n:]
+	entries := make([]Entry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		entry, r, err := decodeEntry(rest)
+		if err != nil {
+			return nil, err
+		}
+		entry.Seq = seq + i
+		entries = append(entries, entry)
+		rest = r
+	}
+	if len(rest) != 0 {
+		return nil, errBadEntry
+	}
+	return entries, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || uint64(len(buf)-size) < n {
+		return nil, nil, false
+	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], true
+}
+
+// RecoverWAL 按写入顺序返回日志中的记录，墓碑也需要回放，批量记录展开为多条。
+// 写到一半的尾部记录会被截断；尾部之前的记录损坏时返回 *CorruptionError
+func RecoverWAL(filename string) ([]Entry, error) {
+	batches, err := readBatches(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	var result []Entry
+	for _, batch := range batches {
+		result = append(result, batch.Entries...)
+	}
+	return result, nil
+}
+
+// RecoverLegacyWAL 读取旧版本的 wal.log：每行一个 {"key":...,"value":...} 形式的 JSON 对象。
+// 旧版本每行写完之后落盘，最后一行不完整时视为写到一半被打断；其他行无法解析时返回 *CorruptionError。
+// 文件只用于升级时回放一次，因此不会被截断
+func RecoverLegacyWAL(filename string) ([]Entry, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return make(map[string]string), nil
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []Entry
+	offset := 0
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			break
+		}
+		line := data[offset : offset+end]
+		var record struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, &CorruptionError{Offset: int64(offset), Reason: err.Error()}
+		}
+		result = append(result, Entry{Key: []byte(record.Key), Value: []byte(record.Value)})
+		offset += end + 1
+	}
+	return result, nil
+}
+
+// ReadBatches 按写入顺序返回日志中的批次，单条写入的记录作为只有一条记录、没有序列号的批次返回。
+// 与 RecoverWAL 不同，它不修改文件，可以读取正在写入的段，不完整的尾部被忽略
+func ReadBatches(filename string) ([]Batch, error) {
+	return readBatches(filename, false)
+}
+
+func readBatches(filename string, truncate bool) ([]Batch, error) {
+	var result []Batch
+	err := readRecords(filename, truncate, func(offset int64, typ byte, payload []byte) error {
+		var batch Batch
+		var err error
+		switch typ {
+		case recordEntry:
+			var entry Entry
+			var rest []byte
+			entry, rest, err = decodeEntry(payload)
+			if err == nil && len(rest) != 0 {
+				err = errBadEntry
+			}
+			batch.Entries = []Entry{entry}
+		case recordBatch:
+			batch.Entries, err = decodeBatch(payload)
+		case recordTimedBatch:
+			batch.Time, batch.Entries, err = decodeTimedBatch(payload)
+		default:
+			return &CorruptionError{Offset: offset, Reason: fmt.Sprintf("unknown record type %d", typ)}
+		}
+		if err != nil {
+			return &CorruptionError{Offset: offset, Reason: err.Error()}
+		}
+		if len(batch.Entries) > 0 {
+			batch.Seq = batch.Entries[0].Seq
+		}
+		result = append(result, batch)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// EncodeRecord 把任意 payload 编码为一条带校验的记录，MANIFEST 复用这一格式
+func EncodeRecord(payload []byte) []byte {
+	return encodeRecord(recordData, payload)
+}
+
+// ReadRecords 读出 EncodeRecord 写入的所有 payload，尾部处理与 RecoverWAL 相同
+func ReadRecords(filename string) ([][]byte, error) {
+	var result [][]byte
+	err := readRecords(filename, true, func(offset int64, typ byte, payload []byte) error {
+		if typ != recordData {
+			return &CorruptionError{Offset: offset, Reason: fmt.Sprintf("unknown record type %d", typ)}
 		}
+		result = append(result, payload)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
+
+// readRecords 依次处理文件中的记录，truncate 为真时截掉不完整的尾部
+func readRecords(filename string, truncate bool, fn func(offset int64, typ byte, payload []byte) error) error {
+	flag := os.O_RDONLY
+	if truncate {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(filename, flag, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
 	defer file.Close()
 
-	result := make(map[string]string)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
 
-	for {
-		var entry Entry
-		data := []byte{}
-		if err := entry.UnmarshalJSON(data); err != nil {
+	offset := int64(0)
+	for offset < int64(len(data)) {
+		rest := data[offset:]
+		// 不完整的头部只可能是写到一半的尾部
+		if len(rest) < headerSize {
 			break
-		} else {
-			result[entry.Key] = entry.Value
 		}
+		if crc32.Checksum(rest[4:9], crcTable) != binary.LittleEndian.Uint32(rest[0:4]) {
+			// 崩溃后文件尾部可能是尚未写入的全零数据
+			if allZero(rest) {
+				break
+			}
+			return &CorruptionError{Offset: offset, Reason: "header checksum mismatch"}
+		}
+		// 头部校验通过时 length 可信，超出文件末尾说明这是写到一半的最后一条记录
+		length := int64(binary.LittleEndian.Uint32(rest[4:8]))
+		if int64(len(rest))-headerSize < length {
+			break
+		}
+		end := headerSize + length
+		if crc32.Checksum(rest[headerSize:end], crcTable) != binary.LittleEndian.Uint32(rest[9:13]) {
+			// 最后一条记录校验失败视为写入被打断，否则是日志中间损坏
+			if end == int64(len(rest)) {
+				break
+			}
+			return &CorruptionError{Offset: offset, Reason: "checksum mismatch"}
+		}
+		if err := fn(offset, rest[8], rest[headerSize:end]); err != nil {
+			return err
+		}
+		offset += end
+	}
 
+	if truncate && offset < int64(len(data)) {
+		// 截掉不完整的尾部，避免之后追加的记录接在垃圾数据后面
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
 	}
-	return result, nil
+	return nil
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
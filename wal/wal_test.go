@@ -0,0 +1,415 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeEntries(t *testing.T, filename string, entries []Entry) []int64 {
+	t.Helper()
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer w.Close()
+
+	// 记录每条记录写完后的文件大小，即记录边界
+	var boundaries []int64
+	for _, e := range entries {
+		if e.Deleted {
+			err = w.Delete(e.Key)
+		} else {
+			err = w.Write(e.Key, e.Value)
+		}
+		if err != nil {
+			t.Fatalf("Failed to write WAL: %v", err)
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatalf("Failed to stat WAL: %v", err)
+		}
+		boundaries = append(boundaries, info.Size())
+	}
+	return boundaries
+}
+
+func testEntries() []Entry {
+	entries := []Entry{
+		{Key: []byte("key1"), Value: []byte("value1")},
+		{Key: []byte("key2"), Value: []byte{}},
+		{Key: []byte("key1"), Deleted: true},
+		{Key: []byte{}, Value: []byte("empty key")},
+		{Key: []byte("binary\x00\xff"), Value: []byte("line\nbreak")},
+	}
+	for i := 0; i < 5; i++ {
+		entries = append(entries, Entry{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte(fmt.Sprintf("value%d", i))})
+	}
+	return entries
+}
+
+func equalEntry(a, b Entry) bool {
+	return bytes.Equal(a.Key, b.Key) && bytes.Equal(a.Value, b.Value) && a.Deleted == b.Deleted && a.Merge == b.Merge && a.ExpiresAt == b.ExpiresAt && a.Family == b.Family
+}
+
+func TestRecoverWAL(t *testing.T) {
+	filename := t.TempDir() + "/wal.log"
+	entries := testEntries()
+	writeEntries(t, filename, entries)
+
+	recovered, err := RecoverWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	if len(recovered) != len(entries) {
+		t.Fatalf("Recovered %d entries, expected %d", len(recovered), len(entries))
+	}
+	for i := range entries {
+		if !equalEntry(recovered[i], entries[i]) {
+			t.Errorf("Entry %d: got %+v, expected %+v", i, recovered[i], entries[i])
+		}
+	}
+
+	// 文件不存在时返回空结果
+	recovered, err = RecoverWAL(t.TempDir() + "/missing.log")
+	if err != nil || len(recovered) != 0 {
+		t.Errorf("Expected empty result for missing WAL, got %v, %v", recovered, err)
+	}
+}
+
+// 模拟写入进程在任意字节处被杀死：截断到每一个可能的长度后恢复
+func TestRecoverWALTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	full := dir + "/full.log"
+	entries := testEntries()
+	boundaries := writeEntries(t, full, entries)
+	data, err := os.ReadFile(full)
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+
+	for cut := 0; cut <= len(data); cut++ {
+		filename := fmt.Sprintf("%s/torn-%d.log", dir, cut)
+		if err := os.WriteFile(filename, data[:cut], 0644); err != nil {
+			t.Fatalf("Failed to write torn WAL: %v", err)
+		}
+
+		// 期望恢复出所有完整写入的记录
+		complete := 0
+		valid := int64(0)
+		for complete < len(boundaries) && boundaries[complete] <= int64(cut) {
+			valid = boundaries[complete]
+			complete++
+		}
+
+		recovered, err := RecoverWAL(filename)
+		if err != nil {
+			t.Fatalf("cut=%d: unexpected error: %v", cut, err)
+		}
+		if len(recovered) != complete {
+			t.Fatalf("cut=%d: recovered %d entries, expected %d", cut, len(recovered), complete)
+		}
+		for i := range recovered {
+			if !equalEntry(recovered[i], entries[i]) {
+				t.Fatalf("cut=%d: entry %d mismatch: %+v", cut, i, recovered[i])
+			}
+		}
+
+		// 不完整的尾部应被截断
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatalf("Failed to stat WAL: %v", err)
+		}
+		if info.Size() != valid {
+			t.Fatalf("cut=%d: file size %d after recovery, expected %d", cut, info.Size(), valid)
+		}
+	}
+}
+
+func TestRecoverWALAppendAfterTruncate(t *testing.T) {
+	filename := t.TempDir() + "/wal.log"
+	entries := testEntries()
+	boundaries := writeEntries(t, filename, entries[:3])
+
+	// 在第三条记录中间截断
+	if err := os.Truncate(filename, boundaries[1]+3); err != nil {
+		t.Fatalf("Failed to truncate WAL: %v", err)
+	}
+	if _, err := RecoverWAL(filename); err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+
+	// 截断后继续追加，新记录应能正常回放
+	writeEntries(t, filename, entries[3:])
+	recovered, err := RecoverWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	expected := append(append([]Entry{}, entries[:2]...), entries[3:]...)
+	if len(recovered) != len(expected) {
+		t.Fatalf("Recovered %d entries, expected %d", len(recovered), len(expected))
+	}
+	for i := range expected {
+		if !equalEntry(recovered[i], expected[i]) {
+			t.Errorf("Entry %d: got %+v, expected %+v", i, recovered[i], expected[i])
+		}
+	}
+}
+
+func TestRecoverWALCorruption(t *testing.T) {
+	filename := t.TempDir() + "/wal.log"
+	boundaries := writeEntries(t, filename, testEntries())
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+
+	// 破坏第三条记录的 payload
+	data[boundaries[1]+headerSize+1] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+
+	_, err = RecoverWAL(filename)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected CorruptionError, got %v", err)
+	}
+	if corruption.Offset != boundaries[1] {
+		t.Errorf("Corruption reported at offset %d, expected %d", corruption.Offset, boundaries[1])
+	}
+
+	// 中间损坏时不能截断文件
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("WAL was modified after corruption: size %d, expected %d", info.Size(), len(data))
+	}
+}
+
+func TestRecoverWALCorruptedLength(t *testing.T) {
+	filename := t.TempDir() + "/wal.log"
+	boundaries := writeEntries(t, filename, testEntries())
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+
+	// 第二条记录的 length 指向文件末尾之后，不能被当作写到一半的尾部
+	binary.LittleEndian.PutUint32(data[boundaries[0]+4:], 1<<30)
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+	_, err = RecoverWAL(filename)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected CorruptionError, got %v", err)
+	}
+	if corruption.Offset != boundaries[0] {
+		t.Errorf("Corruption reported at offset %d, expected %d", corruption.Offset, boundaries[0])
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("WAL was truncated after corruption: size %d, expected %d", info.Size(), len(data))
+	}
+
+	// MANIFEST 使用同样的格式
+	manifest := t.TempDir() + "/MANIFEST"
+	var records []byte
+	for _, payload := range []string{"edit1", "edit2", "edit3"} {
+		records = append(records, EncodeRecord([]byte(payload))...)
+	}
+	second := len(EncodeRecord([]byte("edit1")))
+	binary.LittleEndian.PutUint32(records[second+4:], 1<<30)
+	if err := os.WriteFile(manifest, records, 0644); err != nil {
+		t.Fatalf("Failed to write MANIFEST: %v", err)
+	}
+	if _, err := ReadRecords(manifest); !errors.As(err, &corruption) || corruption.Offset != int64(second) {
+		t.Errorf("Expected CorruptionError at offset %d, got %v", second, err)
+	}
+
+	// 崩溃留下的全零尾部仍按不完整的尾部处理
+	if err := os.WriteFile(manifest, append(EncodeRecord([]byte("edit1")), make([]byte, 64)...), 0644); err != nil {
+		t.Fatalf("Failed to write MANIFEST: %v", err)
+	}
+	payloads, err := ReadRecords(manifest)
+	if err != nil || len(payloads) != 1 {
+		t.Errorf("ReadRecords with a zeroed tail returned %d records, %v", len(payloads), err)
+	}
+}
+
+func TestRecoverWALBatch(t *testing.T) {
+	filename := t.TempDir() + "/wal.log"
+	// 带过期时间的记录、merge 操作数和其他列族的记录只能通过批量写入
+	entries := append(testEntries(),
+		Entry{Key: []byte("session"), Value: []byte("ttl"), ExpiresAt: time.Now().Add(time.Hour).UnixNano()},
+		Entry{Key: []byte("counter"), Value: []byte{1, 0, 0, 0, 0, 0, 0, 0}, Merge: true},
+		Entry{Key: []byte("user:1"), Value: []byte("alice"), Family: 3},
+		Entry{Key: []byte("expires"), Value: []byte("soon"), ExpiresAt: time.Now().Add(time.Minute).UnixNano(), Family: 200},
+	)
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	if err := w.Write(entries[0].Key, entries[0].Value); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	first := info.Size()
+	if err := w.WriteBatch(100, entries[1:]); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	w.Close()
+
+	recovered, err := RecoverWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	if len(recovered) != len(entries) {
+		t.Fatalf("Recovered %d entries, expected %d", len(recovered), len(entries))
+	}
+	for i := range entries {
+		if !equalEntry(recovered[i], entries[i]) {
+			t.Errorf("Entry %d: got %+v, expected %+v", i, recovered[i], entries[i])
+		}
+		// 批内记录的序列号依次递增，单条写入的记录没有序列号
+		expectedSeq := uint64(0)
+		if i > 0 {
+			expectedSeq = uint64(99 + i)
+		}
+		if recovered[i].Seq != expectedSeq {
+			t.Errorf("Entry %d has seq %d, expected %d", i, recovered[i].Seq, expectedSeq)
+		}
+	}
+
+	// 批量记录写到一半时整批丢弃
+	if err := os.Truncate(filename, first+headerSize+5); err != nil {
+		t.Fatalf("Failed to truncate WAL: %v", err)
+	}
+	recovered, err = RecoverWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover WAL: %v", err)
+	}
+	if len(recovered) != 1 || !equalEntry(recovered[0], entries[0]) {
+		t.Errorf("Recovered %d entries from a torn batch, expected only the first entry", len(recovered))
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncEveryWrite, SyncInterval, SyncBytes, SyncNever} {
+		filename := t.TempDir() + "/wal.log"
+		w, err := NewWALWithOptions(filename, &Options{SyncMode: mode, SyncInterval: time.Millisecond, SyncBytes: 1024})
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		// 并发写入共享 fsync，每条记录仍然完整地出现在日志中
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if err := w.Write([]byte(fmt.Sprintf("k%d-%d", i, j)), []byte("v")); err != nil {
+						t.Errorf("Failed to write WAL: %v", err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := w.Sync(); err != nil {
+			t.Errorf("mode %d: Sync failed: %v", mode, err)
+		}
+		if mode != SyncNever && w.synced.Load() != w.written {
+			t.Errorf("mode %d: synced %d of %d bytes", mode, w.synced.Load(), w.written)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("mode %d: Close failed: %v", mode, err)
+		}
+		// 重复关闭返回第一次的结果
+		if err := w.Close(); err != nil {
+			t.Errorf("mode %d: second Close returned %v", mode, err)
+		}
+
+		recovered, err := RecoverWAL(filename)
+		if err != nil {
+			t.Fatalf("Failed to recover WAL: %v", err)
+		}
+		if len(recovered) != 400 {
+			t.Errorf("mode %d: recovered %d entries, expected 400", mode, len(recovered))
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, mode := range []SyncMode{SyncEveryWrite, SyncBytes, SyncNever} {
+		b.Run(fmt.Sprintf("mode-%d", mode), func(b *testing.B) {
+			w, err := NewWALWithOptions(b.TempDir()+"/wal.log", &Options{SyncMode: mode})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			value := bytes.Repeat([]byte("v"), 100)
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := w.Write([]byte("key"), value); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestReadBatches(t *testing.T) {
+	filename := t.TempDir() + "/wal.log"
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	written := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := testEntries()
+	if err := w.AppendBatch(Batch{Seq: 7, Time: written, Entries: entries[:3]}); err != nil {
+		t.Fatalf("Failed to append batch: %v", err)
+	}
+	if err := w.WriteBatch(10, entries[3:]); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	w.Close()
+
+	// 模拟正在追加的记录，ReadBatches 忽略它且不修改文件
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	before, _ := os.Stat(filename)
+
+	batches, err := ReadBatches(filename)
+	if err != nil {
+		t.Fatalf("Failed to read batches: %v", err)
+	}
+	if len(batches) != 2 || batches[0].Seq != 7 || batches[1].Seq != 10 || len(batches[1].Entries) != len(entries)-3 {
+		t.Fatalf("Unexpected batches: %+v", batches)
+	}
+	if !batches[0].Time.Equal(written) || batches[1].Time.Before(written) {
+		t.Errorf("Unexpected batch times %v, %v", batches[0].Time, batches[1].Time)
+	}
+	if after, _ := os.Stat(filename); after.Size() != before.Size() {
+		t.Errorf("ReadBatches changed the file size from %d to %d", before.Size(), after.Size())
+	}
+}